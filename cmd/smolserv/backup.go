@@ -0,0 +1,158 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/storage/backup"
+	"github.com/lucasreed/smol/pkg/storage/boltdb"
+)
+
+var (
+	backupDir      string
+	backupFile     string
+	backupInterval time.Duration
+	backupKeep     int
+	backupServer   string
+)
+
+func init() {
+	backupCmd.Flags().StringVarP(&backupFile, "file", "f", "-", "file to write the snapshot to, - for stdout")
+	backupCmd.Flags().StringVar(&backupServer, "server", "", "base URL of a running smolserv to fetch the snapshot from, such as http://localhost:8080")
+	rootCmd.Flags().StringVar(&backupDir, "backup-dir", "", "directory to write scheduled database snapshots to, empty disables them")
+	rootCmd.Flags().DurationVar(&backupInterval, "backup-interval", 24*time.Hour, "how often to snapshot the database into --backup-dir")
+	rootCmd.Flags().IntVar(&backupKeep, "backup-keep", 7, "number of snapshots to keep in --backup-dir, 0 keeps them all")
+}
+
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Writes a consistent snapshot of the bolt database.",
+	Long: `Writes a consistent snapshot of the bolt database. With --server the snapshot
+is streamed from a running smolserv through /api/v1/admin/backup, which needs
+--admin-token. Without it the file at --boltdb-path is read directly, which
+only works while no server has it open.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runBackup(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func runBackup(ctx context.Context) error {
+	if backupServer == "" && storageType != "boltdb" {
+		return fmt.Errorf("backups are only supported with --storage boltdb, not %s", storageType)
+	}
+	var w io.Writer = os.Stdout
+	if backupFile != "-" {
+		f, err := os.Create(backupFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	var n int64
+	var err error
+	if backupServer != "" {
+		n, err = fetchBackup(ctx, w)
+	} else {
+		n, err = boltdb.BackupFile(ctx, boltdbPath, boltLockTimeout, w)
+		if err != nil {
+			err = fmt.Errorf("%w. Is smolserv running? Use --server to back up a live database", err)
+		}
+	}
+	if err != nil {
+		if backupFile != "-" {
+			os.Remove(backupFile)
+		}
+		return fmt.Errorf("error backing up - %w", err)
+	}
+	log.Printf("wrote a %d byte backup", n)
+	return nil
+}
+
+// fetchBackup copies the snapshot served by the admin endpoint of
+// --server into w
+func fetchBackup(ctx context.Context, w io.Writer) (int64, error) {
+	token := adminToken
+	if token == "" {
+		token = os.Getenv("SMOL_ADMIN_TOKEN")
+	}
+	url := strings.TrimSuffix(backupServer, "/") + "/api/v1/admin/backup"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return 0, fmt.Errorf("%s returned %s: %s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return n, err
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return n, fmt.Errorf("%s sent %d of %d bytes", url, n, resp.ContentLength)
+	}
+	return n, nil
+}
+
+// scheduleBackups snapshots b into dir every interval, keeping the newest
+// keep snapshots, until stop is closed
+func scheduleBackups(b data.Backuper, dir string, interval time.Duration, keep int, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			path, err := backup.Snapshot(ctx, b, dir, time.Now())
+			cancel()
+			if err != nil {
+				log.Println("error writing scheduled backup - ", err)
+				continue
+			}
+			log.Printf("wrote backup %s", path)
+			removed, err := backup.Prune(dir, keep)
+			if err != nil {
+				log.Println("error pruning old backups - ", err)
+			}
+			for _, path := range removed {
+				log.Printf("removed old backup %s", path)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
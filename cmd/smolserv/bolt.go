@@ -0,0 +1,110 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lucasreed/smol/pkg/storage/boltdb"
+)
+
+// boltLockTimeout is how long the offline bolt commands wait for the file
+// lock, which a running smolserv holds
+const boltLockTimeout = 5 * time.Second
+
+var (
+	compactOutput  string
+	compactReplace bool
+)
+
+func init() {
+	boltCmd.AddCommand(boltCompactCmd)
+	boltCmd.AddCommand(boltCheckCmd)
+	boltCompactCmd.Flags().StringVarP(&compactOutput, "output", "o", "", "file to write the compacted database to, defaults to --boltdb-path with a .compact suffix")
+	boltCompactCmd.Flags().BoolVar(&compactReplace, "replace", false, "replace --boltdb-path with the compacted file once it is written")
+}
+
+var boltCmd = &cobra.Command{
+	Use:   "bolt",
+	Short: "Maintenance commands for the bolt database file.",
+	Long: `Maintenance commands for the bolt database at --boltdb-path. They read the
+file directly, so smolserv has to be stopped first.`,
+}
+
+var boltCompactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "Rewrites the bolt database into a fresh, compact file.",
+	Long: `Rewrites the bolt database into a fresh file. Bolt never returns freed pages
+to the filesystem, so a file that has seen a lot of deletes can shrink a lot.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runCompact(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var boltCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Verifies every short code and destination mapping is paired.",
+	Long: `Verifies that every link can be found from its destination and that every
+destination maps back to a link pointing at it. Problems are printed one per
+line and make the command exit with status 1.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ok, err := runCheck(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+	},
+}
+
+func runCompact(ctx context.Context) error {
+	output := compactOutput
+	if output == "" {
+		output = boltdbPath + ".compact"
+	}
+	stats, err := boltdb.Compact(ctx, boltdbPath, output, boltLockTimeout)
+	if err != nil {
+		return fmt.Errorf("error compacting - %w", err)
+	}
+	log.Printf("compacted %s from %d to %d bytes into %s", boltdbPath, stats.Before, stats.After, output)
+	if compactReplace {
+		if err = os.Rename(output, boltdbPath); err != nil {
+			return fmt.Errorf("error replacing %s - %w", boltdbPath, err)
+		}
+		log.Printf("replaced %s", boltdbPath)
+	}
+	return nil
+}
+
+func runCheck(ctx context.Context) (bool, error) {
+	report, err := boltdb.Check(ctx, boltdbPath, boltLockTimeout)
+	if err != nil {
+		return false, fmt.Errorf("error checking - %w", err)
+	}
+	for _, p := range report.Problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("checked %d links and %d mappings, found %d problems\n", report.Links, report.Mappings, len(report.Problems))
+	return len(report.Problems) == 0, nil
+}
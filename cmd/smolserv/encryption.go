@@ -0,0 +1,112 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/storage/encryption"
+)
+
+var (
+	encryptionKey     string
+	encryptionOldKeys []string
+)
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&encryptionKey, "encryption-key", "", "base64 encoded 32 byte key to encrypt stored destinations with, defaults to $SMOL_ENCRYPTION_KEY. Destinations are stored in plaintext without one")
+	rootCmd.PersistentFlags().StringSliceVar(&encryptionOldKeys, "encryption-old-keys", nil, "comma separated keys that stored destinations may still be encrypted with, defaults to $SMOL_ENCRYPTION_OLD_KEYS")
+}
+
+var rotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Re-encrypts every stored destination with --encryption-key.",
+	Long: `Re-encrypts every stored destination with --encryption-key, reading the ones
+encrypted with --encryption-old-keys and encrypting the ones stored in
+plaintext. Once it finishes the old keys can be dropped.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runRotate(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func runRotate(ctx context.Context) error {
+	keys, err := encryptionKeys()
+	if err != nil {
+		return err
+	}
+	if keys == nil {
+		return errors.New("rotate needs --encryption-key")
+	}
+	store, err := setupStorage(storageType)
+	if err != nil {
+		return fmt.Errorf("error setting up storage - %w", err)
+	}
+	defer closeStorage(store)
+
+	stats, err := encryption.New(store, keys[0], keys[1:]...).Rotate(ctx)
+	log.Printf("rewrote %d links, %d were already encrypted with key %s", stats.Rewritten, stats.Current, keys[0].ID())
+	if err != nil {
+		return fmt.Errorf("error rotating - %w", err)
+	}
+	return nil
+}
+
+// encryptStorage wraps store so that destinations are encrypted, if a key is
+// configured
+func encryptStorage(store data.StorageReadWrite) (data.StorageReadWrite, error) {
+	keys, err := encryptionKeys()
+	if err != nil || keys == nil {
+		return store, err
+	}
+	return encryption.New(store, keys[0], keys[1:]...), nil
+}
+
+// encryptionKeys parses the current key followed by the old ones, or returns
+// nil if there is no current key. The environment is read here rather than in
+// the flag defaults so that --help never prints a key.
+func encryptionKeys() ([]*encryption.Key, error) {
+	current, old := encryptionKey, encryptionOldKeys
+	if current == "" {
+		current = os.Getenv("SMOL_ENCRYPTION_KEY")
+	}
+	if len(old) == 0 && os.Getenv("SMOL_ENCRYPTION_OLD_KEYS") != "" {
+		old = strings.Split(os.Getenv("SMOL_ENCRYPTION_OLD_KEYS"), ",")
+	}
+	if current == "" {
+		if len(old) > 0 {
+			return nil, errors.New("--encryption-old-keys needs --encryption-key")
+		}
+		return nil, nil
+	}
+	var keys []*encryption.Key
+	for _, encoded := range append([]string{current}, old...) {
+		key, err := encryption.ParseKey(encoded)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
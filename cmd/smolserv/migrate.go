@@ -0,0 +1,143 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/storage/migrate"
+)
+
+var (
+	migrateBatchSize  int
+	migrateCheckpoint string
+	migrateDryRun     bool
+	migrateFrom       string
+	migrateTo         string
+	migrateVerify     bool
+)
+
+func init() {
+	migrateCmd.Flags().StringVar(&migrateFrom, "from", "", "storage backend to copy links from")
+	migrateCmd.Flags().StringVar(&migrateTo, "to", "", "storage backend to copy links into")
+	migrateCmd.Flags().IntVar(&migrateBatchSize, "batch-size", migrate.DefaultBatchSize, "number of links read from the source at a time")
+	migrateCmd.Flags().StringVar(&migrateCheckpoint, "checkpoint", "", "file to record progress in. An interrupted migration rerun with the same file resumes where it stopped")
+	migrateCmd.Flags().BoolVar(&migrateDryRun, "dry-run", false, "report what would be copied without writing anything")
+	migrateCmd.Flags().BoolVar(&migrateVerify, "verify", false, "after copying, check every source link can be read back from the destination")
+	_ = migrateCmd.MarkFlagRequired("from")
+	_ = migrateCmd.MarkFlagRequired("to")
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Copies every link from one storage backend to another.",
+	Long: `Copies every link from one storage backend to another, for example
+smolserv migrate --from boltdb --to redis. Each backend is configured with
+the same flags smolserv itself uses. Links already in the destination are
+never overwritten, so a migration can safely be run again.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runMigrate(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// runMigrate does the work of migrateCmd, returning rather than exiting on
+// errors so that both stores are always closed and flushed
+func runMigrate(ctx context.Context) error {
+	if migrateFrom == migrateTo {
+		return errors.New("--from and --to must be different backends")
+	}
+	src, err := setupStorage(migrateFrom)
+	if err != nil {
+		return fmt.Errorf("error setting up source storage - %w", err)
+	}
+	defer closeStorage(src)
+	dst, err := setupStorage(migrateTo)
+	if err != nil {
+		return fmt.Errorf("error setting up destination storage - %w", err)
+	}
+	defer closeStorage(dst)
+
+	opts := migrate.Options{BatchSize: migrateBatchSize, DryRun: migrateDryRun}
+	if migrateCheckpoint != "" {
+		opts.Cursor, err = readCheckpoint(migrateCheckpoint)
+		if err != nil {
+			return fmt.Errorf("error reading checkpoint - %w", err)
+		}
+		if opts.Cursor != "" {
+			log.Printf("resuming from checkpoint %s", opts.Cursor)
+		}
+		opts.Checkpoint = func(cursor string) error {
+			return ioutil.WriteFile(migrateCheckpoint, []byte(cursor), 0600)
+		}
+	}
+
+	stats, err := migrate.Copy(ctx, src, dst, opts)
+	prefix := ""
+	if migrateDryRun {
+		prefix = "dry run: "
+	}
+	fmt.Printf("%sread %d, copied %d, already present %d, conflicts %d\n", prefix, stats.Read, stats.Copied, stats.Existing, stats.Conflicts)
+	if err != nil {
+		return fmt.Errorf("error migrating - %w", err)
+	}
+	if migrateCheckpoint != "" && !migrateDryRun {
+		if err = os.Remove(migrateCheckpoint); err != nil && !os.IsNotExist(err) {
+			log.Println("error removing checkpoint - ", err)
+		}
+	}
+
+	if !migrateVerify || migrateDryRun {
+		return nil
+	}
+	v, err := migrate.Verify(ctx, src, dst, migrateBatchSize)
+	if err != nil {
+		return fmt.Errorf("error verifying - %w", err)
+	}
+	fmt.Printf("verify: source %d, matched %d, missing %d, mismatched %d\n", v.Source, v.Matched, v.Missing, v.Mismatched)
+	if !v.OK() {
+		return errors.New("verification failed")
+	}
+	return nil
+}
+
+func closeStorage(store data.StorageReadWrite) {
+	if err := store.Close(); err != nil {
+		log.Println("error closing storage - ", err)
+	}
+}
+
+// readCheckpoint returns the cursor saved by an earlier run, or an empty
+// cursor if there is no checkpoint yet
+func readCheckpoint(path string) (string, error) {
+	cursor, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(cursor)), nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lucasreed/smol/pkg/storage/rediscache"
+)
+
+var rebalanceCmd = &cobra.Command{
+	Use:   "rebalance",
+	Short: "Moves redis keys onto the shards listed in --redis-host.",
+	Long: `Moves redis keys onto the shards listed in --redis-host, after servers have
+been added to or removed from the list. Instances running with either list
+stop taking writes while it runs, answering them with 503, and look links up
+under both lists. Restart every instance with the new list once it is done;
+instances still using the old one keep refusing writes.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runRebalance(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func runRebalance(ctx context.Context) error {
+	if len(redisHosts) < 2 {
+		return errors.New("rebalance needs --redis-host to list the shards")
+	}
+	store, err := setupStorage("redis")
+	if err != nil {
+		return fmt.Errorf("error setting up storage - %w", err)
+	}
+	defer closeStorage(store)
+
+	moved, err := store.(*rediscache.Store).Rebalance(ctx)
+	log.Printf("moved %d keys", moved)
+	if err != nil {
+		return fmt.Errorf("error rebalancing - %w", err)
+	}
+	return nil
+}
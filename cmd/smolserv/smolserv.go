@@ -15,36 +15,102 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net"
+	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 
 	"github.com/lucasreed/smol/pkg/app"
 	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/storage/badgerdb"
 	"github.com/lucasreed/smol/pkg/storage/boltdb"
+	"github.com/lucasreed/smol/pkg/storage/cache"
+	"github.com/lucasreed/smol/pkg/storage/events"
+	"github.com/lucasreed/smol/pkg/storage/hits"
+	"github.com/lucasreed/smol/pkg/storage/memory"
+	"github.com/lucasreed/smol/pkg/storage/postgres"
 	"github.com/lucasreed/smol/pkg/storage/rediscache"
+	"github.com/lucasreed/smol/pkg/storage/sqlite"
 )
 
 var (
-	boltdbPath  string
-	listen      string
-	listenPort  string
-	redisHost   string
-	redisPort   string
-	storageType string
-	version     = "development"
-	commit      = "n/a"
+	adminToken             string
+	badgerPath             string
+	boltdbPath             string
+	cacheNegativeTTL       time.Duration
+	cacheSize              int
+	cacheTTL               time.Duration
+	expiredRetention       time.Duration
+	hitFlushInterval       time.Duration
+	deleteQuarantine       time.Duration
+	eventsChannel          string
+	listen                 string
+	listenPort             string
+	memorySnapshotPath     string
+	memorySnapshotInterval time.Duration
+	postgresDSN            string
+	redisHosts             []string
+	redisOpts              = rediscache.DefaultOptions()
+	requestTimeout         time.Duration
+	sqlitePath             string
+	storageType            string
+	sweepInterval          time.Duration
+	version                = "development"
+	commit                 = "n/a"
 )
 
 func init() {
 	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(migrateCmd)
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(importCmd)
+	rootCmd.AddCommand(backupCmd)
+	rootCmd.AddCommand(boltCmd)
+	rootCmd.AddCommand(rotateCmd)
+	rootCmd.AddCommand(rebalanceCmd)
 	rootCmd.Flags().StringVarP(&listen, "listen-ip", "i", "0.0.0.0", "IP to listen on")
 	rootCmd.Flags().StringVarP(&listenPort, "listen-port", "p", "8080", "port to listen on")
-	rootCmd.Flags().StringVar(&storageType, "storage", "boltdb", "What storage backend to use. Valid options: redis, boltdb")
-	rootCmd.Flags().StringVar(&boltdbPath, "boltdb-path", "./boltdb", "location of boltdb file")
-	rootCmd.Flags().StringVar(&redisHost, "redis-host", "localhost", "hostname/IP of redis")
-	rootCmd.Flags().StringVar(&redisPort, "redis-port", "6379", "port redis is listening on")
+	rootCmd.PersistentFlags().StringVar(&adminToken, "admin-token", "", "bearer token for the /api/v1/admin endpoints, defaults to $SMOL_ADMIN_TOKEN. They are disabled without one")
+	rootCmd.Flags().DurationVar(&requestTimeout, "request-timeout", app.DefaultRequestTimeout, "maximum time a request, including storage calls, may take. 0 disables the limit")
+	rootCmd.PersistentFlags().StringVar(&storageType, "storage", "boltdb", "What storage backend to use. Valid options: redis, boltdb, badger, postgres, sqlite, memory")
+	rootCmd.PersistentFlags().StringVar(&boltdbPath, "boltdb-path", "./boltdb", "location of boltdb file")
+	rootCmd.PersistentFlags().StringVar(&badgerPath, "badger-path", "./badger", "directory of the badger database")
+	rootCmd.PersistentFlags().StringSliceVar(&redisHosts, "redis-host", []string{redisOpts.Host}, "hostname/IP of redis. A comma separated list, each optionally with its own :port, spreads links over independent servers by consistent hashing")
+	rootCmd.PersistentFlags().StringVar(&redisOpts.Port, "redis-port", redisOpts.Port, "port redis is listening on")
+	rootCmd.PersistentFlags().StringVar(&redisOpts.Username, "redis-username", "", "ACL username for redis, empty uses the default user")
+	rootCmd.PersistentFlags().StringVar(&redisOpts.Password, "redis-password", "", "password for redis, defaults to $SMOL_REDIS_PASSWORD")
+	rootCmd.PersistentFlags().IntVar(&redisOpts.DB, "redis-db", 0, "redis database index")
+	rootCmd.PersistentFlags().BoolVar(&redisOpts.TLS, "redis-tls", false, "connect to redis over TLS")
+	rootCmd.PersistentFlags().StringVar(&redisOpts.TLSCAFile, "redis-tls-ca", "", "PEM file of extra CAs to trust for redis TLS")
+	rootCmd.PersistentFlags().StringVar(&redisOpts.TLSServerName, "redis-tls-server-name", "", "server name to verify the redis certificate against, defaults to the host")
+	rootCmd.PersistentFlags().BoolVar(&redisOpts.TLSSkipVerify, "redis-tls-skip-verify", false, "don't verify the redis server certificate")
+	rootCmd.PersistentFlags().DurationVar(&redisOpts.ConnectTimeout, "redis-connect-timeout", redisOpts.ConnectTimeout, "timeout for connecting to redis")
+	rootCmd.PersistentFlags().DurationVar(&redisOpts.ReadTimeout, "redis-read-timeout", 0, "timeout for reading a redis reply, 0 waits forever")
+	rootCmd.PersistentFlags().DurationVar(&redisOpts.WriteTimeout, "redis-write-timeout", 0, "timeout for writing a redis command, 0 waits forever")
+	rootCmd.PersistentFlags().IntVar(&redisOpts.MaxIdle, "redis-max-idle", redisOpts.MaxIdle, "maximum idle connections kept in the redis pool")
+	rootCmd.PersistentFlags().IntVar(&redisOpts.MaxActive, "redis-max-active", redisOpts.MaxActive, "maximum open connections in the redis pool, 0 is unlimited")
+	rootCmd.PersistentFlags().DurationVar(&redisOpts.IdleTimeout, "redis-idle-timeout", redisOpts.IdleTimeout, "close redis connections idle for longer than this, 0 keeps them")
+	rootCmd.PersistentFlags().BoolVar(&redisOpts.Wait, "redis-pool-wait", false, "wait for a free connection when the redis pool is exhausted instead of failing")
+	rootCmd.PersistentFlags().StringSliceVar(&redisOpts.SentinelAddrs, "redis-sentinel-addrs", nil, "comma separated host:port list of sentinels, enables sentinel discovery")
+	rootCmd.PersistentFlags().StringVar(&redisOpts.SentinelMaster, "redis-sentinel-master", "", "name of the master monitored by sentinel")
+	rootCmd.PersistentFlags().StringVar(&redisOpts.SentinelPassword, "redis-sentinel-password", "", "password for sentinel, defaults to $SMOL_REDIS_SENTINEL_PASSWORD")
+	rootCmd.PersistentFlags().StringSliceVar(&redisOpts.ClusterAddrs, "redis-cluster-addrs", nil, "comma separated host:port list of redis cluster startup nodes, enables cluster mode")
+	rootCmd.PersistentFlags().StringVar(&postgresDSN, "postgres-dsn", "postgres://localhost:5432/smol?sslmode=disable", "connection string for postgres")
+	rootCmd.PersistentFlags().StringVar(&sqlitePath, "sqlite-path", "./smol.sqlite", "location of sqlite database file")
+	rootCmd.PersistentFlags().StringVar(&memorySnapshotPath, "memory-snapshot-path", "", "file to load and save memory storage snapshots, empty keeps data in memory only")
+	rootCmd.PersistentFlags().DurationVar(&memorySnapshotInterval, "memory-snapshot-interval", 0, "how often to snapshot memory storage to disk, 0 only snapshots on shutdown")
+	rootCmd.PersistentFlags().DurationVar(&expiredRetention, "expired-retention", 24*time.Hour, "how long expired links keep answering 410 Gone before they are removed")
+	rootCmd.PersistentFlags().DurationVar(&deleteQuarantine, "delete-quarantine", 30*24*time.Hour, "how long deleted links keep answering 410 Gone, and their short codes stay reserved, before they are removed")
+	rootCmd.Flags().DurationVar(&sweepInterval, "sweep-interval", 10*time.Minute, "how often backends without native expiry remove expired and deleted links, 0 disables sweeping")
+	rootCmd.Flags().DurationVar(&hitFlushInterval, "hit-flush-interval", time.Second, "how often hits on links without a click limit are written in a batch, 0 writes each one before redirecting")
+	rootCmd.Flags().IntVar(&cacheSize, "cache-size", 0, "number of short code lookups to keep in an in-process LRU cache, 0 disables the cache")
+	rootCmd.Flags().DurationVar(&cacheTTL, "cache-ttl", time.Minute, "how long a cached lookup is served before going back to storage")
+	rootCmd.Flags().StringVar(&eventsChannel, "events-channel", events.DefaultChannel, "redis pub/sub channel link changes are published on and received from, empty keeps them in-process")
+	rootCmd.Flags().DurationVar(&cacheNegativeTTL, "cache-negative-ttl", 10*time.Second, "how long a lookup of an unknown short code is cached, 0 doesn't cache misses")
 }
 
 var rootCmd = &cobra.Command{
@@ -52,12 +118,81 @@ var rootCmd = &cobra.Command{
 	Short: "smolserv makes urls smol",
 	Long:  `A simple url shortener API written in go`,
 	Run: func(cmd *cobra.Command, args []string) {
-		storage, err := setupStorage()
+		storage, err := setupStorage(storageType)
 		if err != nil {
 			log.Fatal("error setting up storage - ", err)
 		}
+		stopSweep := make(chan struct{})
+		if sweeper, ok := storage.(data.Sweeper); ok && sweepInterval > 0 {
+			go sweep(sweeper, sweepInterval, expiredRetention, deleteQuarantine, stopSweep)
+		}
+		// the wrappers hide the optional interfaces and the concrete type, so
+		// pick out the backuper and redis before they go on
+		backuper, _ := storage.(data.Backuper)
+		redisStore, _ := storage.(*rediscache.Store)
+		stopBackups := make(chan struct{})
+		if backupDir != "" && backupInterval > 0 {
+			if backuper == nil {
+				log.Fatalf("scheduled backups are not supported with --storage %s", storageType)
+			}
+			go scheduleBackups(backuper, backupDir, backupInterval, backupKeep, stopBackups)
+		}
+		// encryption goes underneath the cache and the feed, so that neither
+		// sees sealed destinations
+		storage, err = encryptStorage(storage)
+		if err != nil {
+			log.Fatal("error setting up encryption - ", err)
+		}
+		feed := events.New(storage)
+		if redisStore != nil && eventsChannel != "" {
+			feed.Transport = redisStore
+			feed.Channel = eventsChannel
+		}
+		if cacheSize > 0 {
+			cached := cache.New(storage, cacheSize, cacheTTL, cacheNegativeTTL)
+			feed.StorageReadWrite = cached
+			// events from other instances are read back past the cache, which
+			// hasn't been invalidated yet when they arrive
+			feed.Lookup = storage
+			// changes made by other instances reach the cache through the feed
+			changes, _ := feed.Subscribe(cacheSize)
+			go func() {
+				for e := range changes {
+					cached.Invalidate(e.ShortCode)
+				}
+			}()
+		}
+		listenCtx, stopListening := context.WithCancel(context.Background())
+		go feed.Listen(listenCtx)
+		storage = feed
 		app := app.NewServer(storage, listen+":"+listenPort)
+		app.RequestTimeout = requestTimeout
+		app.AdminToken = adminToken
+		app.Backups = backuper
+		app.Backend = storageType
+		if app.AdminToken == "" {
+			app.AdminToken = os.Getenv("SMOL_ADMIN_TOKEN")
+		}
+		stopHits, hitsFlushed := make(chan struct{}), make(chan struct{})
+		if hitFlushInterval > 0 {
+			app.Hits = hits.New(storage)
+			go func() {
+				app.Hits.Run(hitFlushInterval, stopHits)
+				close(hitsFlushed)
+			}()
+		} else {
+			close(hitsFlushed)
+		}
 		app.Run()
+		// the last hits are flushed before storage closes
+		close(stopHits)
+		<-hitsFlushed
+		stopListening()
+		close(stopSweep)
+		close(stopBackups)
+		if err := storage.Close(); err != nil {
+			log.Println("error closing storage - ", err)
+		}
 	},
 }
 
@@ -70,29 +205,105 @@ var versionCmd = &cobra.Command{
 	},
 }
 
-func setupStorage() (data.StorageReadWrite, error) {
+// setupStorage opens the backend named by storageType, configured by the
+// backend specific flags
+func setupStorage(storageType string) (data.StorageReadWrite, error) {
 	var store data.StorageReadWrite
 	switch storageType {
 	case "boltdb":
 		bolt := boltdb.NewStore(boltdbPath)
-		err := bolt.Open()
+		err := bolt.Open(context.Background())
 		if err != nil {
 			return nil, err
 		}
 		store = bolt
+	case "badger":
+		badgerStore := badgerdb.NewStore(badgerPath)
+		err := badgerStore.Open(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		store = badgerStore
 	case "redis":
-		redisStore := rediscache.NewStore(redisHost, redisPort)
-		err := redisStore.Open()
+		// fall back to the environment here rather than in the flag defaults
+		// so that --help never prints a secret
+		if redisOpts.Password == "" {
+			redisOpts.Password = os.Getenv("SMOL_REDIS_PASSWORD")
+		}
+		if redisOpts.SentinelPassword == "" {
+			redisOpts.SentinelPassword = os.Getenv("SMOL_REDIS_SENTINEL_PASSWORD")
+		}
+		// several hosts are shards, each listening on --redis-port unless
+		// it says otherwise
+		redisOpts.Host, redisOpts.Shards = "", nil
+		if len(redisHosts) == 1 {
+			redisOpts.Host = redisHosts[0]
+		} else {
+			for _, host := range redisHosts {
+				if _, _, err := net.SplitHostPort(host); err != nil {
+					host = net.JoinHostPort(host, redisOpts.Port)
+				}
+				redisOpts.Shards = append(redisOpts.Shards, host)
+			}
+		}
+		redisOpts.ExpiredRetention = expiredRetention
+		redisOpts.Quarantine = deleteQuarantine
+		redisStore := rediscache.NewStore(redisOpts)
+		err := redisStore.Open(context.Background())
 		if err != nil {
 			return nil, err
 		}
 		store = redisStore
+	case "postgres":
+		pgStore := postgres.NewStore(postgresDSN)
+		err := pgStore.Open(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		store = pgStore
+	case "sqlite":
+		sqliteStore := sqlite.NewStore(sqlitePath)
+		err := sqliteStore.Open(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		store = sqliteStore
+	case "memory":
+		memStore := memory.NewStore(memorySnapshotPath, memorySnapshotInterval)
+		err := memStore.Open(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		store = memStore
 	default:
 		return nil, fmt.Errorf("not a valid storage backend: %v", storageType)
 	}
 	return store, nil
 }
 
+// sweep removes links from store that expired more than retention ago, and
+// tombstones older than quarantine, every interval until stop is closed
+func sweep(store data.Sweeper, interval, retention, quarantine time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			now := time.Now()
+			n, err := store.Sweep(ctx, now.Add(-retention), now.Add(-quarantine))
+			cancel()
+			if err != nil {
+				log.Println("error sweeping links - ", err)
+			} else if n > 0 {
+				log.Printf("swept %d expired or deleted links", n)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal("error starting smolserv - ", err)
@@ -0,0 +1,145 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lucasreed/smol/pkg/transfer"
+)
+
+var (
+	transferConflict string
+	transferFile     string
+	transferFormat   string
+)
+
+func init() {
+	for _, cmd := range []*cobra.Command{exportCmd, importCmd} {
+		cmd.Flags().StringVar(&transferFormat, "format", "", "json, ndjson or csv. Defaults to the file extension, or json")
+		cmd.Flags().StringVarP(&transferFile, "file", "f", "-", "file to write or read, - for stdout or stdin")
+	}
+	importCmd.Flags().StringVar(&transferConflict, "conflict", string(transfer.Skip), "what to do with short codes that are already in use: skip, overwrite or fail")
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Dumps every link in the configured storage backend.",
+	Long:  `Dumps every link in the storage backend selected with --storage as JSON, NDJSON or CSV.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runExport(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Loads links into the configured storage backend.",
+	Long: `Loads links from a JSON, NDJSON or CSV file, as written by export, into the
+storage backend selected with --storage. CSV files need a header row with
+ShortCode and Destination columns.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runImport(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func runExport(ctx context.Context) error {
+	format, err := transferFileFormat()
+	if err != nil {
+		return err
+	}
+	store, err := setupStorage(storageType)
+	if err != nil {
+		return fmt.Errorf("error setting up storage - %w", err)
+	}
+	defer closeStorage(store)
+	if store, err = encryptStorage(store); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if transferFile != "-" {
+		f, err := os.Create(transferFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	n, err := transfer.Export(ctx, store, w, format)
+	if err != nil {
+		return fmt.Errorf("error exporting - %w", err)
+	}
+	log.Printf("exported %d links", n)
+	return nil
+}
+
+func runImport(ctx context.Context) error {
+	format, err := transferFileFormat()
+	if err != nil {
+		return err
+	}
+	policy, err := transfer.ParsePolicy(transferConflict)
+	if err != nil {
+		return err
+	}
+	store, err := setupStorage(storageType)
+	if err != nil {
+		return fmt.Errorf("error setting up storage - %w", err)
+	}
+	defer closeStorage(store)
+	if store, err = encryptStorage(store); err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if transferFile != "-" {
+		f, err := os.Open(transferFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	stats, err := transfer.Import(ctx, store, r, format, policy)
+	fmt.Printf("created %d, overwritten %d, skipped %d, unchanged %d, invalid %d\n", stats.Created, stats.Overwritten, stats.Skipped, stats.Unchanged, stats.Invalid)
+	if err != nil {
+		return fmt.Errorf("error importing - %w", err)
+	}
+	return nil
+}
+
+// transferFileFormat picks the format from --format, then the extension of
+// --file
+func transferFileFormat() (transfer.Format, error) {
+	if transferFormat != "" {
+		return transfer.ParseFormat(transferFormat)
+	}
+	if ext := strings.TrimPrefix(filepath.Ext(transferFile), "."); ext != "" {
+		return transfer.ParseFormat(ext)
+	}
+	return transfer.JSON, nil
+}
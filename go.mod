@@ -1,11 +1,16 @@
 module github.com/lucasreed/smol
 
-go 1.14
+go 1.16
 
 require (
+	github.com/alicebob/miniredis/v2 v2.17.0
 	github.com/asaskevich/govalidator v0.0.0-20200108200545-475eaeb16496
-	github.com/gomodule/redigo v2.0.0+incompatible
+	github.com/dgraph-io/badger v1.6.2
+	github.com/gomodule/redigo v1.8.5
 	github.com/gorilla/mux v1.7.3
+	github.com/lib/pq v1.10.9
+	github.com/mna/redisc v1.1.7
 	github.com/spf13/cobra v1.0.0
 	go.etcd.io/bbolt v1.3.2
+	modernc.org/sqlite v1.14.1
 )
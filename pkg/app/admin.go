@@ -0,0 +1,114 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/lucasreed/smol/pkg/transfer"
+)
+
+// handleExport streams every link in the format given by the format query
+// parameter, JSON by default
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	format, err := transfer.ParseFormat(queryDefault(r, "format", string(transfer.JSON)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=smol.%s", format))
+	n, err := transfer.Export(r.Context(), s.Storage, w, format)
+	if err != nil {
+		// the status line may already have gone out with the first links,
+		// so abort the connection rather than end the response as if the
+		// export were complete
+		log.Printf("error exporting links after %d - %v\n", n, err)
+		panic(http.ErrAbortHandler)
+	}
+	log.Printf("Exported %d links\n", n)
+}
+
+// handleImport loads the request body in the format given by the format query
+// parameter, resolving taken short codes with the conflict parameter
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	format, err := transfer.ParseFormat(queryDefault(r, "format", string(transfer.JSON)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	policy, err := transfer.ParsePolicy(queryDefault(r, "conflict", string(transfer.Skip)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stats, err := transfer.Import(r.Context(), s.Storage, r.Body, format, policy)
+	status := http.StatusOK
+	body := map[string]interface{}{"stats": stats}
+	if err != nil {
+		log.Printf("error importing links - %v\n", err)
+		status = storageErrorStatus(err, http.StatusBadRequest)
+		if errors.Is(err, transfer.ErrConflict) {
+			status = http.StatusConflict
+		}
+		body["error"] = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err = json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+// handleBackup streams a consistent snapshot of the database, for backends
+// that support it
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if s.Backups == nil {
+		http.Error(w, "backups are not supported by this storage backend", http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=smol.db")
+	n, err := s.Backups.Backup(r.Context(), sizedResponse{w})
+	if err != nil {
+		// the status line has usually gone out already, so abort the
+		// connection rather than end the response as if it were complete
+		log.Printf("error writing backup after %d bytes - %v\n", n, err)
+		panic(http.ErrAbortHandler)
+	}
+	log.Printf("Wrote a %d byte backup\n", n)
+}
+
+// sizedResponse sets the Content-Length of a backup response, so that clients
+// can tell a truncated snapshot from a complete one
+type sizedResponse struct {
+	http.ResponseWriter
+}
+
+func (s sizedResponse) SetBackupSize(n int64) {
+	s.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+}
+
+func queryDefault(r *http.Request, key, fallback string) string {
+	if value := r.URL.Query().Get(key); value != "" {
+		return value
+	}
+	return fallback
+}
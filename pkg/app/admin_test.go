@@ -0,0 +1,146 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/data/models"
+	"github.com/lucasreed/smol/pkg/storage/memory"
+)
+
+func TestAdminAuth(t *testing.T) {
+	for name, tc := range map[string]struct {
+		token, header string
+		want          int
+	}{
+		"disabled":   {"", "Bearer ", http.StatusNotFound},
+		"missing":    {"secret", "", http.StatusUnauthorized},
+		"wrong":      {"secret", "Bearer nope", http.StatusUnauthorized},
+		"authorized": {"secret", "Bearer secret", http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "/api/v1/admin/export", nil)
+		req.Header.Set("Authorization", tc.header)
+		rr := httptest.NewRecorder()
+		adminHandler(tc.token)(http.HandlerFunc(server.handleExport)).ServeHTTP(rr, req)
+		if rr.Code != tc.want {
+			t.Errorf("%s: got status %v want %v", name, rr.Code, tc.want)
+		}
+	}
+}
+
+func TestHandleImportExport(t *testing.T) {
+	store := memory.NewStore("", 0)
+	if err := store.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s := Server{Storage: store}
+
+	body := `{"ShortCode":"abcd123","Destination":"https://example.com"}` + "\n"
+	req := httptest.NewRequest("POST", "/api/v1/admin/import?format=ndjson&conflict=fail", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	s.handleImport(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("import returned %v: %s", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest("POST", "/api/v1/admin/import?format=ndjson&conflict=fail", strings.NewReader(strings.Replace(body, "example.com", "example.org", 1)))
+	rr = httptest.NewRecorder()
+	s.handleImport(rr, req)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("conflicting import returned %v want %v", rr.Code, http.StatusConflict)
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/admin/export?format=csv", nil)
+	rr = httptest.NewRecorder()
+	s.handleExport(rr, req)
+	lines := strings.Split(rr.Body.String(), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "ShortCode,Destination,") || !strings.HasPrefix(lines[1], "abcd123,https://example.com,") {
+		t.Errorf("export returned %q", rr.Body.String())
+	}
+}
+
+type failingLister struct {
+	*memory.Store
+}
+
+func (failingLister) List(ctx context.Context, cursor string, limit int) ([]models.URL, string, error) {
+	return nil, "", errors.New("disk on fire")
+}
+
+func TestHandleExportFailure(t *testing.T) {
+	s := &Server{Storage: failingLister{memory.NewStore("", 0)}}
+	defer func() {
+		if r := recover(); r != http.ErrAbortHandler {
+			t.Errorf("failed export recovered %v want http.ErrAbortHandler", r)
+		}
+	}()
+	s.handleExport(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/admin/export", nil))
+}
+
+type fakeBackuper string
+
+func (f fakeBackuper) Backup(ctx context.Context, w io.Writer) (int64, error) {
+	if sizer, ok := w.(data.BackupSizer); ok {
+		sizer.SetBackupSize(int64(len(f)))
+	}
+	n, err := io.WriteString(w, string(f))
+	return int64(n), err
+}
+
+type failingBackuper struct{}
+
+func (failingBackuper) Backup(ctx context.Context, w io.Writer) (int64, error) {
+	n, _ := io.WriteString(w, "snap")
+	return int64(n), errors.New("disk on fire")
+}
+
+func TestHandleBackup(t *testing.T) {
+	s := &Server{}
+	rr := httptest.NewRecorder()
+	s.handleBackup(rr, httptest.NewRequest("GET", "/api/v1/admin/backup", nil))
+	if rr.Code != http.StatusNotImplemented {
+		t.Errorf("backup without a backuper returned %v want %v", rr.Code, http.StatusNotImplemented)
+	}
+
+	s.Backups = fakeBackuper("snapshot")
+	rr = httptest.NewRecorder()
+	s.handleBackup(rr, httptest.NewRequest("GET", "/api/v1/admin/backup", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "snapshot" {
+		t.Errorf("backup returned %v %q", rr.Code, rr.Body.String())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("backup returned Content-Type %s", ct)
+	}
+	if cl := rr.Header().Get("Content-Length"); cl != "8" {
+		t.Errorf("backup returned Content-Length %q want 8", cl)
+	}
+
+	// a failed backup must not look like a short but complete one
+	s.Backups = failingBackuper{}
+	defer func() {
+		if r := recover(); r != http.ErrAbortHandler {
+			t.Errorf("failed backup recovered %v want http.ErrAbortHandler", r)
+		}
+	}()
+	s.handleBackup(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/admin/backup", nil))
+}
@@ -15,41 +15,100 @@
 package app
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/storage/hits"
 )
 
+// DefaultRequestTimeout is how long a request may spend in its handler,
+// including storage calls, before its context is cancelled
+const DefaultRequestTimeout = 5 * time.Second
+
 type Server struct {
-	Listen  string
+	Listen         string
+	RequestTimeout time.Duration
+	// AdminToken is the bearer token the /api/v1/admin endpoints require.
+	// They are disabled while it is empty.
+	AdminToken string
+	// Backups snapshots the database for /api/v1/admin/backup, which reports
+	// 501 while it is nil
+	Backups data.Backuper
+	// Backend names the storage backend in /healthz and /readyz
+	Backend string
+	// Hits buffers the hits of links without a click limit. They are
+	// counted as they happen while it is nil.
+	Hits    *hits.Buffer
 	router  *mux.Router
 	Storage data.StorageReadWrite
+	// draining is set once shutdown starts, failing /readyz
+	draining int32
 }
 
 func NewServer(storageRW data.StorageReadWrite, listenAddress string) *Server {
 	return &Server{
-		Listen:  listenAddress,
-		router:  mux.NewRouter(),
-		Storage: storageRW,
+		Listen:         listenAddress,
+		RequestTimeout: DefaultRequestTimeout,
+		router:         mux.NewRouter(),
+		Storage:        storageRW,
 	}
 }
 
+// Run serves requests until the process receives SIGINT or SIGTERM, then
+// drains in-flight requests and returns so the caller can close storage.
 func (s *Server) Run() {
+	// Admin endpoints stream whole datasets, so they are matched first and
+	// kept out of the request deadline
+	admin := s.router.PathPrefix("/api/v1/admin").Subrouter()
+	admin.Use(adminHandler(s.AdminToken))
+	adminRoutes(admin, s)
+
+	public := s.router.NewRoute().Subrouter()
+	public.Use(deadlineHandler(s.RequestTimeout))
+
 	// Handle basic root paths
-	s.router.HandleFunc("/", logHandler(s.handleIndex))
-	s.router.HandleFunc("/favicon.ico", s.handleIgnore)
-	s.router.HandleFunc("/{shortCode}", logHandler(s.handleShortCode)).Methods("GET")
+	public.HandleFunc("/", logHandler(s.handleIndex))
+	public.HandleFunc("/favicon.ico", s.handleIgnore)
+	// probes are polled constantly, so they aren't logged, and are matched
+	// before short codes
+	public.HandleFunc("/healthz", s.handleHealthz).Methods("GET")
+	public.HandleFunc("/readyz", s.handleReadyz).Methods("GET")
+	public.HandleFunc("/{shortCode}", logHandler(s.handleShortCode)).Methods("GET")
 
 	// Set up a subrouter for /api and then each version as more subrouters below /api
-	api := s.router.PathPrefix("/api").Subrouter()
+	api := public.PathPrefix("/api").Subrouter()
 	v1 := api.PathPrefix("/v1").Subrouter()
 	versionedApiRoutes(v1, s)
 
-	log.Println("Starting server:", s.Listen)
-	if err := http.ListenAndServe(s.Listen, s.router); err != nil {
-		log.Fatalf("Error starting server: %v", err)
+	srv := &http.Server{
+		Addr:    s.Listen,
+		Handler: s.router,
+	}
+	go func() {
+		log.Println("Starting server:", s.Listen)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Error starting server: %v", err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	log.Println("Shutting down server")
+	atomic.StoreInt32(&s.draining, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("ERROR: %v", err)
 	}
 }
@@ -15,7 +15,9 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
@@ -24,6 +26,7 @@ import (
 
 	"github.com/gorilla/mux"
 
+	"github.com/lucasreed/smol/pkg/data"
 	"github.com/lucasreed/smol/pkg/data/models"
 )
 
@@ -44,11 +47,19 @@ func (s *Server) handleIgnore(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// addRequest is the body of an add call. TTL is an alternative to ExpiresAt,
+// given as a duration such as "72h".
+type addRequest struct {
+	models.URL
+	TTL string
+}
+
 func (s *Server) handleAdd(w http.ResponseWriter, r *http.Request) {
 	var path string
-	var urlModel models.URL
+	var req addRequest
 	js := json.NewDecoder(r.Body)
-	err := js.Decode(&urlModel)
+	err := js.Decode(&req)
+	urlModel := req.URL
 	if err != nil {
 		log.Println("error decoding json")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -83,11 +94,14 @@ func (s *Server) handleAdd(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	if p, exists := s.urlRegistered(urlModel.Destination); exists {
-		w.WriteHeader(http.StatusFound)
-		message := fmt.Sprintf("This url is already registered: %s -> %s", p, urlModel.Destination)
-		log.Println(message)
-		_, err = w.Write([]byte(message))
+	expiresAt, err := requestExpiry(req, time.Now())
+	if err == nil && urlModel.MaxClicks < 0 {
+		err = fmt.Errorf("MaxClicks can't be negative: %d", urlModel.MaxClicks)
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		_, err = w.Write([]byte(err.Error()))
 		if err != nil {
 			log.Printf("ERROR: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -95,28 +109,48 @@ func (s *Server) handleAdd(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if p, exists := s.urlRegistered(r.Context(), urlModel.Destination); exists {
+		writeRegistered(w, p, urlModel.Destination)
+		return
+	}
+	// only the descriptive fields are taken from the request, the rest is
+	// owned by the store
+	record := models.URL{
+		Destination: urlModel.Destination,
+		Creator:     urlModel.Creator,
+		Title:       urlModel.Title,
+		Labels:      urlModel.Labels,
+		ExpiresAt:   expiresAt,
+		MaxClicks:   urlModel.MaxClicks,
+	}
 	for i := 0; i < 3; i++ {
-		p := createShortCode(7)
-		if !s.pathRegistered(p) {
-			path = p
+		path = createShortCode(7)
+		record.ShortCode = path
+		err = s.Storage.CreateURL(r.Context(), record)
+		if !errors.Is(err, data.ErrExists) {
 			break
 		}
-		if i == 2 {
+	}
+	if errors.Is(err, data.ErrExists) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, err = w.Write([]byte("error creating a shortCode path"))
+		if err != nil {
+			log.Printf("ERROR: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
-			_, err = w.Write([]byte("error creating a shortCode path"))
-			if err != nil {
-				log.Printf("ERROR: %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+			return
+		}
+		return
+	}
+	if errors.Is(err, data.ErrDestinationExists) {
+		// a request racing this one shortened the destination first
+		if p, exists := s.urlRegistered(r.Context(), urlModel.Destination); exists {
+			writeRegistered(w, p, urlModel.Destination)
 			return
 		}
 	}
-	urlModel.ShortCode = path
-	err = s.Storage.SetURL(path, urlModel.Destination)
 	if err != nil {
 		log.Printf("failed to store url - %v\n", err)
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(storageErrorStatus(err, http.StatusBadRequest))
 		_, innerErr := w.Write([]byte("failed to store url"))
 		if innerErr != nil {
 			log.Printf("ERROR: %v", innerErr)
@@ -125,6 +159,7 @@ func (s *Server) handleAdd(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	urlModel.ShortCode = path
 	w.WriteHeader(http.StatusAccepted)
 	log.Printf("Added path: %s, url: %s\n", urlModel.ShortCode, urlModel.Destination)
 }
@@ -132,10 +167,21 @@ func (s *Server) handleAdd(w http.ResponseWriter, r *http.Request) {
 func (s *Server) handleShortCode(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	shortCode := vars["shortCode"]
-	url, err := s.Storage.GetURL(shortCode)
+	url, err := s.Storage.GetURL(r.Context(), shortCode)
+	if errors.Is(err, data.ErrGone) {
+		log.Printf("shortcode is no longer available: %s - %v\n", shortCode, err)
+		w.WriteHeader(http.StatusGone)
+		_, innerErr := w.Write([]byte("this link is no longer available: " + shortCode))
+		if innerErr != nil {
+			log.Printf("ERROR: %v", innerErr)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		return
+	}
 	if err != nil {
-		log.Printf("error finding shortcode, maybe it does not exist: %s\n", shortCode)
-		w.WriteHeader(http.StatusNotFound)
+		log.Printf("error finding shortcode, maybe it does not exist: %s - %v\n", shortCode, err)
+		w.WriteHeader(storageErrorStatus(err, http.StatusNotFound))
 		_, innerErr := w.Write([]byte("error finding shortcode, maybe it does not exist: " + shortCode))
 		if innerErr != nil {
 			log.Printf("ERROR: %v", innerErr)
@@ -144,15 +190,154 @@ func (s *Server) handleShortCode(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	// a link limited to a number of clicks only redirects once its click has
+	// been counted, as that is what stops concurrent redirects going over.
+	// Other hits are left to the buffer, if there is one, so the redirect
+	// doesn't wait on a write.
+	if url.MaxClicks == 0 && s.Hits != nil {
+		s.Hits.Add(shortCode)
+	} else {
+		err = s.Storage.RecordHit(r.Context(), shortCode)
+	}
+	if err != nil && url.MaxClicks > 0 {
+		log.Printf("error recording hit for limited shortcode: %s - %v\n", shortCode, err)
+		message := "error recording hit for shortcode: " + shortCode
+		if errors.Is(err, data.ErrGone) {
+			message = "this link is no longer available: " + shortCode
+		}
+		w.WriteHeader(storageErrorStatus(err, http.StatusInternalServerError))
+		_, innerErr := w.Write([]byte(message))
+		if innerErr != nil {
+			log.Printf("ERROR: %v", innerErr)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("error recording hit for shortcode: %s - %v\n", shortCode, err)
+	}
 	log.Printf("Redirecting from %s to %s\n", r.URL.EscapedPath(), url.Destination)
+	// links that will stop working mustn't be cached by browsers, or they
+	// would keep following them without asking again
+	if url.MaxClicks > 0 || url.ExpiresAt != nil {
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, url.Destination, http.StatusTemporaryRedirect)
+		return
+	}
 	http.Redirect(w, r, url.Destination, http.StatusPermanentRedirect)
 
 }
 
+// handleInfo returns the stored record for a short code as JSON, including
+// links that are gone
+func (s *Server) handleInfo(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	shortCode := vars["shortCode"]
+	url, err := s.Storage.GetURL(r.Context(), shortCode)
+	if err != nil && !errors.Is(err, data.ErrGone) {
+		log.Printf("error finding shortcode, maybe it does not exist: %s - %v\n", shortCode, err)
+		w.WriteHeader(storageErrorStatus(err, http.StatusNotFound))
+		_, innerErr := w.Write([]byte("error finding shortcode, maybe it does not exist: " + shortCode))
+		if innerErr != nil {
+			log.Printf("ERROR: %v", innerErr)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(url); err != nil {
+		log.Printf("ERROR: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleUpdate points an existing short code at a new destination, keeping
+// the old one in the link's revision history
+func (s *Server) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	shortCode := vars["shortCode"]
+	var urlModel models.URL
+	if err := json.NewDecoder(r.Body).Decode(&urlModel); err != nil {
+		log.Println("error decoding json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, innerErr := w.Write([]byte("error decoding json"))
+		if innerErr != nil {
+			log.Printf("ERROR: %v", innerErr)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+	if len(urlModel.Destination) == 0 || !urlModel.ValidateURL() {
+		message := fmt.Sprintf("url is not valid: %s", urlModel.Destination)
+		log.Println(message)
+		w.WriteHeader(http.StatusBadRequest)
+		_, err := w.Write([]byte(message))
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+	url, err := s.Storage.UpdateDestination(r.Context(), shortCode, urlModel.Destination)
+	if err != nil {
+		log.Printf("error updating shortcode: %s - %v\n", shortCode, err)
+		message := "error updating shortcode: " + shortCode
+		if errors.Is(err, data.ErrDestinationExists) {
+			message = "This url is already registered: " + urlModel.Destination
+		}
+		w.WriteHeader(storageErrorStatus(err, http.StatusInternalServerError))
+		_, innerErr := w.Write([]byte(message))
+		if innerErr != nil {
+			log.Printf("ERROR: %v", innerErr)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	log.Printf("Updated path: %s, url: %s\n", shortCode, url.Destination)
+}
+
+// handleHistory returns the past destinations of a short code as JSON, oldest
+// first
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	shortCode := vars["shortCode"]
+	url, err := s.Storage.GetURL(r.Context(), shortCode)
+	if err != nil && !errors.Is(err, data.ErrGone) {
+		log.Printf("error finding shortcode, maybe it does not exist: %s - %v\n", shortCode, err)
+		w.WriteHeader(storageErrorStatus(err, http.StatusNotFound))
+		_, innerErr := w.Write([]byte("error finding shortcode, maybe it does not exist: " + shortCode))
+		if innerErr != nil {
+			log.Printf("ERROR: %v", innerErr)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+	revisions := url.Revisions
+	if revisions == nil {
+		revisions = []models.Revision{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(revisions); err != nil {
+		log.Printf("ERROR: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleDelete leaves a tombstone in place of the link, so that the short code
+// answers 410 Gone and isn't handed out again until its quarantine is over
 func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	shortCode := vars["shortCode"]
-	if exists := s.pathRegistered(shortCode); !exists {
+	if exists := s.pathRegistered(r.Context(), shortCode); !exists {
 		w.WriteHeader(http.StatusNotFound)
 		message := fmt.Sprintf("This short code is not registered: %s", shortCode)
 		log.Println(message)
@@ -164,10 +349,10 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	err := s.Storage.Delete(shortCode)
+	err := s.Storage.SoftDelete(r.Context(), shortCode)
 	if err != nil {
-		log.Printf("error deleting shortcode: %s\n", shortCode)
-		w.WriteHeader(http.StatusNotFound)
+		log.Printf("error deleting shortcode: %s - %v\n", shortCode, err)
+		w.WriteHeader(storageErrorStatus(err, http.StatusNotFound))
 		_, innerErr := w.Write([]byte("error deleting shortcode: " + shortCode))
 		if innerErr != nil {
 			log.Printf("ERROR: %v", innerErr)
@@ -180,17 +365,93 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Deleted shortcode: %s\n", shortCode)
 }
 
-func (s *Server) urlRegistered(url string) (string, bool) {
-	data, err := s.Storage.GetShortCode(url)
+// handleRestore brings a deleted link back, as long as its destination hasn't
+// been shortened again in the meantime
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	shortCode := vars["shortCode"]
+	err := s.Storage.Restore(r.Context(), shortCode)
+	if err != nil {
+		log.Printf("error restoring shortcode: %s - %v\n", shortCode, err)
+		message := "error restoring shortcode: " + shortCode
+		if errors.Is(err, data.ErrDestinationExists) {
+			message = "the destination of this short code has been shortened again: " + shortCode
+		}
+		w.WriteHeader(storageErrorStatus(err, http.StatusInternalServerError))
+		_, innerErr := w.Write([]byte(message))
+		if innerErr != nil {
+			log.Printf("ERROR: %v", innerErr)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	log.Printf("Restored shortcode: %s\n", shortCode)
+}
+
+func (s *Server) urlRegistered(ctx context.Context, url string) (string, bool) {
+	shortCode, err := s.Storage.GetShortCode(ctx, url)
 	if err != nil {
 		return "", false
 	}
-	return data, true
+	return shortCode, true
 }
 
-func (s *Server) pathRegistered(shortCode string) bool {
-	_, err := s.Storage.GetURL(shortCode)
-	return err == nil
+// pathRegistered reports whether shortCode is stored, even if it is gone
+func (s *Server) pathRegistered(ctx context.Context, shortCode string) bool {
+	_, err := s.Storage.GetURL(ctx, shortCode)
+	return err == nil || errors.Is(err, data.ErrGone)
+}
+
+// requestExpiry works out when a link being added should expire from either
+// the ExpiresAt or the TTL of req, returning nil if it shouldn't
+func requestExpiry(req addRequest, now time.Time) (*time.Time, error) {
+	if req.TTL != "" && req.ExpiresAt != nil {
+		return nil, errors.New("only one of ExpiresAt and TTL may be given")
+	}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("TTL is not a positive duration: %s", req.TTL)
+		}
+		expires := now.Add(ttl)
+		return &expires, nil
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(now) {
+		return nil, fmt.Errorf("ExpiresAt is in the past: %s", req.ExpiresAt.Format(time.RFC3339))
+	}
+	return req.ExpiresAt, nil
+}
+
+// writeRegistered answers an add request for a destination that is already
+// shortened as p
+func writeRegistered(w http.ResponseWriter, p, destination string) {
+	w.WriteHeader(http.StatusFound)
+	message := fmt.Sprintf("This url is already registered: %s -> %s", p, destination)
+	log.Println(message)
+	if _, err := w.Write([]byte(message)); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+// storageErrorStatus picks the response status for a failed storage call,
+// falling back to status when the error isn't one of the data sentinels or a
+// timeout
+func storageErrorStatus(err error, status int) int {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, data.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, data.ErrGone):
+		return http.StatusGone
+	case errors.Is(err, data.ErrExists), errors.Is(err, data.ErrDestinationExists):
+		return http.StatusConflict
+	case errors.Is(err, data.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	}
+	return status
 }
 
 func createShortCode(length int) string {
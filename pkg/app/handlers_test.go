@@ -16,66 +16,38 @@ package app
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
 
 	"github.com/lucasreed/smol/pkg/data/models"
+	"github.com/lucasreed/smol/pkg/storage/hits"
+	"github.com/lucasreed/smol/pkg/storage/memory"
 )
 
-type storage struct {
-	data map[string]string
-}
-
-func (s *storage) Open() error {
-	return nil
-}
-
-func (s *storage) Close() error {
-	return nil
-}
+var testStorage = newTestStorage()
 
-func (s *storage) Health() bool {
-	return true
-}
-
-func (s *storage) GetURL(shortCode string) (models.URL, error) {
-	if dest, ok := s.data[shortCode]; ok {
-		return models.URL{Destination: dest, ShortCode: shortCode}, nil
+func newTestStorage() *memory.Store {
+	store := memory.NewStore("", 0)
+	if err := store.Open(context.Background()); err != nil {
+		panic(err)
 	}
-	return models.URL{}, fmt.Errorf("code not found")
-}
-
-func (s *storage) GetShortCode(destination string) (string, error) {
-	if code, ok := s.data[destination]; ok {
-		return code, nil
+	if err := store.SetURL(context.Background(), models.URL{ShortCode: "abcd123", Destination: "https://google.com"}); err != nil {
+		panic(err)
 	}
-	return "", fmt.Errorf("destination not found")
-}
-
-func (s *storage) SetURL(shortCode, url string) error {
-	s.data[shortCode] = url
-	return nil
-}
-
-func (s *storage) Delete(shortCode string) error {
-	delete(s.data, shortCode)
-	return nil
-}
-
-var testStorage = storage{
-	data: map[string]string{
-		"abcd123":            "https://google.com",
-		"https://google.com": "abcd123",
-	},
+	return store
 }
 
 var server = Server{
 	Listen:  "",
 	router:  nil,
-	Storage: &testStorage,
+	Storage: testStorage,
 }
 
 func TestHandleAdd(t *testing.T) {
@@ -100,6 +72,34 @@ func TestHandleAdd(t *testing.T) {
 	}
 }
 
+// racingStore shortens the destination of the link it is asked to create
+// under another code just before, as a concurrent request would
+type racingStore struct {
+	*memory.Store
+}
+
+func (s racingStore) CreateURL(ctx context.Context, url models.URL) error {
+	if err := s.Store.CreateURL(ctx, models.URL{ShortCode: "racer12", Destination: url.Destination}); err != nil {
+		return err
+	}
+	return s.Store.CreateURL(ctx, url)
+}
+
+func TestHandleAddLosesRace(t *testing.T) {
+	s := Server{Storage: racingStore{newTestStorage()}}
+	req := httptest.NewRequest("POST", "/add", strings.NewReader(`{"Destination":"https://example.com/raced"}`))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.handleAdd).ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusFound {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusFound)
+	}
+	if !strings.Contains(rr.Body.String(), "racer12") {
+		t.Errorf("handler answered %q, want the winning short code", rr.Body.String())
+	}
+}
+
 // func TestHandleShortCode(t *testing.T) {
 // 	req, err := http.NewRequest("GET", "/abcd123", nil)
 // 	if err != nil {
@@ -115,3 +115,188 @@ func TestHandleAdd(t *testing.T) {
 // 			status, http.StatusOK)
 // 	}
 // }
+
+func TestHandleShortCodeDeadlineExceeded(t *testing.T) {
+	req, err := http.NewRequest("GET", "/abcd123", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), -time.Second)
+	defer cancel()
+	req = mux.SetURLVars(req.WithContext(ctx), map[string]string{"shortCode": "abcd123"})
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(server.handleShortCode)
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusGatewayTimeout {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusGatewayTimeout)
+	}
+}
+
+func TestHandleShortCodeRecordsHit(t *testing.T) {
+	s := Server{Storage: newTestStorage()}
+	vars := map[string]string{"shortCode": "abcd123"}
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/abcd123", nil), vars)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.handleShortCode).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusPermanentRedirect {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusPermanentRedirect)
+	}
+
+	req = mux.SetURLVars(httptest.NewRequest("GET", "/api/v1/abcd123", nil), vars)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(s.handleInfo).ServeHTTP(rr, req)
+	var u models.URL
+	if err := json.NewDecoder(rr.Body).Decode(&u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Destination != "https://google.com" || u.Hits != 1 {
+		t.Errorf("info returned %+v, want https://google.com with 1 hit", u)
+	}
+}
+
+func TestHandleShortCodeBuffersHits(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStorage()
+	if err := store.SetURL(ctx, models.URL{ShortCode: "efgh456", Destination: "https://example.com", MaxClicks: 2}); err != nil {
+		t.Fatal(err)
+	}
+	s := Server{Storage: store, Hits: hits.New(store)}
+	for _, code := range []string{"abcd123", "efgh456"} {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/"+code, nil), map[string]string{"shortCode": code})
+		http.HandlerFunc(s.handleShortCode).ServeHTTP(httptest.NewRecorder(), req)
+	}
+	// limited links are still counted before they redirect
+	if u, _ := store.GetURL(ctx, "efgh456"); u.Hits != 1 {
+		t.Errorf("limited link has %d hits, want 1", u.Hits)
+	}
+	if u, _ := store.GetURL(ctx, "abcd123"); u.Hits != 0 {
+		t.Errorf("unlimited link has %d hits before a flush, want 0", u.Hits)
+	}
+	if _, err := s.Hits.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := store.GetURL(ctx, "abcd123"); u.Hits != 1 {
+		t.Errorf("unlimited link has %d hits after a flush, want 1", u.Hits)
+	}
+}
+
+func TestHandleShortCodeExpired(t *testing.T) {
+	store := newTestStorage()
+	expired := time.Now().Add(-time.Minute)
+	if err := store.SetURL(context.Background(), models.URL{ShortCode: "efgh456", Destination: "https://example.com", ExpiresAt: &expired}); err != nil {
+		t.Fatal(err)
+	}
+	s := Server{Storage: store}
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/efgh456", nil), map[string]string{"shortCode": "efgh456"})
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.handleShortCode).ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusGone {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusGone)
+	}
+}
+
+func TestHandleShortCodeMaxClicks(t *testing.T) {
+	store := newTestStorage()
+	if err := store.SetURL(context.Background(), models.URL{ShortCode: "efgh456", Destination: "https://example.com", MaxClicks: 1}); err != nil {
+		t.Fatal(err)
+	}
+	s := Server{Storage: store}
+	for _, want := range []int{http.StatusTemporaryRedirect, http.StatusGone} {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/efgh456", nil), map[string]string{"shortCode": "efgh456"})
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(s.handleShortCode).ServeHTTP(rr, req)
+		if status := rr.Code; status != want {
+			t.Errorf("handler returned wrong status code: got %v want %v",
+				status, want)
+		}
+	}
+}
+
+func TestHandleDeleteAndRestore(t *testing.T) {
+	s := Server{Storage: newTestStorage()}
+	vars := map[string]string{"shortCode": "abcd123"}
+	for _, step := range []struct {
+		handler http.HandlerFunc
+		method  string
+		path    string
+		want    int
+	}{
+		{s.handleDelete, "DELETE", "/api/v1/abcd123", http.StatusAccepted},
+		{s.handleShortCode, "GET", "/abcd123", http.StatusGone},
+		{s.handleDelete, "DELETE", "/api/v1/abcd123", http.StatusGone},
+		{s.handleRestore, "POST", "/api/v1/abcd123/restore", http.StatusAccepted},
+		{s.handleShortCode, "GET", "/abcd123", http.StatusPermanentRedirect},
+	} {
+		req := mux.SetURLVars(httptest.NewRequest(step.method, step.path, nil), vars)
+		rr := httptest.NewRecorder()
+		step.handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != step.want {
+			t.Errorf("%s %s returned wrong status code: got %v want %v",
+				step.method, step.path, status, step.want)
+		}
+	}
+}
+
+func TestHandleUpdate(t *testing.T) {
+	s := Server{Storage: newTestStorage()}
+	vars := map[string]string{"shortCode": "abcd123"}
+	for _, step := range []struct {
+		body string
+		want int
+	}{
+		{`{"Destination":"example.com/fixed"}`, http.StatusAccepted},
+		{`{"Destination":"http:/example.com"}`, http.StatusBadRequest},
+		{`{"Destination":"https://example.com/fixed"}`, http.StatusAccepted},
+	} {
+		req := mux.SetURLVars(httptest.NewRequest("PUT", "/api/v1/abcd123", strings.NewReader(step.body)), vars)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(s.handleUpdate).ServeHTTP(rr, req)
+		if status := rr.Code; status != step.want {
+			t.Errorf("update to %s returned wrong status code: got %v want %v",
+				step.body, status, step.want)
+		}
+	}
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/api/v1/abcd123/history", nil), vars)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.handleHistory).ServeHTTP(rr, req)
+	var revisions []models.Revision
+	if err := json.NewDecoder(rr.Body).Decode(&revisions); err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 || revisions[0].Destination != "https://google.com" || revisions[1].Destination != "http://example.com/fixed" {
+		t.Errorf("history returned %+v, want google.com then example.com/fixed", revisions)
+	}
+}
+
+func TestRequestExpiry(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	for name, tc := range map[string]struct {
+		req     addRequest
+		want    *time.Time
+		wantErr bool
+	}{
+		"none":       {req: addRequest{}},
+		"ttl":        {req: addRequest{TTL: "1h"}, want: &future},
+		"expires at": {req: addRequest{URL: models.URL{ExpiresAt: &future}}, want: &future},
+		"both":       {req: addRequest{URL: models.URL{ExpiresAt: &future}, TTL: "1h"}, wantErr: true},
+		"bad ttl":    {req: addRequest{TTL: "-1h"}, wantErr: true},
+		"past":       {req: addRequest{URL: models.URL{ExpiresAt: &past}}, wantErr: true},
+	} {
+		got, err := requestExpiry(tc.req, now)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error %v", name, err, tc.wantErr)
+			continue
+		}
+		if (got == nil) != (tc.want == nil) || (got != nil && !got.Equal(*tc.want)) {
+			t.Errorf("%s: got expiry %v, want %v", name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package app
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucasreed/smol/pkg/data"
+)
+
+// healthReport is the body of /healthz and /readyz
+type healthReport struct {
+	Status  string `json:"status"`
+	Backend string `json:"backend,omitempty"`
+	// Latency is how long the storage probe took, such as "1.2ms"
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+// handleHealthz reports whether the storage backend answers a real read
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	s.writeHealth(w, r, "")
+}
+
+// handleReadyz is handleHealthz, but also fails once the server has started
+// shutting down so load balancers stop sending it new requests
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.draining) == 1 {
+		s.writeHealth(w, r, "shutting down")
+		return
+	}
+	s.writeHealth(w, r, "")
+}
+
+// writeHealth probes the backend and answers 503 if the probe fails or
+// unready is set
+func (s *Server) writeHealth(w http.ResponseWriter, r *http.Request, unready string) {
+	start := time.Now()
+	err := data.Probe(r.Context(), s.Storage)
+	report := healthReport{
+		Status:  "ok",
+		Backend: s.Backend,
+		Latency: time.Since(start).String(),
+	}
+	status := http.StatusOK
+	if err != nil {
+		log.Printf("health probe failed - %v\n", err)
+		report.Status = "unhealthy"
+		report.Error = err.Error()
+		status = http.StatusServiceUnavailable
+	} else if unready != "" {
+		report.Status = "unavailable"
+		report.Error = unready
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err = json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lucasreed/smol/pkg/storage/memory"
+)
+
+func TestHandleHealth(t *testing.T) {
+	healthy := memory.NewStore("", 0)
+	if err := healthy.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for name, tc := range map[string]struct {
+		server  *Server
+		handler func(*Server, http.ResponseWriter, *http.Request)
+		want    int
+		status  string
+	}{
+		"healthz":          {&Server{Storage: healthy, Backend: "memory"}, (*Server).handleHealthz, http.StatusOK, "ok"},
+		"readyz":           {&Server{Storage: healthy, Backend: "memory"}, (*Server).handleReadyz, http.StatusOK, "ok"},
+		"healthz unopened": {&Server{Storage: memory.NewStore("", 0), Backend: "memory"}, (*Server).handleHealthz, http.StatusServiceUnavailable, "unhealthy"},
+		"readyz unopened":  {&Server{Storage: memory.NewStore("", 0), Backend: "memory"}, (*Server).handleReadyz, http.StatusServiceUnavailable, "unhealthy"},
+		"healthz draining": {&Server{Storage: healthy, Backend: "memory", draining: 1}, (*Server).handleHealthz, http.StatusOK, "ok"},
+		"readyz draining":  {&Server{Storage: healthy, Backend: "memory", draining: 1}, (*Server).handleReadyz, http.StatusServiceUnavailable, "unavailable"},
+	} {
+		rr := httptest.NewRecorder()
+		tc.handler(tc.server, rr, httptest.NewRequest("GET", "/healthz", nil))
+		if rr.Code != tc.want {
+			t.Errorf("%s: got status %v want %v", name, rr.Code, tc.want)
+		}
+		var report healthReport
+		if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if report.Status != tc.status || report.Backend != "memory" || report.Latency == "" {
+			t.Errorf("%s: got report %+v", name, report)
+		}
+		if (tc.want == http.StatusOK) != (report.Error == "") {
+			t.Errorf("%s: got error %q", name, report.Error)
+		}
+	}
+}
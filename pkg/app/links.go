@@ -0,0 +1,159 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lucasreed/smol/pkg/data/models"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 1000
+	// listScanBudget caps how many stored links a single list request reads
+	// while looking for matches. A page that runs out of budget is returned
+	// short, with a cursor to carry on from.
+	listScanBudget = 10000
+)
+
+// linkFilter narrows a listing down. Zero fields match everything.
+type linkFilter struct {
+	// Destination matches a case-insensitive substring of the destination
+	Destination string
+	// Domain matches the destination's host or any subdomain of it
+	Domain        string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+// linksPage is the body of a list response. Next is empty on the last page.
+type linksPage struct {
+	Links []models.URL
+	Next  string
+}
+
+// parseLinkFilter reads the destination, domain, created_after and
+// created_before query parameters. Dates are RFC 3339 times or plain
+// YYYY-MM-DD dates.
+func parseLinkFilter(query url.Values) (linkFilter, error) {
+	f := linkFilter{
+		Destination: strings.ToLower(query.Get("destination")),
+		Domain:      strings.ToLower(strings.TrimPrefix(query.Get("domain"), ".")),
+	}
+	var err error
+	if f.CreatedAfter, err = parseDate(query.Get("created_after")); err != nil {
+		return f, fmt.Errorf("created_after: %w", err)
+	}
+	if f.CreatedBefore, err = parseDate(query.Get("created_before")); err != nil {
+		return f, fmt.Errorf("created_before: %w", err)
+	}
+	return f, nil
+}
+
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func (f linkFilter) matches(u models.URL) bool {
+	if f.Destination != "" && !strings.Contains(strings.ToLower(u.Destination), f.Destination) {
+		return false
+	}
+	if f.Domain != "" {
+		parsed, err := url.Parse(u.Destination)
+		if err != nil {
+			return false
+		}
+		host := strings.ToLower(parsed.Hostname())
+		if host != f.Domain && !strings.HasSuffix(host, "."+f.Domain) {
+			return false
+		}
+	}
+	if !f.CreatedAfter.IsZero() && u.CreatedAt.Before(f.CreatedAfter) {
+		return false
+	}
+	if !f.CreatedBefore.IsZero() && !u.CreatedAt.Before(f.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// listLinks reads pages from storage starting at cursor until it has limit
+// links matching f, everything has been read or the scan budget runs out.
+// Each page asks for no more than the links still wanted, so a page is never
+// split and the cursor the storage hands back can always be resumed from.
+func (s *Server) listLinks(ctx context.Context, cursor string, limit int, f linkFilter) (linksPage, error) {
+	page := linksPage{Links: []models.URL{}, Next: cursor}
+	for scanned := 0; scanned < listScanBudget; {
+		urls, next, err := s.Storage.List(ctx, page.Next, limit-len(page.Links))
+		if err != nil {
+			return linksPage{}, err
+		}
+		scanned += len(urls)
+		for _, u := range urls {
+			if f.matches(u) {
+				page.Links = append(page.Links, u)
+			}
+		}
+		page.Next = next
+		if next == "" || len(page.Links) >= limit {
+			break
+		}
+	}
+	return page, nil
+}
+
+// handleLinks lists stored links a page at a time. The cursor query parameter
+// is the Next of the previous page, and limit caps the links per page.
+func (s *Server) handleLinks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := defaultListLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxListLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxListLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	f, err := parseLinkFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := s.listLinks(r.Context(), query.Get("cursor"), limit, f)
+	if err != nil {
+		log.Printf("error listing links - %v\n", err)
+		http.Error(w, "error listing links", storageErrorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(page); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+}
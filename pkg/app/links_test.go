@@ -0,0 +1,101 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lucasreed/smol/pkg/data/models"
+	"github.com/lucasreed/smol/pkg/storage/memory"
+)
+
+func TestHandleLinks(t *testing.T) {
+	store := memory.NewStore("", 0)
+	if err := store.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	day := func(d int) time.Time { return time.Date(2020, 5, d, 12, 0, 0, 0, time.UTC) }
+	for _, u := range []models.URL{
+		{ShortCode: "aaaaaaa", Destination: "https://example.com/a", CreatedAt: day(1)},
+		{ShortCode: "bbbbbbb", Destination: "https://blog.example.com/b", CreatedAt: day(2)},
+		{ShortCode: "ccccccc", Destination: "https://notexample.com/c", CreatedAt: day(3)},
+		{ShortCode: "ddddddd", Destination: "https://example.org/Spring-Sale", CreatedAt: day(4)},
+		{ShortCode: "eeeeeee", Destination: "https://example.com/e", CreatedAt: day(5)},
+	} {
+		if err := store.SetURL(context.Background(), u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := Server{Storage: store}
+
+	for name, tc := range map[string]struct {
+		query string
+		want  []string
+	}{
+		"all":         {"", []string{"aaaaaaa", "bbbbbbb", "ccccccc", "ddddddd", "eeeeeee"}},
+		"domain":      {"domain=example.com", []string{"aaaaaaa", "bbbbbbb", "eeeeeee"}},
+		"destination": {"destination=spring", []string{"ddddddd"}},
+		"created":     {"created_after=2020-05-02&created_before=2020-05-04T12:00:00Z", []string{"bbbbbbb", "ccccccc"}},
+		"paged":       {"domain=example.com&limit=2", []string{"aaaaaaa", "bbbbbbb", "eeeeeee"}},
+	} {
+		var got []string
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > 5 {
+				t.Fatalf("%s: listing did not finish", name)
+			}
+			req := httptest.NewRequest("GET", "/api/v1/links?"+tc.query+"&cursor="+cursor, nil)
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(s.handleLinks).ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("%s: handler returned wrong status code: got %v want %v", name, rr.Code, http.StatusOK)
+			}
+			var page linksPage
+			if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+				t.Fatal(err)
+			}
+			for _, u := range page.Links {
+				got = append(got, u.ShortCode)
+			}
+			if page.Next == "" {
+				break
+			}
+			cursor = page.Next
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: listed %v, want %v", name, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%s: listed %v, want %v", name, got, tc.want)
+				break
+			}
+		}
+	}
+
+	for _, query := range []string{"limit=0", "limit=abc", "created_after=yesterday"} {
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(s.handleLinks).ServeHTTP(rr, httptest.NewRequest("GET", "/api/v1/links?"+query, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -15,8 +15,12 @@
 package app
 
 import (
+	"context"
+	"crypto/subtle"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 )
 
 func logHandler(next http.HandlerFunc) http.HandlerFunc {
@@ -25,3 +29,39 @@ func logHandler(next http.HandlerFunc) http.HandlerFunc {
 		next(w, r)
 	}
 }
+
+// deadlineHandler bounds every request by timeout so that slow storage calls
+// are cancelled instead of holding the handler open indefinitely
+func deadlineHandler(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if timeout <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// adminHandler only lets through requests bearing token. With no token
+// configured the admin endpoints don't exist at all.
+func adminHandler(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				http.NotFound(w, r)
+				return
+			}
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
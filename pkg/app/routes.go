@@ -20,5 +20,17 @@ import (
 
 func versionedApiRoutes(versionRouter *mux.Router, s *Server) {
 	versionRouter.HandleFunc("/add", logHandler(s.handleAdd)).Methods("POST")
+	// registered before the short code routes, which would otherwise take it
+	versionRouter.HandleFunc("/links", logHandler(s.handleLinks)).Methods("GET")
+	versionRouter.HandleFunc("/{shortCode}", logHandler(s.handleInfo)).Methods("GET")
+	versionRouter.HandleFunc("/{shortCode}", logHandler(s.handleUpdate)).Methods("PUT", "PATCH")
 	versionRouter.HandleFunc("/{shortCode}", logHandler(s.handleDelete)).Methods("DELETE")
+	versionRouter.HandleFunc("/{shortCode}/history", logHandler(s.handleHistory)).Methods("GET")
+	versionRouter.HandleFunc("/{shortCode}/restore", logHandler(s.handleRestore)).Methods("POST")
+}
+
+func adminRoutes(adminRouter *mux.Router, s *Server) {
+	adminRouter.HandleFunc("/export", logHandler(s.handleExport)).Methods("GET")
+	adminRouter.HandleFunc("/import", logHandler(s.handleImport)).Methods("POST")
+	adminRouter.HandleFunc("/backup", logHandler(s.handleBackup)).Methods("GET")
 }
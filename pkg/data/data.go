@@ -15,23 +15,204 @@
 package data
 
 import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
 	"github.com/lucasreed/smol/pkg/data/models"
 )
 
+// ErrNotFound is returned, possibly wrapped, by every storage backend when a
+// short code or destination is not stored
+var ErrNotFound = errors.New("key not found")
+
+// ErrExists is returned, possibly wrapped, by CreateURL when the short code is
+// already in use
+var ErrExists = errors.New("key already exists")
+
+// ErrDestinationExists is returned, possibly wrapped, by CreateURL,
+// UpdateDestination and Restore when the destination is already shortened
+// under another code whose link isn't gone
+var ErrDestinationExists = errors.New("destination already shortened")
+
+// ErrGone is returned, possibly wrapped, by GetURL for a link that existed
+// but can no longer be followed, because it expired, used up its clicks or
+// was deleted
+var ErrGone = errors.New("link is gone")
+
+// ErrUnavailable is returned, possibly wrapped, for writes a backend can't
+// take for the time being, such as while its keys are moved between servers
+var ErrUnavailable = errors.New("backend is not taking writes")
+
+// ErrInvalidLimit is returned, possibly wrapped, by List when asked for a
+// page of no links
+var ErrInvalidLimit = errors.New("limit must be positive")
+
+// StorageReader and StorageWriter methods take a context so that request
+// deadlines and client disconnects cancel in-flight storage calls
 type StorageReader interface {
-	GetURL(shortCode string) (models.URL, error)
-	GetShortCode(destination string) (string, error)
-	Health() bool
+	// GetURL returns the record together with ErrGone for a link that is
+	// gone but hasn't been swept yet, including tombstones
+	GetURL(ctx context.Context, shortCode string) (models.URL, error)
+	// GetShortCode ignores links that are gone, so their destination can be
+	// shortened again
+	GetShortCode(ctx context.Context, destination string) (string, error)
+	Health(ctx context.Context) bool
+	// List returns a page of up to limit stored URLs starting at cursor, which
+	// is empty for the first page, along with the cursor of the next page. The
+	// next cursor is empty once every URL has been returned. A limit below one
+	// is rejected with ErrInvalidLimit. Order depends on the backend, and
+	// backends that walk a keyspace in chunks may return a few more than
+	// limit.
+	List(ctx context.Context, cursor string, limit int) ([]models.URL, string, error)
 }
 
+// StorageWriter methods take the whole record so that metadata is stored
+// alongside the destination. Zero CreatedAt and UpdatedAt are filled in with
+// models.URL.Stamp.
 type StorageWriter interface {
-	Open() error
+	Open(ctx context.Context) error
 	Close() error
-	SetURL(shortCode, url string) error
-	Delete(shortCode string) error
+	SetURL(ctx context.Context, url models.URL) error
+	// CreateURL stores url only if its short code is free, returning
+	// ErrExists otherwise, and its destination isn't held by a link that
+	// isn't gone, returning ErrDestinationExists otherwise. Links created
+	// already gone don't hold their destination. The checks and the write
+	// happen atomically so concurrent callers can't both win.
+	CreateURL(ctx context.Context, url models.URL) error
+	// Delete removes the link for good, freeing its short code straight away
+	Delete(ctx context.Context, shortCode string) error
+	// SoftDelete replaces the link with a tombstone, setting DeletedAt, and
+	// frees its destination. It returns ErrGone if it is already deleted.
+	SoftDelete(ctx context.Context, shortCode string) error
+	// UpdateDestination points shortCode at destination, recording the
+	// previous destination in Revisions and moving the reverse mapping, and
+	// returns the updated record. It returns ErrGone for a link that is gone
+	// and ErrDestinationExists if destination is already shortened under
+	// another code.
+	UpdateDestination(ctx context.Context, shortCode, destination string) (models.URL, error)
+	// Restore brings a tombstone back. It returns ErrDestinationExists if the
+	// destination has since been shortened under another code that isn't
+	// gone, and does nothing for a link that isn't deleted.
+	Restore(ctx context.Context, shortCode string) error
+	// RecordHit atomically adds one to the hit count of shortCode. It returns
+	// ErrGone, without counting, once a link has used up its MaxClicks, so
+	// concurrent callers can't take it over the limit.
+	RecordHit(ctx context.Context, shortCode string) error
 }
 
 type StorageReadWrite interface {
 	StorageReader
 	StorageWriter
 }
+
+// Sweeper is implemented by backends that can't expire links on their own and
+// need expired records and tombstones removed periodically. Until then they
+// are kept so that GetURL can report them as gone.
+type Sweeper interface {
+	// Sweep deletes links that expired before expiredBefore and tombstones
+	// deleted before deletedBefore, returning how many were removed
+	Sweep(ctx context.Context, expiredBefore, deletedBefore time.Time) (int, error)
+}
+
+// Rewriter is implemented by backends that can replace a link without
+// touching the hits counted on it, so that clicks counted while the caller
+// held a stale copy aren't lost
+type Rewriter interface {
+	// RewriteURL stores url like SetURL, except that a stored link keeps its
+	// own hit count rather than taking the one in url
+	RewriteURL(ctx context.Context, url models.URL) error
+}
+
+// Backuper is implemented by backends that can write a consistent snapshot of
+// their database while it is in use
+type Backuper interface {
+	// Backup writes the snapshot to w, returning how many bytes were written
+	Backup(ctx context.Context, w io.Writer) (int64, error)
+}
+
+// BackupSizer is implemented by writers that need the size of a snapshot
+// before it is written, such as an HTTP response setting its Content-Length.
+// Backends call SetBackupSize once, before the first write, when they know it.
+type BackupSizer interface {
+	SetBackupSize(n int64)
+}
+
+// Prober is implemented by backends that can run a real read against their
+// database and report why it failed
+type Prober interface {
+	// Probe looks up a short code that is never stored, so it only fails
+	// when the backend can't be read
+	Probe(ctx context.Context) error
+}
+
+// HitAdder is implemented by backends that can count many hits in one write
+type HitAdder interface {
+	// AddHits adds each count to the hits of its short code. Hits for links
+	// that are missing or gone are dropped, and links limited to MaxClicks
+	// stop counting once they reach it. When it fails none of the hits
+	// are counted.
+	AddHits(ctx context.Context, hits map[string]int64) error
+}
+
+// AddHits counts hits in store, or the first store it wraps that implements
+// HitAdder, falling back to one RecordHit per hit. When it fails, hits is left
+// holding only the counts that weren't added.
+func AddHits(ctx context.Context, store StorageReadWrite, hits map[string]int64) error {
+	for s := store; ; {
+		if a, ok := s.(HitAdder); ok {
+			return a.AddHits(ctx, hits)
+		}
+		w, ok := s.(Wrapper)
+		if !ok {
+			break
+		}
+		s = w.Unwrap()
+	}
+	for shortCode, n := range hits {
+		for ; n > 0; n-- {
+			err := store.RecordHit(ctx, shortCode)
+			if errors.Is(err, ErrNotFound) || errors.Is(err, ErrGone) {
+				break
+			}
+			if err != nil {
+				hits[shortCode] = n
+				return err
+			}
+		}
+		delete(hits, shortCode)
+	}
+	return nil
+}
+
+// ErrUnhealthy is returned by Probe for backends that only implement Health
+var ErrUnhealthy = errors.New("backend is unhealthy")
+
+// Wrapper is implemented by stores that wrap another one, such as caches,
+// so that the optional interfaces of the store underneath can still be found
+type Wrapper interface {
+	Unwrap() StorageReadWrite
+}
+
+// Probe runs the probe of store, or of the first store it wraps that has one,
+// falling back to Health for backends that don't implement Prober
+func Probe(ctx context.Context, store StorageReader) error {
+	for {
+		if p, ok := store.(Prober); ok {
+			return p.Probe(ctx)
+		}
+		w, ok := store.(Wrapper)
+		if !ok {
+			break
+		}
+		store = w.Unwrap()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !store.Health(ctx) {
+		return ErrUnhealthy
+	}
+	return nil
+}
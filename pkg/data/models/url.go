@@ -17,6 +17,7 @@ package models
 import (
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/asaskevich/govalidator"
 )
@@ -24,6 +25,88 @@ import (
 type URL struct {
 	Destination string
 	ShortCode   string `gorm:"type:varchar(7), primary_key"`
+	// CreatedAt and UpdatedAt are filled in by the storage backend when they
+	// are left zero
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Creator   string            `json:",omitempty"`
+	Title     string            `json:",omitempty"`
+	Hits      int64             `json:",omitempty"`
+	Labels    map[string]string `json:",omitempty"`
+	// ExpiresAt, if set, is when the link stops redirecting
+	ExpiresAt *time.Time `json:",omitempty"`
+	// MaxClicks, if above zero, is how many times the link redirects before
+	// it is gone
+	MaxClicks int64 `json:",omitempty"`
+	// DeletedAt is set on the tombstone left by a soft delete, which keeps
+	// the short code from being reissued until it is swept
+	DeletedAt *time.Time `json:",omitempty"`
+	// Revisions are the destinations the link used to point at, oldest first
+	Revisions []Revision `json:",omitempty"`
+}
+
+// Revision is a past destination of a link and when it was replaced
+type Revision struct {
+	Destination string
+	ReplacedAt  time.Time
+}
+
+// Expired reports whether the link has reached its expiry time at now
+func (urlPath URL) Expired(now time.Time) bool {
+	return urlPath.ExpiresAt != nil && !now.Before(*urlPath.ExpiresAt)
+}
+
+// Exhausted reports whether the link has used up its MaxClicks
+func (urlPath URL) Exhausted() bool {
+	return urlPath.MaxClicks > 0 && urlPath.Hits >= urlPath.MaxClicks
+}
+
+// Deleted reports whether the link is a tombstone
+func (urlPath URL) Deleted() bool {
+	return urlPath.DeletedAt != nil
+}
+
+// Gone reports whether the link has stopped redirecting at now, because it
+// expired, ran out of clicks or was deleted
+func (urlPath URL) Gone(now time.Time) bool {
+	return urlPath.Expired(now) || urlPath.Exhausted() || urlPath.Deleted()
+}
+
+// Swept reports whether a sweep removes the link, which it does once it
+// expired before expiredBefore or, for a tombstone, once it was deleted before
+// deletedBefore. A tombstone is kept for its whole quarantine even if it has
+// expired.
+func (urlPath URL) Swept(expiredBefore, deletedBefore time.Time) bool {
+	if urlPath.Deleted() {
+		return urlPath.DeletedAt.Before(deletedBefore)
+	}
+	return urlPath.Expired(expiredBefore)
+}
+
+// Redirect points the link at destination, recording the one it replaces as
+// a revision at now. It does nothing if the destination is unchanged.
+func (urlPath *URL) Redirect(destination string, now time.Time) {
+	if destination == urlPath.Destination {
+		return
+	}
+	urlPath.Revisions = append(urlPath.Revisions, Revision{Destination: urlPath.Destination, ReplacedAt: now})
+	urlPath.Destination = destination
+	urlPath.UpdatedAt = now
+}
+
+// Stamp fills in zero timestamps before a write. created is kept from the
+// record being replaced, if there is one, so overwriting a link doesn't reset
+// when it was first made.
+func (urlPath *URL) Stamp(now time.Time, created time.Time) {
+	if urlPath.CreatedAt.IsZero() {
+		urlPath.CreatedAt = created
+	}
+	if urlPath.CreatedAt.IsZero() {
+		urlPath.CreatedAt = now
+	}
+	if urlPath.UpdatedAt.IsZero() {
+		urlPath.UpdatedAt = now
+	}
 }
 
 func (urlPath *URL) ValidateURL() bool {
@@ -0,0 +1,101 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+// Package backup keeps a directory of timestamped database snapshots.
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lucasreed/smol/pkg/data"
+)
+
+const (
+	prefix     = "smol-"
+	suffix     = ".db"
+	timeFormat = "20060102T150405Z"
+)
+
+// Snapshot writes a backup from b into dir, named after now, and returns its
+// path. The file only appears under its final name once it is complete.
+func Snapshot(ctx context.Context, b data.Backuper, dir string, now time.Time) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(dir, ".snapshot-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = b.Backup(ctx, tmp); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("error writing snapshot: %w", err)
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, prefix+now.UTC().Format(timeFormat)+suffix)
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Prune removes all but the newest keep snapshots in dir and returns the
+// paths it removed. Other files are left alone, and keep 0 keeps everything.
+func Prune(dir string, keep int) ([]string, error) {
+	if keep <= 0 {
+		return nil, nil
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		if _, err := time.Parse(timeFormat, strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix)); err != nil {
+			continue
+		}
+		snapshots = append(snapshots, name)
+	}
+	if len(snapshots) <= keep {
+		return nil, nil
+	}
+	// the timestamps sort the same as the times they stand for
+	sort.Strings(snapshots)
+	var removed []string
+	for _, name := range snapshots[:len(snapshots)-keep] {
+		path := filepath.Join(dir, name)
+		if err := os.Remove(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeBackuper struct {
+	body string
+	err  error
+}
+
+func (f fakeBackuper) Backup(ctx context.Context, w io.Writer) (int64, error) {
+	n, err := io.WriteString(w, f.body)
+	if err == nil {
+		err = f.err
+	}
+	return int64(n), err
+}
+
+func listDir(t *testing.T, dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smol-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	now := time.Date(2020, 5, 1, 12, 30, 0, 0, time.UTC)
+
+	path, err := Snapshot(ctx, fakeBackuper{body: "snapshot"}, dir, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "smol-20200501T123000Z.db"); path != want {
+		t.Errorf("Snapshot wrote %s, want %s", path, want)
+	}
+	if body, err := ioutil.ReadFile(path); err != nil || string(body) != "snapshot" {
+		t.Errorf("snapshot contains %q, %v", body, err)
+	}
+
+	if _, err = Snapshot(ctx, fakeBackuper{body: "partial", err: errors.New("boom")}, dir, now.Add(time.Hour)); err == nil {
+		t.Error("Snapshot succeeded with a failing backup")
+	}
+	if names := listDir(t, dir); !reflect.DeepEqual(names, []string{"smol-20200501T123000Z.db"}) {
+		t.Errorf("failed snapshot left %v behind", names)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smol-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{
+		"smol-20200503T000000Z.db",
+		"smol-20200501T000000Z.db",
+		"smol-20200502T000000Z.db",
+		"smol-notatime.db",
+		"other.db",
+	} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if removed, err := Prune(dir, 0); err != nil || removed != nil {
+		t.Errorf("Prune with keep 0 returned %v, %v", removed, err)
+	}
+	removed, err := Prune(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join(dir, "smol-20200501T000000Z.db")}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("Prune removed %v, want %v", removed, want)
+	}
+	want := []string{"other.db", "smol-20200502T000000Z.db", "smol-20200503T000000Z.db", "smol-notatime.db"}
+	if names := listDir(t, dir); !reflect.DeepEqual(names, want) {
+		t.Errorf("Prune left %v, want %v", names, want)
+	}
+}
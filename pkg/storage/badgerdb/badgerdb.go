@@ -0,0 +1,563 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+// Package badgerdb stores links in Badger, an embedded LSM tree. Unlike bolt,
+// which runs one write transaction at a time, Badger commits concurrent
+// writers in parallel and only retries those that touched the same keys.
+package badgerdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/data/models"
+	"github.com/lucasreed/smol/pkg/storage/record"
+)
+
+const (
+	// maxTxAttempts bounds how often a write is retried when it keeps
+	// conflicting with concurrent writes to the same link
+	maxTxAttempts = 50
+	// gcInterval is how often the value log is compacted
+	gcInterval = 5 * time.Minute
+	// gcDiscardRatio is how much of a value log file has to be garbage
+	// before it is rewritten
+	gcDiscardRatio = 0.5
+	// sweepBatch is how many links Sweep removes per transaction, keeping
+	// each one below badger's transaction size limit
+	sweepBatch = 1000
+)
+
+var (
+	// urlPrefix keys map short codes to their encoded record
+	urlPrefix = []byte("url:")
+	// codePrefix keys map destinations back to their short code
+	codePrefix = []byte("code:")
+)
+
+// Store represents a badger storage location
+type Store struct {
+	DB   *badger.DB
+	Path string
+
+	stopGC chan struct{}
+	gcDone sync.WaitGroup
+}
+
+// NewStore represents a new instance of a badger storage location, a
+// directory that is created if it doesn't exist
+func NewStore(path string) *Store {
+	return &Store{
+		Path: path,
+	}
+}
+
+func (s *Store) Open(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db, err := badger.Open(badger.DefaultOptions(s.Path).WithLogger(logger{}))
+	if err != nil {
+		return fmt.Errorf("[badger] error opening %s: %w", s.Path, err)
+	}
+	s.DB = db
+	s.stopGC = make(chan struct{})
+	s.gcDone.Add(1)
+	go s.collectGarbage()
+	return nil
+}
+
+func (s *Store) Close() error {
+	close(s.stopGC)
+	s.gcDone.Wait()
+	return s.DB.Close()
+}
+
+func (s *Store) Health(ctx context.Context) bool {
+	return s.Probe(ctx) == nil
+}
+
+// Probe reads the empty short code
+func (s *Store) Probe(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.DB == nil {
+		return errors.New("[badger] database not open")
+	}
+	if _, err := s.GetURL(ctx, ""); err != nil && !errors.Is(err, data.ErrNotFound) {
+		return fmt.Errorf("[badger] probe failed: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) GetURL(ctx context.Context, shortCode string) (models.URL, error) {
+	if err := ctx.Err(); err != nil {
+		return models.URL{}, err
+	}
+	var u models.URL
+	err := s.DB.View(func(txn *badger.Txn) error {
+		var err error
+		u, err = getURL(txn, shortCode)
+		return err
+	})
+	if err != nil {
+		return models.URL{}, err
+	}
+	if u.Gone(time.Now()) {
+		return u, fmt.Errorf("%w: %s", data.ErrGone, shortCode)
+	}
+	return u, nil
+}
+
+// GetShortCode looks the code up and checks the link it points at isn't gone
+// in the same transaction
+func (s *Store) GetShortCode(ctx context.Context, destination string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	var shortCode string
+	err := s.DB.View(func(txn *badger.Txn) error {
+		code, err := get(txn, codeKey(destination))
+		if err != nil || code == nil {
+			return err
+		}
+		u, err := getURL(txn, string(code))
+		if errors.Is(err, data.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !u.Gone(time.Now()) {
+			shortCode = string(code)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if shortCode == "" {
+		return "", fmt.Errorf("%w: %s", data.ErrNotFound, destination)
+	}
+	return shortCode, nil
+}
+
+// List walks the url keys in order, the cursor being the last code of the
+// previous page
+func (s *Store) List(ctx context.Context, cursor string, limit int) ([]models.URL, string, error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("%w: %d", data.ErrInvalidLimit, limit)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	var urls []models.URL
+	next := ""
+	err := s.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, PrefetchSize: limit, Prefix: urlPrefix})
+		defer it.Close()
+		start := urlPrefix
+		if cursor != "" {
+			start = urlKey(cursor)
+		}
+		for it.Seek(start); it.Valid(); it.Next() {
+			item := it.Item()
+			code := string(bytes.TrimPrefix(item.Key(), urlPrefix))
+			if code == cursor {
+				continue
+			}
+			if len(urls) == limit {
+				next = urls[len(urls)-1].ShortCode
+				break
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			u, err := record.Decode(code, value)
+			if err != nil {
+				return err
+			}
+			urls = append(urls, u)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return urls, next, nil
+}
+
+func (s *Store) SetURL(ctx context.Context, url models.URL) error {
+	return s.setURL(ctx, url, false)
+}
+
+// RewriteURL replaces the link like SetURL but keeps its stored hit count.
+// Badger tracks the read, so a hit counted concurrently conflicts and the
+// rewrite is retried.
+func (s *Store) RewriteURL(ctx context.Context, url models.URL) error {
+	return s.setURL(ctx, url, true)
+}
+
+func (s *Store) setURL(ctx context.Context, url models.URL, keepHits bool) error {
+	return s.update(ctx, func(txn *badger.Txn) error {
+		var created time.Time
+		old, err := getURL(txn, url.ShortCode)
+		switch {
+		case err == nil:
+			if old.Destination != url.Destination {
+				if err = unmapDestination(txn, old); err != nil {
+					return err
+				}
+			}
+			created = old.CreatedAt
+			if keepHits {
+				url.Hits = old.Hits
+			}
+		case !errors.Is(err, data.ErrNotFound):
+			return err
+		}
+		url.Stamp(time.Now(), created)
+		return put(txn, url)
+	})
+}
+
+// CreateURL checks the short code and destination are free and writes the
+// link in one transaction. Badger tracks the reads, so a concurrent create
+// of the same code or destination conflicts and is retried, then finds it
+// taken.
+func (s *Store) CreateURL(ctx context.Context, url models.URL) error {
+	return s.update(ctx, func(txn *badger.Txn) error {
+		_, err := getURL(txn, url.ShortCode)
+		if err == nil {
+			return fmt.Errorf("%w: %s", data.ErrExists, url.ShortCode)
+		}
+		if !errors.Is(err, data.ErrNotFound) {
+			return err
+		}
+		now := time.Now()
+		if !url.Gone(now) {
+			if err = destinationFree(txn, url.ShortCode, url.Destination, now); err != nil {
+				return err
+			}
+		}
+		url.Stamp(now, time.Time{})
+		return put(txn, url)
+	})
+}
+
+func (s *Store) RecordHit(ctx context.Context, shortCode string) error {
+	return s.update(ctx, func(txn *badger.Txn) error {
+		u, err := getURL(txn, shortCode)
+		if err != nil {
+			return err
+		}
+		if u.Exhausted() {
+			return fmt.Errorf("%w: %s", data.ErrGone, shortCode)
+		}
+		u.Hits++
+		if u.Exhausted() {
+			if err = unmapDestination(txn, u); err != nil {
+				return err
+			}
+		}
+		encoded, err := record.Encode(u)
+		if err != nil {
+			return err
+		}
+		return txn.Set(urlKey(shortCode), encoded)
+	})
+}
+
+func (s *Store) Delete(ctx context.Context, shortCode string) error {
+	return s.update(ctx, func(txn *badger.Txn) error {
+		u, err := getURL(txn, shortCode)
+		if err != nil {
+			return err
+		}
+		if err = unmapDestination(txn, u); err != nil {
+			return err
+		}
+		return txn.Delete(urlKey(shortCode))
+	})
+}
+
+func (s *Store) SoftDelete(ctx context.Context, shortCode string) error {
+	return s.update(ctx, func(txn *badger.Txn) error {
+		u, err := getURL(txn, shortCode)
+		if err != nil {
+			return err
+		}
+		if u.Deleted() {
+			return fmt.Errorf("%w: %s", data.ErrGone, shortCode)
+		}
+		if err = unmapDestination(txn, u); err != nil {
+			return err
+		}
+		now := time.Now()
+		u.DeletedAt, u.UpdatedAt = &now, now
+		return put(txn, u)
+	})
+}
+
+func (s *Store) UpdateDestination(ctx context.Context, shortCode, destination string) (models.URL, error) {
+	var updated models.URL
+	err := s.update(ctx, func(txn *badger.Txn) error {
+		u, err := getURL(txn, shortCode)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if u.Gone(now) {
+			return fmt.Errorf("%w: %s", data.ErrGone, shortCode)
+		}
+		if err = destinationFree(txn, shortCode, destination, now); err != nil {
+			return err
+		}
+		if err = unmapDestination(txn, u); err != nil {
+			return err
+		}
+		u.Redirect(destination, now)
+		updated = u
+		return put(txn, u)
+	})
+	if err != nil {
+		return models.URL{}, err
+	}
+	return updated, nil
+}
+
+func (s *Store) Restore(ctx context.Context, shortCode string) error {
+	return s.update(ctx, func(txn *badger.Txn) error {
+		u, err := getURL(txn, shortCode)
+		if err != nil {
+			return err
+		}
+		if !u.Deleted() {
+			return nil
+		}
+		now := time.Now()
+		if err = destinationFree(txn, shortCode, u.Destination, now); err != nil {
+			return err
+		}
+		u.DeletedAt, u.UpdatedAt = nil, now
+		return put(txn, u)
+	})
+}
+
+// Sweep removes links that expired before expiredBefore and tombstones
+// deleted before deletedBefore. Candidates are found in one read and removed
+// in batches, each checking its links again in case they changed meanwhile.
+func (s *Store) Sweep(ctx context.Context, expiredBefore, deletedBefore time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	var codes []string
+	err := s.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, PrefetchSize: 100, Prefix: urlPrefix})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			u, err := record.Decode(string(bytes.TrimPrefix(item.Key(), urlPrefix)), value)
+			if err != nil {
+				return err
+			}
+			if u.Swept(expiredBefore, deletedBefore) {
+				codes = append(codes, u.ShortCode)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	swept := 0
+	for start := 0; start < len(codes); start += sweepBatch {
+		end := start + sweepBatch
+		if end > len(codes) {
+			end = len(codes)
+		}
+		n := 0
+		err = s.update(ctx, func(txn *badger.Txn) error {
+			n = 0
+			for _, code := range codes[start:end] {
+				u, err := getURL(txn, code)
+				if errors.Is(err, data.ErrNotFound) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if !u.Swept(expiredBefore, deletedBefore) {
+					continue
+				}
+				if err = unmapDestination(txn, u); err != nil {
+					return err
+				}
+				if err = txn.Delete(urlKey(code)); err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		})
+		if err != nil {
+			return swept, err
+		}
+		swept += n
+	}
+	return swept, nil
+}
+
+// update runs fn in a write transaction, running it again from scratch when
+// badger reports a conflict with a concurrent transaction
+func (s *Store) update(ctx context.Context, fn func(txn *badger.Txn) error) error {
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := s.DB.Update(fn)
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+		if attempt == maxTxAttempts {
+			return fmt.Errorf("[badger] giving up after %d attempts: %w", attempt, err)
+		}
+	}
+}
+
+// collectGarbage rewrites value log files that are mostly garbage, which
+// badger leaves to the application, until Close
+func (s *Store) collectGarbage() {
+	defer s.gcDone.Done()
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// each run rewrites at most one file, so keep going until
+			// there is nothing left worth rewriting
+			for s.DB.RunValueLogGC(gcDiscardRatio) == nil {
+			}
+		case <-s.stopGC:
+			return
+		}
+	}
+}
+
+// destinationFree fails with ErrDestinationExists if a live link other than
+// shortCode holds destination
+func destinationFree(txn *badger.Txn, shortCode, destination string, now time.Time) error {
+	other, err := get(txn, codeKey(destination))
+	if err != nil || other == nil || string(other) == shortCode {
+		return err
+	}
+	live, err := getURL(txn, string(other))
+	if errors.Is(err, data.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !live.Gone(now) {
+		return fmt.Errorf("%w: %s is shortened as %s", data.ErrDestinationExists, destination, other)
+	}
+	return nil
+}
+
+// unmapDestination removes the reverse mapping of u unless the destination
+// has since been shortened again under another code
+func unmapDestination(txn *badger.Txn, u models.URL) error {
+	code, err := get(txn, codeKey(u.Destination))
+	if err != nil || string(code) != u.ShortCode {
+		return err
+	}
+	return txn.Delete(codeKey(u.Destination))
+}
+
+// put writes both directions of the mapping for url. Links that are gone
+// aren't mapped so that they can't take the destination from a live link.
+func put(txn *badger.Txn, url models.URL) error {
+	encoded, err := record.Encode(url)
+	if err != nil {
+		return err
+	}
+	if err = txn.Set(urlKey(url.ShortCode), encoded); err != nil {
+		return err
+	}
+	if url.Gone(time.Now()) {
+		return nil
+	}
+	return txn.Set(codeKey(url.Destination), []byte(url.ShortCode))
+}
+
+func getURL(txn *badger.Txn, shortCode string) (models.URL, error) {
+	value, err := get(txn, urlKey(shortCode))
+	if err != nil {
+		return models.URL{}, err
+	}
+	if value == nil {
+		return models.URL{}, fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+	}
+	return record.Decode(shortCode, value)
+}
+
+// get returns a copy of the value at key, or nil if there is none
+func get(txn *badger.Txn, key []byte) ([]byte, error) {
+	item, err := txn.Get(key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+func urlKey(shortCode string) []byte {
+	return append(append([]byte{}, urlPrefix...), shortCode...)
+}
+
+func codeKey(destination string) []byte {
+	return append(append([]byte{}, codePrefix...), destination...)
+}
+
+// logger passes badger's warnings and errors on to the standard logger and
+// drops the rest, which badger produces a lot of
+type logger struct{}
+
+func (logger) Errorf(format string, args ...interface{}) {
+	log.Printf("[badger] ERROR: "+format, args...)
+}
+
+func (logger) Warningf(format string, args ...interface{}) {
+	log.Printf("[badger] WARNING: "+format, args...)
+}
+
+func (logger) Infof(string, ...interface{})  {}
+func (logger) Debugf(string, ...interface{}) {}
@@ -0,0 +1,73 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package boltdb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/lucasreed/smol/pkg/data"
+)
+
+// Backup writes a consistent copy of the database to w. It runs in a read
+// transaction, so writes carry on while it streams.
+func (s *Store) Backup(ctx context.Context, w io.Writer) (int64, error) {
+	return backup(ctx, s.DB, w)
+}
+
+// BackupFile writes a consistent copy of the bolt file at path to w without
+// opening a Store. The file is opened read-only, which fails after timeout
+// while another process, such as a running smolserv, has it open.
+func BackupFile(ctx context.Context, path string, timeout time.Duration, w io.Writer) (int64, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: timeout})
+	if err != nil {
+		return 0, fmt.Errorf("[boltdb] error opening %s: %w", path, err)
+	}
+	defer db.Close()
+	return backup(ctx, db, w)
+}
+
+func backup(ctx context.Context, db *bolt.DB, w io.Writer) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	var n int64
+	err := db.View(func(tx *bolt.Tx) error {
+		if sizer, ok := w.(data.BackupSizer); ok {
+			sizer.SetBackupSize(tx.Size())
+		}
+		var err error
+		n, err = tx.WriteTo(&contextWriter{ctx: ctx, w: w})
+		return err
+	})
+	return n, err
+}
+
+// contextWriter stops a backup part way through once ctx is done
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (c *contextWriter) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.w.Write(p)
+}
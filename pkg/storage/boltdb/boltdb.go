@@ -15,16 +15,24 @@
 package boltdb
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 
+	"github.com/lucasreed/smol/pkg/data"
 	"github.com/lucasreed/smol/pkg/data/models"
+	"github.com/lucasreed/smol/pkg/storage/record"
 )
 
 var (
-	bucketName = "smol"
+	// urlBucket maps short codes to their encoded record
+	urlBucket = []byte("urls")
+	// codeBucket maps destinations back to their short code
+	codeBucket = []byte("codes")
 )
 
 // Store represents a boltdb storage location
@@ -40,7 +48,10 @@ func NewStore(path string) *Store {
 	}
 }
 
-func (s *Store) Open() error {
+func (s *Store) Open(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	db, err := bolt.Open(s.Path, 0600, nil)
 	if err != nil {
 		return err
@@ -48,11 +59,12 @@ func (s *Store) Open() error {
 	s.DB = db
 
 	if err = db.Update(func(tx *bolt.Tx) error {
-		_, err = tx.CreateBucketIfNotExists([]byte(bucketName))
-		if err != nil {
-			return fmt.Errorf("[boltdb] error creating bucket: %s", err)
+		for _, name := range [][]byte{urlBucket, codeBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return fmt.Errorf("[boltdb] error creating bucket: %s", err)
+			}
 		}
-		return nil
+		return migrateLegacyBucket(tx)
 	}); err != nil {
 		return err
 	}
@@ -63,60 +75,427 @@ func (s *Store) Close() error {
 	return s.DB.Close()
 }
 
-func (s *Store) Health() bool {
-	if _, err := os.Stat(s.Path); os.IsNotExist(err) {
-		return false
+func (s *Store) Health(ctx context.Context) bool {
+	return s.Probe(ctx) == nil
+}
+
+// Probe checks the file is still on disk, as bolt keeps serving its memory
+// map after it is removed, and reads the empty short code
+func (s *Store) Probe(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.DB == nil {
+		return errors.New("[boltdb] database not open")
+	}
+	if _, err := os.Stat(s.Path); err != nil {
+		return fmt.Errorf("[boltdb] %w", err)
 	}
-	return s.DB != nil
+	if _, err := s.GetURL(ctx, ""); err != nil && !errors.Is(err, data.ErrNotFound) {
+		return fmt.Errorf("[boltdb] probe failed: %w", err)
+	}
+	return nil
 }
 
-func (s *Store) GetURL(shortCode string) (models.URL, error) {
-	data, err := s.getValue(shortCode)
+func (s *Store) GetURL(ctx context.Context, shortCode string) (models.URL, error) {
+	value, err := s.getValue(ctx, urlBucket, shortCode)
+	if err != nil {
+		return models.URL{}, err
+	}
+	u, err := record.Decode(shortCode, []byte(value))
 	if err != nil {
 		return models.URL{}, err
 	}
-	return models.URL{Destination: data, ShortCode: shortCode}, nil
+	if u.Gone(time.Now()) {
+		return u, fmt.Errorf("%w: %s", data.ErrGone, shortCode)
+	}
+	return u, nil
+}
+
+// GetShortCode looks the code up and checks the link it points at isn't gone
+// in the same transaction
+func (s *Store) GetShortCode(ctx context.Context, destination string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	var shortCode string
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		code := tx.Bucket(codeBucket).Get([]byte(destination))
+		if code == nil {
+			return nil
+		}
+		u, err := record.Decode(string(code), tx.Bucket(urlBucket).Get(code))
+		if err != nil {
+			return err
+		}
+		if !u.Gone(time.Now()) {
+			shortCode = string(code)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if shortCode == "" {
+		return "", fmt.Errorf("%w: %s", data.ErrNotFound, destination)
+	}
+	return shortCode, nil
+}
+
+// List walks the url bucket in key order, the cursor being the last code of
+// the previous page
+func (s *Store) List(ctx context.Context, cursor string, limit int) ([]models.URL, string, error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("%w: %d", data.ErrInvalidLimit, limit)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	var urls []models.URL
+	next := ""
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(urlBucket).Cursor()
+		k, v := c.First()
+		if cursor != "" {
+			k, v = c.Seek([]byte(cursor))
+			if k != nil && string(k) == cursor {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil; k, v = c.Next() {
+			if len(urls) == limit {
+				next = urls[len(urls)-1].ShortCode
+				break
+			}
+			u, err := record.Decode(string(k), v)
+			if err != nil {
+				return err
+			}
+			urls = append(urls, u)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return urls, next, nil
+}
+
+func (s *Store) SetURL(ctx context.Context, url models.URL) error {
+	return s.setURL(ctx, url, false)
 }
 
-func (s *Store) GetShortCode(destination string) (string, error) {
-	return s.getValue(destination)
+// RewriteURL replaces the link like SetURL but keeps its stored hit count
+func (s *Store) RewriteURL(ctx context.Context, url models.URL) error {
+	return s.setURL(ctx, url, true)
 }
 
-func (s *Store) SetURL(shortCode, url string) error {
+func (s *Store) setURL(ctx context.Context, url models.URL, keepHits bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	return s.DB.Batch(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketName))
-		if err := b.Put([]byte(shortCode), []byte(url)); err != nil {
+		urls, codes := tx.Bucket(urlBucket), tx.Bucket(codeBucket)
+		var created time.Time
+		if value := urls.Get([]byte(url.ShortCode)); value != nil {
+			old, err := record.Decode(url.ShortCode, value)
+			if err != nil {
+				return err
+			}
+			if old.Destination != url.Destination {
+				if err = unmapDestination(codes, old); err != nil {
+					return err
+				}
+			}
+			created = old.CreatedAt
+			if keepHits {
+				url.Hits = old.Hits
+			}
+		}
+		url.Stamp(time.Now(), created)
+		return put(urls, codes, url)
+	})
+}
+
+// CreateURL checks the short code and destination are free and writes the
+// link in a single bolt transaction
+func (s *Store) CreateURL(ctx context.Context, url models.URL) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		urls, codes := tx.Bucket(urlBucket), tx.Bucket(codeBucket)
+		if urls.Get([]byte(url.ShortCode)) != nil {
+			return fmt.Errorf("%w: %s", data.ErrExists, url.ShortCode)
+		}
+		now := time.Now()
+		if !url.Gone(now) {
+			if err := destinationFree(urls, codes, url.ShortCode, url.Destination, now); err != nil {
+				return err
+			}
+		}
+		url.Stamp(now, time.Time{})
+		return put(urls, codes, url)
+	})
+}
+
+// RecordHit rewrites the record with its count bumped. Batch keeps a burst of
+// redirects down to a few write transactions, which bolt still runs one at a
+// time, so the MaxClicks check can't race.
+func (s *Store) RecordHit(ctx context.Context, shortCode string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.DB.Batch(func(tx *bolt.Tx) error {
+		urls, codes := tx.Bucket(urlBucket), tx.Bucket(codeBucket)
+		value := urls.Get([]byte(shortCode))
+		if value == nil {
+			return fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+		}
+		u, err := record.Decode(shortCode, value)
+		if err != nil {
 			return err
 		}
-		if err := b.Put([]byte(url), []byte(shortCode)); err != nil {
+		if u.Exhausted() {
+			return fmt.Errorf("%w: %s", data.ErrGone, shortCode)
+		}
+		u.Hits++
+		if u.Exhausted() {
+			if err = unmapDestination(codes, u); err != nil {
+				return err
+			}
+		}
+		encoded, err := record.Encode(u)
+		if err != nil {
 			return err
 		}
+		return urls.Put([]byte(shortCode), encoded)
+	})
+}
+
+// AddHits counts buffered hits in one write transaction, stopping limited
+// links at MaxClicks as RecordHit would
+func (s *Store) AddHits(ctx context.Context, hits map[string]int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		urls, codes := tx.Bucket(urlBucket), tx.Bucket(codeBucket)
+		for shortCode, n := range hits {
+			value := urls.Get([]byte(shortCode))
+			if value == nil {
+				continue
+			}
+			u, err := record.Decode(shortCode, value)
+			if err != nil {
+				return err
+			}
+			if u.Exhausted() {
+				continue
+			}
+			u.Hits += n
+			if u.Exhausted() {
+				u.Hits = u.MaxClicks
+				if err = unmapDestination(codes, u); err != nil {
+					return err
+				}
+			}
+			encoded, err := record.Encode(u)
+			if err != nil {
+				return err
+			}
+			if err = urls.Put([]byte(shortCode), encoded); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 }
 
-func (s *Store) Delete(shortCode string) error {
-	destination, err := s.getValue(shortCode)
-	if err != nil {
+func (s *Store) Delete(ctx context.Context, shortCode string) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 	return s.DB.Batch(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketName))
-		if err = b.Delete([]byte(shortCode)); err != nil {
+		urls, codes := tx.Bucket(urlBucket), tx.Bucket(codeBucket)
+		value := urls.Get([]byte(shortCode))
+		if value == nil {
+			return fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+		}
+		u, err := record.Decode(shortCode, value)
+		if err != nil {
+			return err
+		}
+		if err = unmapDestination(codes, u); err != nil {
+			return err
+		}
+		return urls.Delete([]byte(shortCode))
+	})
+}
+
+func (s *Store) SoftDelete(ctx context.Context, shortCode string) error {
+	return s.update(ctx, shortCode, func(urls, codes *bolt.Bucket, u models.URL) error {
+		if u.Deleted() {
+			return fmt.Errorf("%w: %s", data.ErrGone, shortCode)
+		}
+		if err := unmapDestination(codes, u); err != nil {
+			return err
+		}
+		now := time.Now()
+		u.DeletedAt, u.UpdatedAt = &now, now
+		return put(urls, codes, u)
+	})
+}
+
+func (s *Store) UpdateDestination(ctx context.Context, shortCode, destination string) (models.URL, error) {
+	var updated models.URL
+	err := s.update(ctx, shortCode, func(urls, codes *bolt.Bucket, u models.URL) error {
+		now := time.Now()
+		if u.Gone(now) {
+			return fmt.Errorf("%w: %s", data.ErrGone, shortCode)
+		}
+		if err := destinationFree(urls, codes, shortCode, destination, now); err != nil {
+			return err
+		}
+		if err := unmapDestination(codes, u); err != nil {
+			return err
+		}
+		u.Redirect(destination, now)
+		updated = u
+		return put(urls, codes, u)
+	})
+	if err != nil {
+		return models.URL{}, err
+	}
+	return updated, nil
+}
+
+func (s *Store) Restore(ctx context.Context, shortCode string) error {
+	return s.update(ctx, shortCode, func(urls, codes *bolt.Bucket, u models.URL) error {
+		if !u.Deleted() {
+			return nil
+		}
+		if err := destinationFree(urls, codes, shortCode, u.Destination, time.Now()); err != nil {
+			return err
+		}
+		u.DeletedAt, u.UpdatedAt = nil, time.Now()
+		return put(urls, codes, u)
+	})
+}
+
+// update runs fn on the stored record of shortCode in a write transaction
+func (s *Store) update(ctx context.Context, shortCode string, fn func(urls, codes *bolt.Bucket, u models.URL) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		urls, codes := tx.Bucket(urlBucket), tx.Bucket(codeBucket)
+		value := urls.Get([]byte(shortCode))
+		if value == nil {
+			return fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+		}
+		u, err := record.Decode(shortCode, value)
+		if err != nil {
 			return err
 		}
-		if err = b.Delete([]byte(destination)); err != nil {
+		return fn(urls, codes, u)
+	})
+}
+
+// Sweep removes links that expired before expiredBefore and tombstones
+// deleted before deletedBefore. It walks the whole bucket in one write
+// transaction, which is fine for the sizes bolt is used at.
+func (s *Store) Sweep(ctx context.Context, expiredBefore, deletedBefore time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	swept := 0
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		urls, codes := tx.Bucket(urlBucket), tx.Bucket(codeBucket)
+		var expired []models.URL
+		err := urls.ForEach(func(k, v []byte) error {
+			u, err := record.Decode(string(k), v)
+			if err != nil {
+				return err
+			}
+			if u.Swept(expiredBefore, deletedBefore) {
+				expired = append(expired, u)
+			}
+			return nil
+		})
+		if err != nil {
 			return err
 		}
+		// bolt doesn't allow deleting from a bucket while iterating over it
+		for _, u := range expired {
+			if err = unmapDestination(codes, u); err != nil {
+				return err
+			}
+			if err = urls.Delete([]byte(u.ShortCode)); err != nil {
+				return err
+			}
+		}
+		swept = len(expired)
 		return nil
 	})
+	return swept, err
 }
 
-func (s *Store) getValue(key string) (string, error) {
+// unmapDestination removes the reverse mapping of u unless the destination
+// has since been shortened again under another code
+func unmapDestination(codes *bolt.Bucket, u models.URL) error {
+	if string(codes.Get([]byte(u.Destination))) != u.ShortCode {
+		return nil
+	}
+	return codes.Delete([]byte(u.Destination))
+}
+
+// destinationFree returns ErrDestinationExists if a link other than shortCode
+// that isn't gone holds destination
+func destinationFree(urls, codes *bolt.Bucket, shortCode, destination string, now time.Time) error {
+	other := codes.Get([]byte(destination))
+	if other == nil || string(other) == shortCode {
+		return nil
+	}
+	value := urls.Get(other)
+	if value == nil {
+		return nil
+	}
+	live, err := record.Decode(string(other), value)
+	if err != nil {
+		return err
+	}
+	if !live.Gone(now) {
+		return fmt.Errorf("%w: %s is shortened as %s", data.ErrDestinationExists, destination, other)
+	}
+	return nil
+}
+
+// put writes both directions of the mapping for url. Links that are gone
+// aren't mapped so that they can't take the destination from a live link.
+func put(urls, codes *bolt.Bucket, url models.URL) error {
+	encoded, err := record.Encode(url)
+	if err != nil {
+		return err
+	}
+	if err = urls.Put([]byte(url.ShortCode), encoded); err != nil {
+		return err
+	}
+	if url.Gone(time.Now()) {
+		return nil
+	}
+	return codes.Put([]byte(url.Destination), []byte(url.ShortCode))
+}
+
+// getValue reads a single key from bucket. Bolt transactions can't be
+// interrupted, so ctx is only checked before the read starts.
+func (s *Store) getValue(ctx context.Context, bucket []byte, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 	var value string
 	err := s.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketName))
-		val := b.Get([]byte(key))
+		val := tx.Bucket(bucket).Get([]byte(key))
 		value = string(val)
 		return nil
 	})
@@ -124,7 +503,7 @@ func (s *Store) getValue(key string) (string, error) {
 		return "", err
 	}
 	if value == "" {
-		return "", fmt.Errorf("key not found: %s", key)
+		return "", fmt.Errorf("%w: %s", data.ErrNotFound, key)
 	}
 	return value, nil
 }
@@ -0,0 +1,337 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package boltdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/data/models"
+	"github.com/lucasreed/smol/pkg/storage/storagetest"
+)
+
+func TestStoreConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) data.StorageReadWrite {
+		dir, err := ioutil.TempDir("", "smol-boltdb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+
+		store := NewStore(filepath.Join(dir, "boltdb"))
+		if err = store.Open(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+func TestStore_MigrateLegacyBucket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smol-boltdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "boltdb")
+
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(legacyBucket)
+		if err != nil {
+			return err
+		}
+		if err = b.Put([]byte("abcd123"), []byte("https://example.com")); err != nil {
+			return err
+		}
+		return b.Put([]byte("https://example.com"), []byte("abcd123"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	store := NewStore(path)
+	if err = store.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	u, err := store.GetURL(ctx, "abcd123")
+	if err != nil {
+		t.Fatalf("GetURL after migration: %v", err)
+	}
+	if u.Destination != "https://example.com" {
+		t.Errorf("GetURL returned %s after migration, want https://example.com", u.Destination)
+	}
+	code, err := store.GetShortCode(ctx, "https://example.com")
+	if err != nil {
+		t.Fatalf("GetShortCode after migration: %v", err)
+	}
+	if code != "abcd123" {
+		t.Errorf("GetShortCode returned %s after migration, want abcd123", code)
+	}
+	err = store.DB.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(legacyBucket) != nil {
+			t.Error("legacy bucket still exists after migration")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// migrated values are still bare destinations until they are next written
+	if err = store.RecordHit(ctx, "abcd123"); err != nil {
+		t.Fatalf("RecordHit on a plain value: %v", err)
+	}
+	u, err = store.GetURL(ctx, "abcd123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Destination != "https://example.com" || u.Hits != 1 {
+		t.Errorf("GetURL returned %+v after RecordHit, want https://example.com with 1 hit", u)
+	}
+}
+
+type sizedBuffer struct {
+	bytes.Buffer
+	size int64
+}
+
+func (b *sizedBuffer) SetBackupSize(n int64) {
+	b.size = n
+}
+
+func TestStore_Backup(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "smol-boltdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewStore(filepath.Join(dir, "boltdb"))
+	if err = store.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.SetURL(ctx, models.URL{ShortCode: "abcd123", Destination: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	buf := sizedBuffer{size: -1}
+	n, err := store.Backup(ctx, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("Backup returned %d bytes, wrote %d", n, buf.Len())
+	}
+	if buf.size != n {
+		t.Errorf("Backup announced %d bytes, wrote %d", buf.size, n)
+	}
+
+	// the live file is locked, so a direct backup has to give up
+	if _, err = BackupFile(ctx, store.Path, 50*time.Millisecond, ioutil.Discard); err == nil {
+		t.Error("BackupFile succeeded while the store was open")
+	}
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	copyPath := filepath.Join(dir, "copy")
+	if err = ioutil.WriteFile(copyPath, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewStore(copyPath)
+	if err = restored.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := restored.GetURL(ctx, "abcd123"); err != nil || u.Destination != "https://example.com" {
+		t.Errorf("GetURL on the backup returned %+v, %v", u, err)
+	}
+	if err = restored.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = BackupFile(ctx, copyPath, time.Second, ioutil.Discard); err != nil || n == 0 {
+		t.Errorf("BackupFile on a closed file returned %d, %v", n, err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "smol-boltdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewStore(filepath.Join(dir, "boltdb"))
+	if err = store.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for code, destination := range map[string]string{
+		"aaaaaaa": "https://example.com/a",
+		"bbbbbbb": "https://example.com/b",
+		"ccccccc": "https://example.com/c",
+		"ddddddd": "https://example.com/d",
+	} {
+		if err = store.SetURL(ctx, models.URL{ShortCode: code, Destination: destination}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = store.SoftDelete(ctx, "ddddddd"); err != nil {
+		t.Fatal(err)
+	}
+	report, err := func() (CheckReport, error) {
+		var report CheckReport
+		err := store.DB.View(func(tx *bolt.Tx) error {
+			report, err = check(ctx, tx, time.Now())
+			return err
+		})
+		return report, err
+	}()
+	if err != nil || len(report.Problems) != 0 || report.Links != 4 || report.Mappings != 3 {
+		t.Fatalf("check on a consistent store returned %+v, %v", report, err)
+	}
+
+	// what a crash between the two puts of an overwrite leaves behind, plus
+	// a few other kinds of damage
+	err = store.DB.Update(func(tx *bolt.Tx) error {
+		codes := tx.Bucket(codeBucket)
+		for dest, code := range map[string]string{
+			"https://example.com/orphan": "zzzzzzz",
+			"https://example.com/b":      "aaaaaaa",
+			"https://example.com/d":      "ddddddd",
+		} {
+			if err := codes.Put([]byte(dest), []byte(code)); err != nil {
+				return err
+			}
+		}
+		return codes.Delete([]byte("https://example.com/c"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = Check(ctx, store.Path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := map[string]ProblemKind{}
+	for _, p := range report.Problems {
+		kinds[p.Key] = p.Kind
+	}
+	want := map[string]ProblemKind{
+		"https://example.com/orphan": Orphaned,
+		"https://example.com/b":      Mismatched,
+		"https://example.com/d":      Stale,
+		"bbbbbbb":                    Unmapped,
+		"ccccccc":                    Unmapped,
+	}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("Check found %v, want %v", report.Problems, want)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "smol-boltdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewStore(filepath.Join(dir, "boltdb"))
+	if err = store.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// write and delete in a single transaction each, SetURL and Delete
+	// batch and would spend most of the test waiting
+	err = store.DB.Update(func(tx *bolt.Tx) error {
+		urls, codes := tx.Bucket(urlBucket), tx.Bucket(codeBucket)
+		for i := 0; i < 2000; i++ {
+			u := models.URL{ShortCode: fmt.Sprintf("c%06d", i), Destination: fmt.Sprintf("https://example.com/%d/%s", i, strings.Repeat("x", 200))}
+			if err := put(urls, codes, u); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.DB.Update(func(tx *bolt.Tx) error {
+		urls, codes := tx.Bucket(urlBucket), tx.Bucket(codeBucket)
+		for i := 1; i < 2000; i++ {
+			if err := urls.Delete([]byte(fmt.Sprintf("c%06d", i))); err != nil {
+				return err
+			}
+			if err := codes.Delete([]byte(fmt.Sprintf("https://example.com/%d/%s", i, strings.Repeat("x", 200)))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "compact")
+	stats, err := Compact(ctx, store.Path, dst, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.After >= stats.Before {
+		t.Errorf("Compact went from %d to %d bytes", stats.Before, stats.After)
+	}
+	if _, err = Compact(ctx, store.Path, dst, time.Second); err == nil {
+		t.Error("Compact overwrote an existing file")
+	}
+
+	compacted := NewStore(dst)
+	if err = compacted.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer compacted.Close()
+	if code, err := compacted.GetShortCode(ctx, fmt.Sprintf("https://example.com/0/%s", strings.Repeat("x", 200))); err != nil || code != "c000000" {
+		t.Errorf("GetShortCode on the compacted file returned %s, %v", code, err)
+	}
+	if _, err = compacted.GetURL(ctx, "c000001"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("GetURL of a deleted link returned %v on the compacted file", err)
+	}
+}
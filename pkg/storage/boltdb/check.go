@@ -0,0 +1,168 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package boltdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/lucasreed/smol/pkg/data/models"
+	"github.com/lucasreed/smol/pkg/storage/record"
+)
+
+// ProblemKind says what is wrong with a mapping found by Check
+type ProblemKind string
+
+const (
+	// Undecodable records can't be read at all
+	Undecodable ProblemKind = "undecodable"
+	// Orphaned reverse mappings point at a short code that doesn't exist
+	Orphaned ProblemKind = "orphaned"
+	// Mismatched reverse mappings point at a link to somewhere else
+	Mismatched ProblemKind = "mismatched"
+	// Stale reverse mappings point at a deleted or used up link, which
+	// should have given its destination up
+	Stale ProblemKind = "stale"
+	// Unmapped links can't be found from their destination
+	Unmapped ProblemKind = "unmapped"
+)
+
+// Problem is one inconsistency found by Check. Key is the short code or
+// destination it was found under.
+type Problem struct {
+	Kind   ProblemKind
+	Key    string
+	Detail string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s %s: %s", p.Kind, p.Key, p.Detail)
+}
+
+// CheckReport counts what Check looked at and lists what it found
+type CheckReport struct {
+	Links    int
+	Mappings int
+	Problems []Problem
+}
+
+// Check verifies that every link in the bolt file at path is reachable from
+// its destination, and that every reverse mapping leads back to a link with
+// that destination. The file is opened read-only, which fails after timeout
+// while another process has it open. A file still in the legacy single
+// bucket layout is checked as it is.
+func Check(ctx context.Context, path string, timeout time.Duration) (CheckReport, error) {
+	var report CheckReport
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: timeout})
+	if err != nil {
+		return report, fmt.Errorf("[boltdb] error opening %s: %w", path, err)
+	}
+	defer db.Close()
+	err = db.View(func(tx *bolt.Tx) error {
+		report, err = check(ctx, tx, time.Now())
+		return err
+	})
+	return report, err
+}
+
+func check(ctx context.Context, tx *bolt.Tx, now time.Time) (CheckReport, error) {
+	var report CheckReport
+	urls, codes := tx.Bucket(urlBucket), tx.Bucket(codeBucket)
+	// both directions share the legacy bucket, but never a key, since only
+	// destinations contain a scheme
+	isCode := func(k []byte) bool { return true }
+	isDestination := isCode
+	if urls == nil || codes == nil {
+		legacy := tx.Bucket(legacyBucket)
+		if legacy == nil {
+			return report, errors.New("[boltdb] not a smol database, no urls or legacy bucket")
+		}
+		urls, codes = legacy, legacy
+		isDestination = func(k []byte) bool { return strings.Contains(string(k), "://") }
+		isCode = func(k []byte) bool { return !isDestination(k) }
+	}
+	problem := func(kind ProblemKind, key, format string, args ...interface{}) {
+		report.Problems = append(report.Problems, Problem{Kind: kind, Key: key, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	err := urls.ForEach(func(k, v []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !isCode(k) {
+			return nil
+		}
+		report.Links++
+		u, err := record.Decode(string(k), v)
+		if err != nil {
+			problem(Undecodable, string(k), "%v", err)
+			return nil
+		}
+		// gone links may have given their destination up already
+		if u.Gone(now) {
+			return nil
+		}
+		mapped := codes.Get([]byte(u.Destination))
+		switch {
+		case mapped == nil:
+			problem(Unmapped, u.ShortCode, "no reverse mapping for %s", u.Destination)
+		case string(mapped) != u.ShortCode:
+			problem(Unmapped, u.ShortCode, "%s maps to %s instead", u.Destination, mapped)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	err = codes.ForEach(func(k, v []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !isDestination(k) {
+			return nil
+		}
+		report.Mappings++
+		value := urls.Get(v)
+		if value == nil {
+			problem(Orphaned, string(k), "maps to missing short code %s", v)
+			return nil
+		}
+		u, err := record.Decode(string(v), value)
+		if err != nil {
+			// already reported against the short code
+			return nil
+		}
+		switch {
+		case u.Destination != string(k):
+			problem(Mismatched, string(k), "maps to %s, which points at %s", v, u.Destination)
+		case releases(u):
+			problem(Stale, string(k), "maps to %s, which is deleted or used up", v)
+		}
+		return nil
+	})
+	return report, err
+}
+
+// releases reports whether u should no longer hold its reverse mapping.
+// Expired links keep theirs until they are swept.
+func releases(u models.URL) bool {
+	return u.Deleted() || u.Exhausted()
+}
@@ -0,0 +1,157 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package boltdb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// compactTxSize is roughly how many bytes Compact writes per transaction, so
+// that copying a large file doesn't hold it all in memory at once
+const compactTxSize = 64 << 20
+
+// CompactStats are the file sizes before and after Compact
+type CompactStats struct {
+	Before, After int64
+}
+
+// Compact rewrites the bolt file at src into a new file at dst, which must
+// not exist yet. Bolt never gives pages back to the filesystem, so after a
+// lot of deletes the copy can be much smaller. src is opened read-only,
+// which fails after timeout while another process has it open.
+func Compact(ctx context.Context, src, dst string, timeout time.Duration) (CompactStats, error) {
+	var stats CompactStats
+	if _, err := os.Stat(dst); err == nil {
+		return stats, fmt.Errorf("[boltdb] %s already exists", dst)
+	}
+	from, err := bolt.Open(src, 0600, &bolt.Options{ReadOnly: true, Timeout: timeout})
+	if err != nil {
+		return stats, fmt.Errorf("[boltdb] error opening %s: %w", src, err)
+	}
+	defer from.Close()
+	to, err := bolt.Open(dst, 0600, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return stats, fmt.Errorf("[boltdb] error creating %s: %w", dst, err)
+	}
+	if err = compact(ctx, from, to); err != nil {
+		to.Close()
+		os.Remove(dst)
+		return stats, err
+	}
+	if err = to.Close(); err != nil {
+		os.Remove(dst)
+		return stats, err
+	}
+
+	for path, size := range map[string]*int64{src: &stats.Before, dst: &stats.After} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return stats, err
+		}
+		*size = info.Size()
+	}
+	return stats, nil
+}
+
+// compactor copies buckets into dst, committing every compactTxSize bytes
+type compactor struct {
+	ctx  context.Context
+	dst  *bolt.DB
+	tx   *bolt.Tx
+	size int64
+}
+
+func compact(ctx context.Context, src, dst *bolt.DB) error {
+	c := &compactor{ctx: ctx, dst: dst}
+	var err error
+	if c.tx, err = dst.Begin(true); err != nil {
+		return err
+	}
+	defer func() { _ = c.tx.Rollback() }()
+	err = src.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return c.copyBucket(b, [][]byte{name})
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return c.tx.Commit()
+}
+
+// copyBucket recreates src, and any buckets nested in it, at path in dst
+func (c *compactor) copyBucket(src *bolt.Bucket, path [][]byte) error {
+	var dst *bolt.Bucket
+	var err error
+	if len(path) == 1 {
+		dst, err = c.tx.CreateBucket(path[0])
+	} else {
+		dst, err = c.bucket(path[:len(path)-1]).CreateBucket(path[len(path)-1])
+	}
+	if err != nil {
+		return err
+	}
+	if err = dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			nested := append(append([][]byte{}, path...), k)
+			return c.copyBucket(src.Bucket(k), nested)
+		}
+		if err := c.reserve(int64(len(k) + len(v))); err != nil {
+			return err
+		}
+		dst := c.bucket(path)
+		// keys arrive in order, so pages can be filled completely
+		dst.FillPercent = 1
+		return dst.Put(k, v)
+	})
+}
+
+// reserve commits the current transaction and starts another once it has
+// grown past compactTxSize
+func (c *compactor) reserve(n int64) error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	if c.size+n <= compactTxSize {
+		c.size += n
+		return nil
+	}
+	if err := c.tx.Commit(); err != nil {
+		return err
+	}
+	tx, err := c.dst.Begin(true)
+	if err != nil {
+		return err
+	}
+	c.tx, c.size = tx, n
+	return nil
+}
+
+// bucket finds the bucket at path in the current transaction
+func (c *compactor) bucket(path [][]byte) *bolt.Bucket {
+	b := c.tx.Bucket(path[0])
+	for _, name := range path[1:] {
+		b = b.Bucket(name)
+	}
+	return b
+}
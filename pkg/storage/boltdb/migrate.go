@@ -0,0 +1,48 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package boltdb
+
+import (
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// legacyBucket held both directions of every mapping as flat keys before they
+// were split into urlBucket and codeBucket
+var legacyBucket = []byte("smol")
+
+// migrateLegacyBucket moves every mapping out of legacyBucket, if it still
+// exists, and removes it. It runs inside the transaction that opens the store
+// so a crash part way through leaves the old layout untouched.
+func migrateLegacyBucket(tx *bolt.Tx) error {
+	legacy := tx.Bucket(legacyBucket)
+	if legacy == nil {
+		return nil
+	}
+	urls, codes := tx.Bucket(urlBucket), tx.Bucket(codeBucket)
+	err := legacy.ForEach(func(k, v []byte) error {
+		// destinations always carry a scheme while short codes are
+		// alphanumeric, which tells the two directions apart
+		if strings.Contains(string(k), "://") {
+			return codes.Put(k, v)
+		}
+		return urls.Put(k, v)
+	})
+	if err != nil {
+		return err
+	}
+	return tx.DeleteBucket(legacyBucket)
+}
@@ -0,0 +1,203 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+// Package cache provides a read-through LRU cache that can sit in front of
+// any storage backend.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/data/models"
+)
+
+// Store caches GetURL lookups from the wrapped store in a bounded LRU. Missing
+// short codes are cached too, for NegativeTTL, so that scans for random codes
+// don't reach the backend every time. Writes made through the Store invalidate
+// the affected code; writes made by other processes are picked up once the
+// entry expires. Hit counts are left to lag in the same way, as RecordHit
+// only invalidates once a link runs out of clicks. The limit itself is
+// enforced by the wrapped store.
+type Store struct {
+	data.StorageReadWrite
+
+	Size        int
+	TTL         time.Duration
+	NegativeTTL time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	now     func() time.Time
+	// gen is bumped by every invalidation so that a lookup which raced with a
+	// write doesn't put the value it read before the write back in the cache
+	gen uint64
+}
+
+type entry struct {
+	shortCode string
+	url       models.URL
+	notFound  bool
+	expires   time.Time
+}
+
+// New wraps store with a cache holding up to size short codes
+func New(store data.StorageReadWrite, size int, ttl, negativeTTL time.Duration) *Store {
+	return &Store{
+		StorageReadWrite: store,
+		Size:             size,
+		TTL:              ttl,
+		NegativeTTL:      negativeTTL,
+		lru:              list.New(),
+		entries:          make(map[string]*list.Element),
+		now:              time.Now,
+	}
+}
+
+func (s *Store) GetURL(ctx context.Context, shortCode string) (models.URL, error) {
+	e, gen, ok := s.get(shortCode)
+	if ok {
+		if e.notFound {
+			return models.URL{}, fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+		}
+		if e.url.Gone(s.now()) {
+			return e.url, fmt.Errorf("%w: %s", data.ErrGone, shortCode)
+		}
+		return e.url, nil
+	}
+	url, err := s.StorageReadWrite.GetURL(ctx, shortCode)
+	switch {
+	case err == nil:
+		s.add(entry{shortCode: shortCode, url: url}, s.TTL, gen)
+	case errors.Is(err, data.ErrNotFound):
+		s.add(entry{shortCode: shortCode, notFound: true}, s.NegativeTTL, gen)
+	}
+	return url, err
+}
+
+func (s *Store) SetURL(ctx context.Context, url models.URL) error {
+	defer s.invalidate(url.ShortCode)
+	return s.StorageReadWrite.SetURL(ctx, url)
+}
+
+func (s *Store) CreateURL(ctx context.Context, url models.URL) error {
+	defer s.invalidate(url.ShortCode)
+	return s.StorageReadWrite.CreateURL(ctx, url)
+}
+
+func (s *Store) RecordHit(ctx context.Context, shortCode string) error {
+	err := s.StorageReadWrite.RecordHit(ctx, shortCode)
+	if errors.Is(err, data.ErrGone) {
+		s.invalidate(shortCode)
+	}
+	return err
+}
+
+func (s *Store) Delete(ctx context.Context, shortCode string) error {
+	defer s.invalidate(shortCode)
+	return s.StorageReadWrite.Delete(ctx, shortCode)
+}
+
+func (s *Store) SoftDelete(ctx context.Context, shortCode string) error {
+	defer s.invalidate(shortCode)
+	return s.StorageReadWrite.SoftDelete(ctx, shortCode)
+}
+
+func (s *Store) UpdateDestination(ctx context.Context, shortCode, destination string) (models.URL, error) {
+	defer s.invalidate(shortCode)
+	return s.StorageReadWrite.UpdateDestination(ctx, shortCode, destination)
+}
+
+func (s *Store) Restore(ctx context.Context, shortCode string) error {
+	defer s.invalidate(shortCode)
+	return s.StorageReadWrite.Restore(ctx, shortCode)
+}
+
+// Unwrap returns the store the cache sits in front of
+func (s *Store) Unwrap() data.StorageReadWrite {
+	return s.StorageReadWrite
+}
+
+// Len is the number of cached short codes, including expired ones that
+// haven't been evicted yet
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// get returns the live entry for shortCode, if any, along with the current
+// generation to hand to add on a miss
+func (s *Store) get(shortCode string) (entry, uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[shortCode]
+	if !ok {
+		return entry{}, s.gen, false
+	}
+	e := el.Value.(*entry)
+	if !s.now().Before(e.expires) {
+		s.remove(el)
+		return entry{}, s.gen, false
+	}
+	s.lru.MoveToFront(el)
+	return *e, s.gen, true
+}
+
+func (s *Store) add(e entry, ttl time.Duration, gen uint64) {
+	if s.Size <= 0 || ttl <= 0 {
+		return
+	}
+	e.expires = s.now().Add(ttl)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if gen != s.gen {
+		return
+	}
+	if el, ok := s.entries[e.shortCode]; ok {
+		el.Value = &e
+		s.lru.MoveToFront(el)
+		return
+	}
+	s.entries[e.shortCode] = s.lru.PushFront(&e)
+	for s.lru.Len() > s.Size {
+		s.remove(s.lru.Back())
+	}
+}
+
+// Invalidate drops shortCode from the cache, for writes made by other
+// processes that are announced some other way
+func (s *Store) Invalidate(shortCode string) {
+	s.invalidate(shortCode)
+}
+
+func (s *Store) invalidate(shortCode string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gen++
+	if el, ok := s.entries[shortCode]; ok {
+		s.remove(el)
+	}
+}
+
+func (s *Store) remove(el *list.Element) {
+	s.lru.Remove(el)
+	delete(s.entries, el.Value.(*entry).shortCode)
+}
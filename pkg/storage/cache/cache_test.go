@@ -0,0 +1,140 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/data/models"
+	"github.com/lucasreed/smol/pkg/storage/memory"
+	"github.com/lucasreed/smol/pkg/storage/storagetest"
+)
+
+// countingStore counts the lookups that make it past the cache
+type countingStore struct {
+	*memory.Store
+	gets int
+}
+
+func (c *countingStore) GetURL(ctx context.Context, shortCode string) (models.URL, error) {
+	c.gets++
+	return c.Store.GetURL(ctx, shortCode)
+}
+
+func newCountingStore(t *testing.T) *countingStore {
+	store := memory.NewStore("", 0)
+	if err := store.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return &countingStore{Store: store}
+}
+
+func TestStoreConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) data.StorageReadWrite {
+		return New(newCountingStore(t), 100, time.Minute, time.Minute)
+	})
+}
+
+func TestStore_CachesLookups(t *testing.T) {
+	ctx := context.Background()
+	backend := newCountingStore(t)
+	store := New(backend, 100, time.Minute, time.Minute)
+	if err := store.SetURL(ctx, models.URL{ShortCode: "abcd123", Destination: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		u, err := store.GetURL(ctx, "abcd123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Destination != "https://example.com" {
+			t.Errorf("GetURL returned %s, want https://example.com", u.Destination)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := store.GetURL(ctx, "missing"); !errors.Is(err, data.ErrNotFound) {
+			t.Errorf("GetURL on missing code returned %v, want data.ErrNotFound", err)
+		}
+	}
+	if backend.gets != 2 {
+		t.Errorf("backend saw %d lookups, want 2", backend.gets)
+	}
+}
+
+func TestStore_WritesInvalidate(t *testing.T) {
+	ctx := context.Background()
+	store := New(newCountingStore(t), 100, time.Minute, time.Minute)
+
+	if _, err := store.GetURL(ctx, "abcd123"); !errors.Is(err, data.ErrNotFound) {
+		t.Fatalf("GetURL on missing code returned %v, want data.ErrNotFound", err)
+	}
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "abcd123", Destination: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := store.GetURL(ctx, "abcd123"); err != nil || u.Destination != "https://example.com" {
+		t.Errorf("GetURL after CreateURL returned %+v, %v, want https://example.com", u, err)
+	}
+	if err := store.SetURL(ctx, models.URL{ShortCode: "abcd123", Destination: "https://example.org"}); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := store.GetURL(ctx, "abcd123"); err != nil || u.Destination != "https://example.org" {
+		t.Errorf("GetURL after SetURL returned %+v, %v, want https://example.org", u, err)
+	}
+	if err := store.Delete(ctx, "abcd123"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetURL(ctx, "abcd123"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("GetURL after Delete returned %v, want data.ErrNotFound", err)
+	}
+}
+
+func TestStore_EvictionAndExpiry(t *testing.T) {
+	ctx := context.Background()
+	backend := newCountingStore(t)
+	store := New(backend, 2, time.Minute, time.Minute)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	for _, code := range []string{"a", "b", "c"} {
+		if _, err := store.GetURL(ctx, code); !errors.Is(err, data.ErrNotFound) {
+			t.Fatal(err)
+		}
+	}
+	if store.Len() != 2 {
+		t.Errorf("cache holds %d codes, want it bounded at 2", store.Len())
+	}
+
+	backend.gets = 0
+	if _, err := store.GetURL(ctx, "a"); !errors.Is(err, data.ErrNotFound) {
+		t.Fatal(err)
+	}
+	if backend.gets != 1 {
+		t.Errorf("least recently used code was not evicted")
+	}
+
+	now = now.Add(2 * time.Minute)
+	backend.gets = 0
+	if _, err := store.GetURL(ctx, "c"); !errors.Is(err, data.ErrNotFound) {
+		t.Fatal(err)
+	}
+	if backend.gets != 1 {
+		t.Errorf("expired entry was served from the cache")
+	}
+}
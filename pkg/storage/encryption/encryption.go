@@ -0,0 +1,355 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+// Package encryption seals link destinations with AES-GCM before they reach
+// a storage backend.
+package encryption
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/data/models"
+)
+
+// KeySize is the length of a key in bytes, used for AES-256
+const KeySize = 32
+
+// prefix marks a sealed destination, followed by the key ID and the base64
+// nonce and ciphertext. Destinations are validated URLs, so a value without
+// it was written before encryption was turned on.
+const prefix = "enc:"
+
+// rotatePageSize is how many links Rotate lists at a time
+const rotatePageSize = 500
+
+// ErrUnknownKey is returned, possibly wrapped, for a destination sealed with
+// a key the Store wasn't given
+var ErrUnknownKey = errors.New("destination sealed with an unknown key")
+
+// Key seals and opens destinations. The AES key, the key used for lookup
+// hashes and the ID are all derived from one secret.
+type Key struct {
+	id   string
+	aead cipher.AEAD
+	mac  []byte
+}
+
+// NewKey derives a Key from secret, which must be KeySize bytes
+func NewKey(secret []byte) (*Key, error) {
+	if len(secret) != KeySize {
+		return nil, fmt.Errorf("[encryption] key is %d bytes, want %d", len(secret), KeySize)
+	}
+	block, err := aes.NewCipher(derive(secret, "smol destination encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{
+		id:   hex.EncodeToString(derive(secret, "smol key id")[:4]),
+		aead: aead,
+		mac:  derive(secret, "smol destination lookup"),
+	}, nil
+}
+
+// ParseKey decodes a base64 secret, as returned by GenerateKey
+func ParseKey(encoded string) (*Key, error) {
+	secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("[encryption] key isn't base64: %w", err)
+	}
+	return NewKey(secret)
+}
+
+// GenerateKey returns a new random secret encoded in base64
+func GenerateKey() (string, error) {
+	secret := make([]byte, KeySize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(secret), nil
+}
+
+// ID identifies the key in the destinations it sealed without revealing it
+func (k *Key) ID() string {
+	return k.id
+}
+
+// seal encrypts destination under a nonce that is a keyed hash of it. The
+// same destination always seals to the same value, so backends can keep
+// mapping it back to its short code, and equal destinations are all the
+// ciphertext gives away.
+func (k *Key) seal(destination string) string {
+	h := hmac.New(sha256.New, k.mac)
+	h.Write([]byte(destination))
+	nonce := h.Sum(nil)[:k.aead.NonceSize()]
+	sealed := k.aead.Seal(nonce, nonce, []byte(destination), []byte(k.id))
+	return prefix + k.id + ":" + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// open decrypts the nonce and ciphertext of a destination sealed by k
+func (k *Key) open(encoded string) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	size := k.aead.NonceSize()
+	if len(sealed) < size {
+		return "", errors.New("sealed destination is too short")
+	}
+	plain, err := k.aead.Open(nil, sealed[:size], sealed[size:], []byte(k.id))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func derive(secret []byte, label string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(label))
+	return h.Sum(nil)
+}
+
+// Store seals the destinations, including past ones in Revisions, of the
+// links written to the wrapped store and opens them again on the way out.
+// Everything else about a link is stored as it is. Destinations that were
+// stored before encryption was turned on are read as they are, until Rotate
+// seals them.
+type Store struct {
+	data.StorageReadWrite
+
+	// Key seals every destination written
+	Key *Key
+	// OldKeys can still open destinations sealed before a rotation
+	OldKeys []*Key
+}
+
+// New wraps store so that destinations are sealed with key. Destinations
+// sealed with any of oldKeys can still be read.
+func New(store data.StorageReadWrite, key *Key, oldKeys ...*Key) *Store {
+	return &Store{
+		StorageReadWrite: store,
+		Key:              key,
+		OldKeys:          oldKeys,
+	}
+}
+
+func (s *Store) GetURL(ctx context.Context, shortCode string) (models.URL, error) {
+	u, err := s.StorageReadWrite.GetURL(ctx, shortCode)
+	if err != nil && !errors.Is(err, data.ErrGone) {
+		return u, err
+	}
+	opened, openErr := s.openURL(u)
+	if openErr != nil {
+		return models.URL{}, openErr
+	}
+	return opened, err
+}
+
+// GetShortCode looks the destination up as sealed by each key in turn, then
+// as plaintext for links stored before encryption was turned on
+func (s *Store) GetShortCode(ctx context.Context, destination string) (string, error) {
+	for _, k := range s.keys() {
+		code, err := s.StorageReadWrite.GetShortCode(ctx, k.seal(destination))
+		if !errors.Is(err, data.ErrNotFound) {
+			return code, err
+		}
+	}
+	return s.StorageReadWrite.GetShortCode(ctx, destination)
+}
+
+func (s *Store) List(ctx context.Context, cursor string, limit int) ([]models.URL, string, error) {
+	urls, next, err := s.StorageReadWrite.List(ctx, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range urls {
+		if urls[i], err = s.openURL(urls[i]); err != nil {
+			return nil, "", err
+		}
+	}
+	return urls, next, nil
+}
+
+func (s *Store) SetURL(ctx context.Context, url models.URL) error {
+	return s.StorageReadWrite.SetURL(ctx, s.sealURL(url))
+}
+
+func (s *Store) CreateURL(ctx context.Context, url models.URL) error {
+	return s.StorageReadWrite.CreateURL(ctx, s.sealURL(url))
+}
+
+// UpdateDestination only finds the new destination in use if it was sealed
+// with Key, as the backend compares sealed values
+func (s *Store) UpdateDestination(ctx context.Context, shortCode, destination string) (models.URL, error) {
+	u, err := s.StorageReadWrite.UpdateDestination(ctx, shortCode, s.Key.seal(destination))
+	if err != nil {
+		return u, err
+	}
+	return s.openURL(u)
+}
+
+// Unwrap returns the store holding the sealed destinations
+func (s *Store) Unwrap() data.StorageReadWrite {
+	return s.StorageReadWrite
+}
+
+// RotateStats counts the links Rotate went through
+type RotateStats struct {
+	// Rewritten links had a destination sealed with an old key, or not
+	// sealed at all
+	Rewritten int
+	// Current links were already sealed with Key
+	Current int
+}
+
+// Rotate rewrites every link with a destination that isn't sealed with Key,
+// so that the old keys can be dropped once it returns. Links that are gone
+// are rewritten before live ones: backends map a rewritten destination back
+// to whichever link was written last, and that has to be the live link when
+// a gone one shares its destination. Links are rewritten with RewriteURL
+// when the store implements data.Rewriter, so the clicks counted on a link
+// between reading and rewriting it are kept; with SetURL they are lost.
+func (s *Store) Rotate(ctx context.Context) (RotateStats, error) {
+	var stats RotateStats
+	now := time.Now()
+	for _, gone := range []bool{true, false} {
+		cursor := ""
+		for {
+			page, next, err := s.StorageReadWrite.List(ctx, cursor, rotatePageSize)
+			if err != nil {
+				return stats, err
+			}
+			for _, raw := range page {
+				if raw.Gone(now) != gone {
+					continue
+				}
+				if s.current(raw) {
+					stats.Current++
+					continue
+				}
+				u, err := s.openURL(raw)
+				if err != nil {
+					return stats, err
+				}
+				if err = s.rewrite(ctx, s.sealURL(u)); err != nil {
+					return stats, fmt.Errorf("[encryption] error rewriting %s: %w", raw.ShortCode, err)
+				}
+				stats.Rewritten++
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+	}
+	return stats, nil
+}
+
+// rewrite stores a resealed link, keeping its hit count if the store can
+func (s *Store) rewrite(ctx context.Context, u models.URL) error {
+	if r, ok := s.StorageReadWrite.(data.Rewriter); ok {
+		return r.RewriteURL(ctx, u)
+	}
+	return s.StorageReadWrite.SetURL(ctx, u)
+}
+
+// current reports whether every destination of a stored link is sealed with
+// Key
+func (s *Store) current(u models.URL) bool {
+	mine := prefix + s.Key.id + ":"
+	if !strings.HasPrefix(u.Destination, mine) {
+		return false
+	}
+	for _, r := range u.Revisions {
+		if !strings.HasPrefix(r.Destination, mine) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Store) keys() []*Key {
+	return append([]*Key{s.Key}, s.OldKeys...)
+}
+
+// sealURL returns a copy of u with its destinations sealed
+func (s *Store) sealURL(u models.URL) models.URL {
+	u.Destination = s.Key.seal(u.Destination)
+	if u.Revisions != nil {
+		revisions := make([]models.Revision, len(u.Revisions))
+		for i, r := range u.Revisions {
+			r.Destination = s.Key.seal(r.Destination)
+			revisions[i] = r
+		}
+		u.Revisions = revisions
+	}
+	return u
+}
+
+// openURL returns a copy of u with its destinations opened
+func (s *Store) openURL(u models.URL) (models.URL, error) {
+	var err error
+	if u.Destination, err = s.open(u.ShortCode, u.Destination); err != nil {
+		return models.URL{}, err
+	}
+	if u.Revisions != nil {
+		revisions := make([]models.Revision, len(u.Revisions))
+		for i, r := range u.Revisions {
+			if r.Destination, err = s.open(u.ShortCode, r.Destination); err != nil {
+				return models.URL{}, err
+			}
+			revisions[i] = r
+		}
+		u.Revisions = revisions
+	}
+	return u, nil
+}
+
+// open decrypts a stored destination of shortCode, passing plaintext ones
+// through
+func (s *Store) open(shortCode, value string) (string, error) {
+	if !strings.HasPrefix(value, prefix) {
+		return value, nil
+	}
+	id, encoded := value[len(prefix):], ""
+	if i := strings.IndexByte(id, ':'); i >= 0 {
+		id, encoded = id[:i], id[i+1:]
+	}
+	for _, k := range s.keys() {
+		if k.id != id {
+			continue
+		}
+		plain, err := k.open(encoded)
+		if err != nil {
+			return "", fmt.Errorf("[encryption] error opening destination of %s: %w", shortCode, err)
+		}
+		return plain, nil
+	}
+	return "", fmt.Errorf("%w: %s of %s", ErrUnknownKey, id, shortCode)
+}
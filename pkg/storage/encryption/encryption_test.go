@@ -0,0 +1,194 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package encryption
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/data/models"
+	"github.com/lucasreed/smol/pkg/storage/memory"
+	"github.com/lucasreed/smol/pkg/storage/storagetest"
+)
+
+func newKey(t *testing.T) *Key {
+	t.Helper()
+	encoded, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParseKey(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newBackend(t *testing.T) *memory.Store {
+	t.Helper()
+	store := memory.NewStore("", 0)
+	if err := store.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestStoreConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) data.StorageReadWrite {
+		return New(newBackend(t), newKey(t))
+	})
+}
+
+func TestParseKey(t *testing.T) {
+	for _, encoded := range []string{"", "not base64!", "c2hvcnQ="} {
+		if _, err := ParseKey(encoded); err == nil {
+			t.Errorf("ParseKey(%q) succeeded", encoded)
+		}
+	}
+}
+
+func TestStore_SealsDestinations(t *testing.T) {
+	ctx := context.Background()
+	backend := newBackend(t)
+	key := newKey(t)
+	store := New(backend, key)
+	secret := "https://docs.example.com/report.pdf?signature=s3cr3t"
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "abcd123", Destination: secret}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.UpdateDestination(ctx, "abcd123", secret+"2"); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := backend.GetURL(ctx, "abcd123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(raw.Destination, "s3cr3t") || strings.Contains(raw.Revisions[0].Destination, "s3cr3t") {
+		t.Errorf("backend stored plaintext: %+v", raw)
+	}
+	if !strings.HasPrefix(raw.Destination, prefix+key.ID()+":") {
+		t.Errorf("backend stored %q, want it sealed with %s", raw.Destination, key.ID())
+	}
+
+	u, err := store.GetURL(ctx, "abcd123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Destination != secret+"2" || len(u.Revisions) != 1 || u.Revisions[0].Destination != secret {
+		t.Errorf("got %+v", u)
+	}
+	if code, err := store.GetShortCode(ctx, secret+"2"); err != nil || code != "abcd123" {
+		t.Errorf("GetShortCode returned %q, %v", code, err)
+	}
+
+	if _, err = New(backend, newKey(t)).GetURL(ctx, "abcd123"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("GetURL with another key returned %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestStore_Rotate(t *testing.T) {
+	ctx := context.Background()
+	backend := newBackend(t)
+	oldKey, currentKey := newKey(t), newKey(t)
+
+	// a link stored before encryption was turned on, one sealed with the old
+	// key and a gone one sharing the destination of a live one
+	if err := backend.SetURL(ctx, models.URL{ShortCode: "plain12", Destination: "https://example.com/plain"}); err != nil {
+		t.Fatal(err)
+	}
+	old := New(backend, oldKey)
+	if err := old.SetURL(ctx, models.URL{ShortCode: "sealed1", Destination: "https://example.com/sealed"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.SetURL(ctx, models.URL{ShortCode: "gone123", Destination: "https://example.com/shared"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.SoftDelete(ctx, "gone123"); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.SetURL(ctx, models.URL{ShortCode: "live123", Destination: "https://example.com/shared"}); err != nil {
+		t.Fatal(err)
+	}
+
+	store := New(backend, currentKey, oldKey)
+	stats, err := store.Rotate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Rewritten != 4 || stats.Current != 0 {
+		t.Errorf("first rotation got %+v", stats)
+	}
+	if stats, err = store.Rotate(ctx); err != nil || stats.Rewritten != 0 || stats.Current != 4 {
+		t.Errorf("second rotation got %+v, %v", stats, err)
+	}
+
+	rotated := New(backend, currentKey)
+	for code, destination := range map[string]string{
+		"plain12": "https://example.com/plain",
+		"sealed1": "https://example.com/sealed",
+		"live123": "https://example.com/shared",
+	} {
+		u, err := rotated.GetURL(ctx, code)
+		if err != nil || u.Destination != destination {
+			t.Errorf("GetURL(%s) returned %q, %v", code, u.Destination, err)
+		}
+		if got, err := rotated.GetShortCode(ctx, destination); err != nil || got != code {
+			t.Errorf("GetShortCode(%s) returned %q, %v", destination, got, err)
+		}
+	}
+	if _, err := rotated.GetURL(ctx, "gone123"); !errors.Is(err, data.ErrGone) {
+		t.Errorf("GetURL of the deleted link returned %v, want ErrGone", err)
+	}
+}
+
+// clickingStore counts a click on every link it lists, as redirects served
+// while Rotate works through a page would
+type clickingStore struct {
+	*memory.Store
+}
+
+func (s clickingStore) List(ctx context.Context, cursor string, limit int) ([]models.URL, string, error) {
+	urls, next, err := s.Store.List(ctx, cursor, limit)
+	for _, u := range urls {
+		if hitErr := s.Store.RecordHit(ctx, u.ShortCode); hitErr != nil && !errors.Is(hitErr, data.ErrGone) {
+			return nil, "", hitErr
+		}
+	}
+	return urls, next, err
+}
+
+func TestStore_RotateKeepsHits(t *testing.T) {
+	ctx := context.Background()
+	backend := newBackend(t)
+	if err := backend.SetURL(ctx, models.URL{ShortCode: "plain12", Destination: "https://example.com/plain", Hits: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the link is listed once per pass, live links being rewritten on the second
+	if _, err := New(clickingStore{backend}, newKey(t)).Rotate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	u, err := backend.GetURL(ctx, "plain12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Hits != 7 {
+		t.Errorf("GetURL returned %d hits after Rotate, want the 5 stored and 2 counted while rotating", u.Hits)
+	}
+}
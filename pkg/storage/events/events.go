@@ -0,0 +1,277 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+// Package events wraps a storage backend to announce link changes to
+// in-process subscribers and, through a Transport, to other smolserv
+// instances.
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/data/models"
+)
+
+// DefaultChannel is the pub/sub channel events are published on
+const DefaultChannel = "smol:events"
+
+// listenRetry is how long Listen waits before resubscribing after an error
+const listenRetry = time.Second
+
+// lookupTimeout bounds reading back the link of a received event
+const lookupTimeout = 5 * time.Second
+
+// Kind says what happened to a link
+type Kind string
+
+const (
+	// Created links are new short codes
+	Created Kind = "created"
+	// Updated links changed destination or metadata, or were restored
+	Updated Kind = "updated"
+	// Deleted links were soft or hard deleted
+	Deleted Kind = "deleted"
+)
+
+// Event describes one change to a link
+type Event struct {
+	Kind      Kind
+	ShortCode string
+	// URL is the link after the change, or as it was before a hard delete.
+	// Events from other instances carry only the short code of a link that
+	// has been hard deleted.
+	URL models.URL `json:"-"`
+	At  time.Time
+	// Source identifies the instance that made the change
+	Source string
+}
+
+// Transport carries encoded events between instances
+type Transport interface {
+	Publish(ctx context.Context, channel string, payload []byte) error
+	Subscribe(ctx context.Context, channel string, fn func(payload []byte)) error
+}
+
+// Store announces every successful write to the wrapped store. Hits aren't
+// announced, and neither are links removed by sweeping, which happens below
+// the wrapper.
+type Store struct {
+	data.StorageReadWrite
+
+	// Transport, when set, publishes every event on Channel, and Listen
+	// receives the events of other instances from it
+	Transport Transport
+	Channel   string
+	// Source tags the events made through this Store
+	Source string
+	// Lookup reads back the links of events received from other instances,
+	// as only the kind and short code are published so that destinations
+	// don't leave the store. It defaults to the wrapped store, and should
+	// bypass any cache in front of it.
+	Lookup data.StorageReader
+
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+	now  func() time.Time
+}
+
+// New wraps store with a random Source and no Transport
+func New(store data.StorageReadWrite) *Store {
+	return &Store{
+		StorageReadWrite: store,
+		Channel:          DefaultChannel,
+		Source:           newSource(),
+		subs:             make(map[chan Event]struct{}),
+		now:              time.Now,
+	}
+}
+
+// Subscribe returns a channel receiving every event, made locally or
+// received by Listen, until cancel is called. Writes never wait for a slow
+// subscriber: once buffer events are queued, further ones are dropped.
+func (s *Store) Subscribe(buffer int) (events <-chan Event, cancel func()) {
+	ch := make(chan Event, buffer)
+	s.mu.Lock()
+	s.subs[ch] = struct{}{}
+	s.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			delete(s.subs, ch)
+			s.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Listen hands the events other instances publish to local subscribers
+// until ctx is done, resubscribing after errors
+func (s *Store) Listen(ctx context.Context) {
+	if s.Transport == nil {
+		return
+	}
+	for {
+		err := s.Transport.Subscribe(ctx, s.Channel, s.receive)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("error listening for link events, retrying - %v\n", err)
+		select {
+		case <-time.After(listenRetry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Store) SetURL(ctx context.Context, url models.URL) error {
+	kind := Updated
+	if _, err := s.StorageReadWrite.GetURL(ctx, url.ShortCode); errors.Is(err, data.ErrNotFound) {
+		kind = Created
+	}
+	if err := s.StorageReadWrite.SetURL(ctx, url); err != nil {
+		return err
+	}
+	s.emit(ctx, kind, s.current(ctx, url))
+	return nil
+}
+
+func (s *Store) CreateURL(ctx context.Context, url models.URL) error {
+	if err := s.StorageReadWrite.CreateURL(ctx, url); err != nil {
+		return err
+	}
+	s.emit(ctx, Created, s.current(ctx, url))
+	return nil
+}
+
+func (s *Store) Delete(ctx context.Context, shortCode string) error {
+	u := s.current(ctx, models.URL{ShortCode: shortCode})
+	if err := s.StorageReadWrite.Delete(ctx, shortCode); err != nil {
+		return err
+	}
+	s.emit(ctx, Deleted, u)
+	return nil
+}
+
+func (s *Store) SoftDelete(ctx context.Context, shortCode string) error {
+	if err := s.StorageReadWrite.SoftDelete(ctx, shortCode); err != nil {
+		return err
+	}
+	s.emit(ctx, Deleted, s.current(ctx, models.URL{ShortCode: shortCode}))
+	return nil
+}
+
+func (s *Store) UpdateDestination(ctx context.Context, shortCode, destination string) (models.URL, error) {
+	u, err := s.StorageReadWrite.UpdateDestination(ctx, shortCode, destination)
+	if err != nil {
+		return u, err
+	}
+	s.emit(ctx, Updated, u)
+	return u, nil
+}
+
+func (s *Store) Restore(ctx context.Context, shortCode string) error {
+	if err := s.StorageReadWrite.Restore(ctx, shortCode); err != nil {
+		return err
+	}
+	s.emit(ctx, Updated, s.current(ctx, models.URL{ShortCode: shortCode}))
+	return nil
+}
+
+// Unwrap returns the store whose writes are announced
+func (s *Store) Unwrap() data.StorageReadWrite {
+	return s.StorageReadWrite
+}
+
+// current reads the stored record of url, which carries the timestamps the
+// backend filled in, falling back to url itself if it can't be read
+func (s *Store) current(ctx context.Context, url models.URL) models.URL {
+	u, err := s.StorageReadWrite.GetURL(ctx, url.ShortCode)
+	if err != nil && !errors.Is(err, data.ErrGone) {
+		return url
+	}
+	return u
+}
+
+func (s *Store) emit(ctx context.Context, kind Kind, u models.URL) {
+	e := Event{Kind: kind, ShortCode: u.ShortCode, URL: u, At: s.now(), Source: s.Source}
+	s.deliver(e)
+	if s.Transport == nil {
+		return
+	}
+	payload, err := json.Marshal(e)
+	if err == nil {
+		err = s.Transport.Publish(ctx, s.Channel, payload)
+	}
+	if err != nil {
+		// the write itself went through, so only the announcement is lost
+		log.Printf("error publishing %s event for %s - %v\n", kind, u.ShortCode, err)
+	}
+}
+
+// receive delivers an event published by another instance. Our own come
+// back too, and were delivered when they were made.
+func (s *Store) receive(payload []byte) {
+	var e Event
+	if err := json.Unmarshal(payload, &e); err != nil {
+		log.Printf("error decoding link event - %v\n", err)
+		return
+	}
+	if e.Source == s.Source {
+		return
+	}
+	lookup := s.Lookup
+	if lookup == nil {
+		lookup = s.StorageReadWrite
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	e.URL = models.URL{ShortCode: e.ShortCode}
+	u, err := lookup.GetURL(ctx, e.ShortCode)
+	switch {
+	case err == nil || errors.Is(err, data.ErrGone):
+		e.URL = u
+	case !errors.Is(err, data.ErrNotFound):
+		log.Printf("error reading back link for %s event on %s - %v\n", e.Kind, e.ShortCode, err)
+	}
+	s.deliver(e)
+}
+
+func (s *Store) deliver(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func newSource() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format(time.RFC3339Nano)
+	}
+	return hex.EncodeToString(b)
+}
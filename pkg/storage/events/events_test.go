@@ -0,0 +1,194 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package events
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lucasreed/smol/pkg/data/models"
+	"github.com/lucasreed/smol/pkg/storage/memory"
+)
+
+func newStore(t *testing.T) *Store {
+	store := memory.NewStore("", 0)
+	if err := store.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return New(store)
+}
+
+func next(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("no event arrived")
+		return Event{}
+	}
+}
+
+func TestStore_Events(t *testing.T) {
+	ctx := context.Background()
+	s := newStore(t)
+	events, cancel := s.Subscribe(10)
+	defer cancel()
+
+	u := models.URL{ShortCode: "abcd123", Destination: "https://example.com"}
+	if err := s.SetURL(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	u.Title = "example"
+	if err := s.SetURL(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UpdateDestination(ctx, "abcd123", "https://example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SoftDelete(ctx, "abcd123"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Restore(ctx, "abcd123"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "abcd123"); err != nil {
+		t.Fatal(err)
+	}
+	// failed writes aren't announced
+	if err := s.Delete(ctx, "abcd123"); err == nil {
+		t.Fatal("second Delete succeeded")
+	}
+	if err := s.CreateURL(ctx, models.URL{ShortCode: "efgh456", Destination: "https://example.net"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []struct {
+		kind        Kind
+		code, title string
+		destination string
+	}{
+		{Created, "abcd123", "", "https://example.com"},
+		{Updated, "abcd123", "example", "https://example.com"},
+		{Updated, "abcd123", "example", "https://example.org"},
+		{Deleted, "abcd123", "example", "https://example.org"},
+		{Updated, "abcd123", "example", "https://example.org"},
+		{Deleted, "abcd123", "example", "https://example.org"},
+		{Created, "efgh456", "", "https://example.net"},
+	} {
+		e := next(t, events)
+		if e.Kind != want.kind || e.ShortCode != want.code || e.URL.Title != want.title || e.URL.Destination != want.destination || e.Source != s.Source {
+			t.Errorf("event %d is %+v, want %s of %s to %s", i, e, want.kind, want.code, want.destination)
+		}
+		if e.URL.CreatedAt.IsZero() {
+			t.Errorf("event %d carries no CreatedAt", i)
+		}
+	}
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %+v", e)
+	default:
+	}
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Error("events still open after cancel")
+	}
+}
+
+// loopback is a Transport connecting every Store that uses it
+type loopback struct {
+	mu       sync.Mutex
+	subs     []func([]byte)
+	payloads []string
+}
+
+func (l *loopback) Publish(ctx context.Context, channel string, payload []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.payloads = append(l.payloads, string(payload))
+	for _, fn := range l.subs {
+		fn(payload)
+	}
+	return nil
+}
+
+func (l *loopback) Subscribe(ctx context.Context, channel string, fn func([]byte)) error {
+	l.mu.Lock()
+	l.subs = append(l.subs, fn)
+	l.mu.Unlock()
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestStore_Listen(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	transport := &loopback{}
+	// two instances in front of the same backend
+	a := newStore(t)
+	b := New(a.StorageReadWrite)
+	a.Transport, b.Transport = transport, transport
+	go a.Listen(ctx)
+	go b.Listen(ctx)
+	deadline := time.Now().Add(time.Second)
+	for {
+		transport.mu.Lock()
+		n := len(transport.subs)
+		transport.mu.Unlock()
+		if n == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	fromA, cancelA := a.Subscribe(10)
+	defer cancelA()
+	fromB, cancelB := b.Subscribe(10)
+	defer cancelB()
+	if err := a.SetURL(context.Background(), models.URL{ShortCode: "abcd123", Destination: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(t, fromB); e.Kind != Created || e.ShortCode != "abcd123" || e.Source != a.Source || e.URL.Destination != "https://example.com" {
+		t.Errorf("b received %+v", e)
+	}
+	if err := a.Delete(context.Background(), "abcd123"); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(t, fromB); e.Kind != Deleted || e.URL.ShortCode != "abcd123" || e.URL.Destination != "" {
+		t.Errorf("b received %+v for a hard delete", e)
+	}
+	transport.mu.Lock()
+	for _, payload := range transport.payloads {
+		if strings.Contains(payload, "example.com") {
+			t.Errorf("published event carries the destination: %s", payload)
+		}
+	}
+	transport.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		if e := next(t, fromA); e.Source != a.Source {
+			t.Errorf("a received %+v", e)
+		}
+	}
+	// a must not see its own event a second time when it comes back
+	select {
+	case e := <-fromA:
+		t.Errorf("a received its own event again: %+v", e)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+// Package hits buffers hit counts for links without a click limit, so that
+// redirects don't wait on a storage write each.
+package hits
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lucasreed/smol/pkg/data"
+)
+
+// Buffer collects hits in memory until they are flushed to its store. Counts
+// are best effort: hits are lost if the process dies before a flush, and
+// dropped if a flush fails.
+type Buffer struct {
+	store   data.StorageReadWrite
+	mu      sync.Mutex
+	pending map[string]int64
+}
+
+// New returns a Buffer flushing into store
+func New(store data.StorageReadWrite) *Buffer {
+	return &Buffer{store: store, pending: make(map[string]int64)}
+}
+
+// Add counts a hit on shortCode
+func (b *Buffer) Add(shortCode string) {
+	b.mu.Lock()
+	b.pending[shortCode]++
+	b.mu.Unlock()
+}
+
+// Flush writes the hits counted since the last flush, returning how many
+// there were. Hits the store isn't taking writes for at the moment are kept
+// for the next flush; on any other error they are dropped.
+func (b *Buffer) Flush(ctx context.Context) (int64, error) {
+	b.mu.Lock()
+	hits := b.pending
+	b.pending = make(map[string]int64)
+	b.mu.Unlock()
+	var n int64
+	for _, count := range hits {
+		n += count
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	err := data.AddHits(ctx, b.store, hits)
+	if errors.Is(err, data.ErrUnavailable) {
+		b.mu.Lock()
+		for shortCode, count := range hits {
+			b.pending[shortCode] += count
+		}
+		b.mu.Unlock()
+	}
+	return n, err
+}
+
+// Run flushes every interval until stop is closed, then flushes once more so
+// that no hits are left behind at shutdown
+func (b *Buffer) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.flush(interval)
+		case <-stop:
+			b.flush(interval)
+			return
+		}
+	}
+}
+
+func (b *Buffer) flush(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if n, err := b.Flush(ctx); err != nil {
+		log.Printf("error recording %d buffered hits - %v\n", n, err)
+	}
+}
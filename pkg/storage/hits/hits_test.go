@@ -0,0 +1,107 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package hits
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/data/models"
+	"github.com/lucasreed/smol/pkg/storage/memory"
+)
+
+func TestBuffer(t *testing.T) {
+	ctx := context.Background()
+	store := memory.NewStore("", 0)
+	if err := store.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetURL(ctx, models.URL{ShortCode: "abcd123", Destination: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	b := New(store)
+	for i := 0; i < 3; i++ {
+		b.Add("abcd123")
+	}
+	b.Add("missing")
+	if u, _ := store.GetURL(ctx, "abcd123"); u.Hits != 0 {
+		t.Errorf("hits reached the store before a flush: %d", u.Hits)
+	}
+
+	n, err := b.Flush(ctx)
+	if err != nil || n != 4 {
+		t.Fatalf("Flush returned %d, %v want 4 hits", n, err)
+	}
+	if u, _ := store.GetURL(ctx, "abcd123"); u.Hits != 3 {
+		t.Errorf("GetURL returned %d hits after a flush, want 3", u.Hits)
+	}
+	if n, err = b.Flush(ctx); err != nil || n != 0 {
+		t.Errorf("second Flush returned %d, %v want nothing left", n, err)
+	}
+
+	// stopping flushes what is left
+	b.Add("abcd123")
+	stop := make(chan struct{})
+	close(stop)
+	b.Run(time.Hour, stop)
+	if u, _ := store.GetURL(ctx, "abcd123"); u.Hits != 4 {
+		t.Errorf("GetURL returned %d hits after Run stopped, want 4", u.Hits)
+	}
+}
+
+// pausingStore stops taking writes once it has counted budget hits, as a
+// redis store does when its shards start being rebalanced
+type pausingStore struct {
+	*memory.Store
+	budget int
+}
+
+func (s *pausingStore) RecordHit(ctx context.Context, shortCode string) error {
+	if s.budget == 0 {
+		return fmt.Errorf("paused: %w", data.ErrUnavailable)
+	}
+	s.budget--
+	return s.Store.RecordHit(ctx, shortCode)
+}
+
+func TestBufferKeepsHitsWhileUnavailable(t *testing.T) {
+	ctx := context.Background()
+	store := &pausingStore{Store: memory.NewStore("", 0), budget: 1}
+	if err := store.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetURL(ctx, models.URL{ShortCode: "abcd123", Destination: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	b := New(store)
+	for i := 0; i < 3; i++ {
+		b.Add("abcd123")
+	}
+	if _, err := b.Flush(ctx); !errors.Is(err, data.ErrUnavailable) {
+		t.Fatalf("Flush returned %v, want ErrUnavailable", err)
+	}
+
+	store.budget = 10
+	if n, err := b.Flush(ctx); err != nil || n != 2 {
+		t.Errorf("Flush returned %d, %v once writes resumed, want the 2 hits kept", n, err)
+	}
+	if u, _ := store.GetURL(ctx, "abcd123"); u.Hits != 3 {
+		t.Errorf("GetURL returned %d hits, want 3", u.Hits)
+	}
+}
@@ -0,0 +1,454 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/data/models"
+)
+
+// Store represents an in-memory storage location that is safe for concurrent use.
+// If SnapshotPath is set the contents are loaded from it on Open and written back
+// every SnapshotInterval and on Close.
+type Store struct {
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+
+	mu    sync.RWMutex
+	urls  map[string]models.URL
+	codes map[string]string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewStore represents a new instance of an in-memory storage location.
+// An empty snapshotPath keeps everything in memory only.
+func NewStore(snapshotPath string, snapshotInterval time.Duration) *Store {
+	return &Store{
+		SnapshotPath:     snapshotPath,
+		SnapshotInterval: snapshotInterval,
+	}
+}
+
+// Open loads the last snapshot, if any, and starts the snapshot loop
+func (s *Store) Open(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.urls = make(map[string]models.URL)
+	s.codes = make(map[string]string)
+	s.mu.Unlock()
+
+	if s.SnapshotPath == "" {
+		return nil
+	}
+	if err := s.load(); err != nil {
+		return fmt.Errorf("[memory] error loading snapshot: %w", err)
+	}
+	if s.SnapshotInterval > 0 {
+		s.stop = make(chan struct{})
+		s.done = make(chan struct{})
+		go s.snapshotLoop()
+	}
+	return nil
+}
+
+// Close stops the snapshot loop and writes a final snapshot
+func (s *Store) Close() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+		s.stop = nil
+	}
+	if s.SnapshotPath == "" {
+		return nil
+	}
+	return s.Snapshot()
+}
+
+func (s *Store) Health(ctx context.Context) bool {
+	return s.Probe(ctx) == nil
+}
+
+// Probe reads the empty short code, which also waits for any write holding
+// the lock
+func (s *Store) Probe(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.RLock()
+	open := s.urls != nil
+	s.mu.RUnlock()
+	if !open {
+		return errors.New("[memory] store not open")
+	}
+	if _, err := s.GetURL(ctx, ""); err != nil && !errors.Is(err, data.ErrNotFound) {
+		return fmt.Errorf("[memory] probe failed: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) GetURL(ctx context.Context, shortCode string) (models.URL, error) {
+	if err := ctx.Err(); err != nil {
+		return models.URL{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.urls[shortCode]
+	if !ok {
+		return models.URL{}, fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+	}
+	if u.Gone(time.Now()) {
+		return copyURL(u), fmt.Errorf("%w: %s", data.ErrGone, shortCode)
+	}
+	return copyURL(u), nil
+}
+
+func (s *Store) GetShortCode(ctx context.Context, destination string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	shortCode, ok := s.codes[destination]
+	if !ok || s.urls[shortCode].Gone(time.Now()) {
+		return "", fmt.Errorf("%w: %s", data.ErrNotFound, destination)
+	}
+	return shortCode, nil
+}
+
+// List pages through the short codes in sorted order, the cursor being the
+// last code of the previous page
+func (s *Store) List(ctx context.Context, cursor string, limit int) ([]models.URL, string, error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("%w: %d", data.ErrInvalidLimit, limit)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	codes := make([]string, 0, len(s.urls))
+	for shortCode := range s.urls {
+		if shortCode > cursor {
+			codes = append(codes, shortCode)
+		}
+	}
+	sort.Strings(codes)
+	next := ""
+	if len(codes) > limit {
+		codes = codes[:limit]
+		next = codes[limit-1]
+	}
+	urls := make([]models.URL, len(codes))
+	for i, shortCode := range codes {
+		urls[i] = copyURL(s.urls[shortCode])
+	}
+	return urls, next, nil
+}
+
+func (s *Store) SetURL(ctx context.Context, url models.URL) error {
+	return s.setURL(ctx, url, false)
+}
+
+// RewriteURL replaces the link like SetURL but keeps its stored hit count
+func (s *Store) RewriteURL(ctx context.Context, url models.URL) error {
+	return s.setURL(ctx, url, true)
+}
+
+func (s *Store) setURL(ctx context.Context, url models.URL, keepHits bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.urls[url.ShortCode]
+	if ok {
+		s.unmapDestination(old)
+		if keepHits {
+			url.Hits = old.Hits
+		}
+	}
+	url.Stamp(time.Now(), old.CreatedAt)
+	s.put(url)
+	return nil
+}
+
+func (s *Store) CreateURL(ctx context.Context, url models.URL) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.urls[url.ShortCode]; ok {
+		return fmt.Errorf("%w: %s", data.ErrExists, url.ShortCode)
+	}
+	now := time.Now()
+	if !url.Gone(now) {
+		if err := s.destinationFree(url.ShortCode, url.Destination, now); err != nil {
+			return err
+		}
+	}
+	url.Stamp(now, time.Time{})
+	s.put(url)
+	return nil
+}
+
+func (s *Store) RecordHit(ctx context.Context, shortCode string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.urls[shortCode]
+	if !ok {
+		return fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+	}
+	if u.Exhausted() {
+		return fmt.Errorf("%w: %s", data.ErrGone, shortCode)
+	}
+	u.Hits++
+	s.urls[shortCode] = u
+	if u.Exhausted() {
+		s.unmapDestination(u)
+	}
+	return nil
+}
+
+func (s *Store) Delete(ctx context.Context, shortCode string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.urls[shortCode]
+	if !ok {
+		return fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+	}
+	delete(s.urls, shortCode)
+	s.unmapDestination(u)
+	return nil
+}
+
+func (s *Store) SoftDelete(ctx context.Context, shortCode string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.urls[shortCode]
+	if !ok {
+		return fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+	}
+	if u.Deleted() {
+		return fmt.Errorf("%w: %s", data.ErrGone, shortCode)
+	}
+	now := time.Now()
+	u.DeletedAt, u.UpdatedAt = &now, now
+	s.urls[shortCode] = u
+	s.unmapDestination(u)
+	return nil
+}
+
+func (s *Store) UpdateDestination(ctx context.Context, shortCode, destination string) (models.URL, error) {
+	if err := ctx.Err(); err != nil {
+		return models.URL{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.urls[shortCode]
+	if !ok {
+		return models.URL{}, fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+	}
+	now := time.Now()
+	if u.Gone(now) {
+		return models.URL{}, fmt.Errorf("%w: %s", data.ErrGone, shortCode)
+	}
+	if err := s.destinationFree(shortCode, destination, now); err != nil {
+		return models.URL{}, err
+	}
+	s.unmapDestination(u)
+	u = copyURL(u)
+	u.Redirect(destination, now)
+	s.put(u)
+	return copyURL(u), nil
+}
+
+func (s *Store) Restore(ctx context.Context, shortCode string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.urls[shortCode]
+	if !ok {
+		return fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+	}
+	if !u.Deleted() {
+		return nil
+	}
+	if err := s.destinationFree(shortCode, u.Destination, time.Now()); err != nil {
+		return err
+	}
+	u.DeletedAt, u.UpdatedAt = nil, time.Now()
+	s.put(u)
+	return nil
+}
+
+// Sweep removes links that expired before expiredBefore and tombstones
+// deleted before deletedBefore
+func (s *Store) Sweep(ctx context.Context, expiredBefore, deletedBefore time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	swept := 0
+	for shortCode, u := range s.urls {
+		if u.Swept(expiredBefore, deletedBefore) {
+			delete(s.urls, shortCode)
+			s.unmapDestination(u)
+			swept++
+		}
+	}
+	return swept, nil
+}
+
+// put stores url along with its reverse mapping. Links that are gone aren't
+// mapped so that they can't take the destination from a live link. s.mu must
+// be held.
+func (s *Store) put(url models.URL) {
+	s.urls[url.ShortCode] = copyURL(url)
+	if !url.Gone(time.Now()) {
+		s.codes[url.Destination] = url.ShortCode
+	}
+}
+
+// destinationFree returns ErrDestinationExists if a link other than shortCode
+// that isn't gone holds destination. s.mu must be held.
+func (s *Store) destinationFree(shortCode, destination string, now time.Time) error {
+	if other, ok := s.codes[destination]; ok && other != shortCode && !s.urls[other].Gone(now) {
+		return fmt.Errorf("%w: %s is shortened as %s", data.ErrDestinationExists, destination, other)
+	}
+	return nil
+}
+
+// unmapDestination removes the reverse mapping of u unless the destination
+// has since been shortened again under another code. s.mu must be held.
+func (s *Store) unmapDestination(u models.URL) {
+	if s.codes[u.Destination] == u.ShortCode {
+		delete(s.codes, u.Destination)
+	}
+}
+
+// Snapshot writes the current contents of the store to SnapshotPath. The file is
+// replaced atomically so a crash mid-write never leaves a truncated snapshot.
+func (s *Store) Snapshot() error {
+	s.mu.RLock()
+	urls := make([]models.URL, 0, len(s.urls))
+	for _, u := range s.urls {
+		urls = append(urls, u)
+	}
+	s.mu.RUnlock()
+	sort.Slice(urls, func(i, j int) bool { return urls[i].ShortCode < urls[j].ShortCode })
+
+	body, err := json.Marshal(urls)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.SnapshotPath), filepath.Base(s.SnapshotPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err = tmp.Write(body); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.SnapshotPath)
+}
+
+func (s *Store) load() error {
+	body, err := ioutil.ReadFile(s.SnapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var urls []models.URL
+	if err = json.Unmarshal(body, &urls); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range urls {
+		s.put(u)
+	}
+	return nil
+}
+
+// copyURL copies the labels of u so that callers can't modify a stored record
+// through the map they were handed
+func copyURL(u models.URL) models.URL {
+	if u.Labels != nil {
+		labels := make(map[string]string, len(u.Labels))
+		for k, v := range u.Labels {
+			labels[k] = v
+		}
+		u.Labels = labels
+	}
+	if u.Revisions != nil {
+		u.Revisions = append([]models.Revision(nil), u.Revisions...)
+	}
+	return u
+}
+
+func (s *Store) snapshotLoop() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.SnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Snapshot(); err != nil {
+				log.Printf("[memory] error writing snapshot: %v", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package memory
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/data/models"
+	"github.com/lucasreed/smol/pkg/storage/storagetest"
+)
+
+func TestStoreConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) data.StorageReadWrite {
+		store := NewStore("", 0)
+		if err := store.Open(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+func TestStore_SnapshotRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smol-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.json")
+
+	store := NewStore(path, 0)
+	if err = store.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.SetURL(context.Background(), models.URL{ShortCode: "abcd123", Destination: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := NewStore(path, 0)
+	if err = reopened.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	u, err := reopened.GetURL(context.Background(), "abcd123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Destination != "https://example.com" {
+		t.Errorf("wrong destination after reload: got %s want %s", u.Destination, "https://example.com")
+	}
+	code, err := reopened.GetShortCode(context.Background(), "https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != "abcd123" {
+		t.Errorf("wrong short code after reload: got %s want %s", code, "abcd123")
+	}
+}
+
+func TestStore_SnapshotReloadKeepsLiveDestination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smol-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.json")
+
+	ctx := context.Background()
+	store := NewStore(path, 0)
+	if err = store.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the expired link sorts after the live one, so it is loaded last
+	past := time.Now().Add(-time.Minute)
+	if err = store.CreateURL(ctx, models.URL{ShortCode: "abcd123", Destination: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.CreateURL(ctx, models.URL{ShortCode: "zzzz999", Destination: "https://example.com", ExpiresAt: &past}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := NewStore(path, 0)
+	if err = reopened.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	code, err := reopened.GetShortCode(ctx, "https://example.com")
+	if err != nil || code != "abcd123" {
+		t.Errorf("GetShortCode returned %s, %v after reload, want abcd123", code, err)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+// Package migrate copies short links from one storage backend to another.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/lucasreed/smol/pkg/data"
+)
+
+// DefaultBatchSize is how many links are read from the source at a time
+const DefaultBatchSize = 500
+
+// Options tune a Copy
+type Options struct {
+	// BatchSize is the page size used to list the source
+	BatchSize int
+	// Cursor resumes a previous copy from the List cursor it last reported
+	Cursor string
+	// DryRun reads everything and checks the destination without writing
+	DryRun bool
+	// Checkpoint, if set, is called with the cursor of the next page after
+	// every batch has been written so an interrupted copy can be resumed
+	Checkpoint func(cursor string) error
+}
+
+// Stats counts what a Copy did with each link read from the source
+type Stats struct {
+	Read int
+	// Copied links were written, or would have been on a dry run
+	Copied int
+	// Existing links were already in the destination with the same destination
+	Existing int
+	// Conflicts are short codes the destination already uses for something
+	// else, or links whose destination it already shortens under another
+	// code. They are logged and left alone.
+	Conflicts int
+}
+
+// Copy streams every link from src into dst. Links are created with CreateURL
+// so nothing already in dst is overwritten, which also makes it safe to rerun
+// a copy that was interrupted.
+func Copy(ctx context.Context, src data.StorageReader, dst data.StorageReadWrite, opts Options) (Stats, error) {
+	var stats Stats
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	cursor := opts.Cursor
+	for {
+		urls, next, err := src.List(ctx, cursor, opts.BatchSize)
+		if err != nil {
+			return stats, fmt.Errorf("error listing source: %w", err)
+		}
+		for _, u := range urls {
+			stats.Read++
+			existing, err := dst.GetURL(ctx, u.ShortCode)
+			if errors.Is(err, data.ErrGone) {
+				err = nil
+			}
+			switch {
+			case err == nil && existing.Destination == u.Destination:
+				stats.Existing++
+				continue
+			case err == nil:
+				stats.Conflicts++
+				log.Printf("[migrate] skipping %s: destination already maps it to %s instead of %s", u.ShortCode, existing.Destination, u.Destination)
+				continue
+			case !errors.Is(err, data.ErrNotFound):
+				return stats, fmt.Errorf("error reading %s from destination: %w", u.ShortCode, err)
+			}
+			if opts.DryRun {
+				holder, err := destinationHolder(ctx, dst, u.Destination)
+				if err != nil {
+					return stats, fmt.Errorf("error reading %s from destination: %w", u.Destination, err)
+				}
+				if holder != "" {
+					stats.Conflicts++
+					log.Printf("[migrate] skipping %s: destination already shortens %s as %s", u.ShortCode, u.Destination, holder)
+					continue
+				}
+				stats.Copied++
+				continue
+			}
+			err = dst.CreateURL(ctx, u)
+			if errors.Is(err, data.ErrDestinationExists) {
+				stats.Conflicts++
+				log.Printf("[migrate] skipping %s: %v", u.ShortCode, err)
+				continue
+			}
+			if err != nil {
+				return stats, fmt.Errorf("error writing %s: %w", u.ShortCode, err)
+			}
+			stats.Copied++
+		}
+		if next == "" {
+			return stats, nil
+		}
+		cursor = next
+		if opts.Checkpoint != nil && !opts.DryRun {
+			if err = opts.Checkpoint(cursor); err != nil {
+				return stats, fmt.Errorf("error saving checkpoint: %w", err)
+			}
+		}
+	}
+}
+
+// destinationHolder returns the code destination is shortened as in dst, or
+// "" if no link that isn't gone holds it
+func destinationHolder(ctx context.Context, dst data.StorageReader, destination string) (string, error) {
+	code, err := dst.GetShortCode(ctx, destination)
+	if errors.Is(err, data.ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	_, err = dst.GetURL(ctx, code)
+	if errors.Is(err, data.ErrNotFound) || errors.Is(err, data.ErrGone) {
+		return "", nil
+	}
+	return code, err
+}
+
+// Verification is the result of comparing a destination against its source
+type Verification struct {
+	Source  int
+	Matched int
+	Missing int
+	// Mismatched short codes exist in both but point at different destinations
+	Mismatched int
+}
+
+// OK reports whether every link in the source was found in the destination
+func (v Verification) OK() bool {
+	return v.Matched == v.Source
+}
+
+// Verify checks that every link in src can be read back from dst
+func Verify(ctx context.Context, src, dst data.StorageReader, batchSize int) (Verification, error) {
+	var v Verification
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	cursor := ""
+	for {
+		urls, next, err := src.List(ctx, cursor, batchSize)
+		if err != nil {
+			return v, fmt.Errorf("error listing source: %w", err)
+		}
+		for _, u := range urls {
+			v.Source++
+			got, err := dst.GetURL(ctx, u.ShortCode)
+			if errors.Is(err, data.ErrGone) {
+				err = nil
+			}
+			switch {
+			case errors.Is(err, data.ErrNotFound):
+				v.Missing++
+			case err != nil:
+				return v, fmt.Errorf("error reading %s from destination: %w", u.ShortCode, err)
+			case got.Destination != u.Destination:
+				v.Mismatched++
+			default:
+				v.Matched++
+			}
+		}
+		if next == "" {
+			return v, nil
+		}
+		cursor = next
+	}
+}
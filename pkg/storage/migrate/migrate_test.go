@@ -0,0 +1,105 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package migrate
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lucasreed/smol/pkg/data/models"
+	"github.com/lucasreed/smol/pkg/storage/memory"
+)
+
+func newStore(t *testing.T, urls map[string]string) *memory.Store {
+	store := memory.NewStore("", 0)
+	if err := store.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for code, destination := range urls {
+		if err := store.SetURL(context.Background(), models.URL{ShortCode: code, Destination: destination}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	src := newStore(t, map[string]string{
+		"aaaaaaa": "https://example.com/a",
+		"bbbbbbb": "https://example.com/b",
+		"ccccccc": "https://example.com/c",
+		"ddddddd": "https://example.com/d",
+		"eeeeeee": "https://example.com/e",
+	})
+	dst := newStore(t, map[string]string{
+		"bbbbbbb": "https://example.com/b",
+		"ccccccc": "https://example.org/other",
+		"fffffff": "https://example.com/e",
+	})
+
+	dry, err := Copy(ctx, src, dst, Options{BatchSize: 3, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := Verify(ctx, src, dst, 3); v.Missing != 3 {
+		t.Errorf("dry run wrote to the destination, %d links missing, want 3", v.Missing)
+	}
+
+	var checkpoints []string
+	stats, err := Copy(ctx, src, dst, Options{
+		BatchSize:  3,
+		Checkpoint: func(cursor string) error { checkpoints = append(checkpoints, cursor); return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Stats{Read: 5, Copied: 2, Existing: 1, Conflicts: 2}
+	if stats != want || dry != want {
+		t.Errorf("Copy returned %+v, dry run %+v, want %+v", stats, dry, want)
+	}
+	if len(checkpoints) != 1 || checkpoints[0] != "ccccccc" {
+		t.Errorf("Copy checkpointed %v, want [ccccccc]", checkpoints)
+	}
+
+	v, err := Verify(ctx, src, dst, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != (Verification{Source: 5, Matched: 3, Missing: 1, Mismatched: 1}) || v.OK() {
+		t.Errorf("Verify returned %+v", v)
+	}
+}
+
+func TestCopy_Resume(t *testing.T) {
+	ctx := context.Background()
+	src := newStore(t, map[string]string{
+		"aaaaaaa": "https://example.com/a",
+		"bbbbbbb": "https://example.com/b",
+		"ccccccc": "https://example.com/c",
+	})
+	dst := newStore(t, nil)
+
+	stats, err := Copy(ctx, src, dst, Options{BatchSize: 2, Cursor: "bbbbbbb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Read != 1 || stats.Copied != 1 {
+		t.Errorf("resumed Copy returned %+v, want only ccccccc copied", stats)
+	}
+	if _, err = dst.GetURL(ctx, "ccccccc"); err != nil {
+		t.Errorf("resumed Copy did not write ccccccc: %v", err)
+	}
+}
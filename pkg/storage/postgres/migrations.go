@@ -0,0 +1,92 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+)
+
+// migrationLockID is the advisory lock key held while migrating so that
+// several smolserv instances starting together don't race each other.
+const migrationLockID = 7665378
+
+// migrations are applied in order and must never be edited once released.
+// Add a new entry to the end of the list to change the schema.
+var migrations = []string{
+	// 1: initial schema
+	`CREATE TABLE urls (
+		short_code  varchar(7) PRIMARY KEY,
+		destination text NOT NULL UNIQUE
+	)`,
+	// 2: link metadata
+	`ALTER TABLE urls
+		ADD COLUMN created_at timestamptz NOT NULL DEFAULT now(),
+		ADD COLUMN updated_at timestamptz NOT NULL DEFAULT now(),
+		ADD COLUMN creator    text NOT NULL DEFAULT '',
+		ADD COLUMN title      text NOT NULL DEFAULT '',
+		ADD COLUMN hits       bigint NOT NULL DEFAULT 0,
+		ADD COLUMN labels     jsonb NOT NULL DEFAULT '{}'`,
+	// 3: expiring links
+	`ALTER TABLE urls ADD COLUMN expires_at timestamptz;
+	CREATE INDEX urls_expires_at ON urls (expires_at) WHERE expires_at IS NOT NULL`,
+	// 4: links limited to a number of clicks
+	`ALTER TABLE urls ADD COLUMN max_clicks bigint NOT NULL DEFAULT 0`,
+	// 5: tombstones. A deleted link keeps its short code but not its
+	// destination, which only has to be unique among live links.
+	`ALTER TABLE urls ADD COLUMN deleted_at timestamptz;
+	ALTER TABLE urls DROP CONSTRAINT urls_destination_key;
+	CREATE UNIQUE INDEX urls_destination_live ON urls (destination) WHERE deleted_at IS NULL;
+	CREATE INDEX urls_deleted_at ON urls (deleted_at) WHERE deleted_at IS NOT NULL`,
+	// 6: past destinations
+	`ALTER TABLE urls ADD COLUMN revisions jsonb NOT NULL DEFAULT '[]'`,
+	// 7: links that expired or used up their clicks give up their
+	// destination, rather than being deleted, once it is shortened again
+	`ALTER TABLE urls ADD COLUMN released boolean NOT NULL DEFAULT false;
+	DROP INDEX urls_destination_live;
+	CREATE UNIQUE INDEX urls_destination_live ON urls (destination) WHERE deleted_at IS NULL AND NOT released`,
+}
+
+func migrate(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLockID); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    integer PRIMARY KEY,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`); err != nil {
+		return err
+	}
+
+	var current int
+	if err = tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	for i := current; i < len(migrations); i++ {
+		if _, err = tx.ExecContext(ctx, migrations[i]); err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, i+1); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	// register the postgres driver with database/sql
+	_ "github.com/lib/pq"
+
+	"github.com/lucasreed/smol/pkg/storage/sqlstore"
+)
+
+// Store represents a postgres storage location
+type Store struct {
+	sqlstore.Store
+	DSN string
+}
+
+// NewStore represents a new instance of a postgres storage location
+func NewStore(dsn string) *Store {
+	return &Store{
+		Store: sqlstore.NewStore(sqlstore.Dialect{
+			Name:    "postgres",
+			Rebind:  rebind,
+			LockRow: " FOR UPDATE",
+		}),
+		DSN: dsn,
+	}
+}
+
+// Open connects to postgres and applies any outstanding schema migrations
+func (s *Store) Open(ctx context.Context) error {
+	db, err := sql.Open("postgres", s.DSN)
+	if err != nil {
+		return err
+	}
+	if err = db.PingContext(ctx); err != nil {
+		_ = db.Close()
+		return fmt.Errorf("[postgres] connection not established: %w", err)
+	}
+	s.DB = db
+
+	if err = migrate(ctx, db); err != nil {
+		return fmt.Errorf("[postgres] error migrating schema: %w", err)
+	}
+	return nil
+}
+
+// rebind numbers the ? placeholders of query as $1, $2 and so on. None of
+// the shared queries have a ? anywhere else.
+func rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	for {
+		i := strings.IndexByte(query, '?')
+		if i < 0 {
+			break
+		}
+		n++
+		b.WriteString(query[:i])
+		b.WriteString("$" + strconv.Itoa(n))
+		query = query[i+1:]
+	}
+	b.WriteString(query)
+	return b.String()
+}
@@ -0,0 +1,51 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package postgres
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/storage/storagetest"
+)
+
+// The postgres suite needs a real server and is skipped unless
+// SMOL_TEST_POSTGRES_DSN points at a database that can be wiped.
+func TestStoreConformance(t *testing.T) {
+	dsn := os.Getenv("SMOL_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("SMOL_TEST_POSTGRES_DSN not set")
+	}
+	storagetest.Run(t, func(t *testing.T) data.StorageReadWrite {
+		store := NewStore(dsn)
+		if err := store.Open(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.DB.Exec(`TRUNCATE urls`); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+func TestRebind(t *testing.T) {
+	got := rebind(`UPDATE urls SET hits = ? WHERE short_code = ? AND hits < ?`)
+	want := `UPDATE urls SET hits = $1 WHERE short_code = $2 AND hits < $3`
+	if got != want {
+		t.Errorf("rebind returned %q, want %q", got, want)
+	}
+}
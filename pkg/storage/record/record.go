@@ -0,0 +1,57 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+// Package record encodes links for the key-value backends, which store the
+// whole models.URL under its short code.
+package record
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/lucasreed/smol/pkg/data/models"
+)
+
+// Version is written into every encoded record so the format can change
+// without guessing at what is stored
+const Version = 1
+
+type envelope struct {
+	V int `json:"v"`
+	models.URL
+}
+
+// Encode returns the stored form of u
+func Encode(u models.URL) ([]byte, error) {
+	return json.Marshal(envelope{V: Version, URL: u})
+}
+
+// Decode reads a value stored under shortCode. Values written before records
+// were versioned are bare destinations, which can never start with a brace,
+// and are returned as a record with only the destination set.
+func Decode(shortCode string, value []byte) (models.URL, error) {
+	if !bytes.HasPrefix(value, []byte("{")) {
+		return models.URL{Destination: string(value), ShortCode: shortCode}, nil
+	}
+	var e envelope
+	if err := json.Unmarshal(value, &e); err != nil {
+		return models.URL{}, fmt.Errorf("error decoding record %s: %w", shortCode, err)
+	}
+	if e.V != Version {
+		return models.URL{}, fmt.Errorf("record %s has unknown version %d", shortCode, e.V)
+	}
+	e.URL.ShortCode = shortCode
+	return e.URL, nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package record
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lucasreed/smol/pkg/data/models"
+)
+
+func TestRoundTrip(t *testing.T) {
+	u := models.URL{
+		Destination: "https://example.com",
+		ShortCode:   "abcd123",
+		CreatedAt:   time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC),
+		UpdatedAt:   time.Date(2020, 5, 2, 12, 0, 0, 0, time.UTC),
+		Creator:     "luke",
+		Title:       "Example",
+		Hits:        42,
+		Labels:      map[string]string{"campaign": "spring"},
+	}
+	value, err := Encode(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Decode("abcd123", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, u) {
+		t.Errorf("Decode returned %+v, want %+v", got, u)
+	}
+}
+
+func TestDecodeLegacy(t *testing.T) {
+	got, err := Decode("abcd123", []byte("https://example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (models.URL{Destination: "https://example.com", ShortCode: "abcd123"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Decode returned %+v for a legacy value", got)
+	}
+}
+
+func TestDecodeUnknownVersion(t *testing.T) {
+	if _, err := Decode("abcd123", []byte(`{"v":99}`)); err == nil {
+		t.Error("Decode accepted an unknown version")
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package rediscache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/data/models"
+)
+
+// claimPrefix marks a reverse mapping as a pending claim by the short code
+// after it. No short code starts with a NUL byte.
+const claimPrefix = "\x00"
+
+// claimTimeout is how long a pending claim holds a destination. A claim left
+// behind by a process that died before writing its link lapses after it.
+const claimTimeout = 30 * time.Second
+
+// claimScript claims the destination in KEYS[1] for the short code in ARGV[1]
+// with a pending mapping that expires after ARGV[3] milliseconds. The
+// mapping is taken over if it is free, already ours or held by ARGV[2], a
+// holder found to be stale. Otherwise it returns the current holder. It
+// returns 1 if ARGV[1] already holds the committed mapping and 2 once it
+// has claimed it.
+var claimScript = newScript(1, `
+local current = redis.call("GET", KEYS[1])
+if current == ARGV[1] then
+	return 1
+end
+if current and current ~= ARGV[2] and current ~= "\0" .. ARGV[1] then
+	return current
+end
+redis.call("SET", KEYS[1], "\0" .. ARGV[1], "PX", ARGV[3])
+return 2
+`)
+
+// commitScript turns the claim of ARGV[1] on KEYS[1] into the mapping,
+// expiring at the unix millisecond time in ARGV[2] unless that is 0. It
+// returns 0 if the claim is no longer held.
+var commitScript = newScript(1, `
+local current = redis.call("GET", KEYS[1])
+if current ~= ARGV[1] and current ~= "\0" .. ARGV[1] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1])
+if ARGV[2] ~= "0" then
+	redis.call("PEXPIREAT", KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// releaseScript drops the pending claim of ARGV[1] on KEYS[1], leaving a
+// committed mapping alone
+var releaseScript = newScript(1, `
+if redis.call("GET", KEYS[1]) == "\0" .. ARGV[1] then
+	redis.call("DEL", KEYS[1])
+end
+return 1
+`)
+
+// claimDestination reserves destination for shortCode on the shard of the
+// destination, before a link whose reverse mapping lives there rather than
+// beside its record is written. Checking the destination is free and taking
+// it are one step, so two links can't both win it. The caller settles the
+// claim with settleClaim once the link is written or has failed. It returns
+// ErrDestinationExists if another link holds the destination.
+func (s *Store) claimDestination(ctx context.Context, shortCode, destination string) error {
+	conn, err := s.conn(ctx, destination)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stale := ""
+	for attempt := 0; attempt < maxTxAttempts; attempt++ {
+		reply, err := claimScript.do(ctx, conn, s.codeKey(destination),
+			shortCode, stale, claimTimeout.Milliseconds())
+		if err != nil {
+			return err
+		}
+		holder, ok := reply.([]byte)
+		if !ok {
+			return nil
+		}
+		if stale, err = s.staleHolder(ctx, string(holder), destination); err != nil {
+			return err
+		}
+	}
+	return errTxConflict
+}
+
+// settleClaim commits the claim of url on its destination once the link has
+// been written, or releases it when err says the write failed, returning
+// err. A claim that has since been replaced, by a SetURL taking the
+// destination, is left to the later write.
+func (s *Store) settleClaim(ctx context.Context, url models.URL, err error) error {
+	conn, connErr := s.conn(ctx, url.Destination)
+	if connErr != nil {
+		if err != nil {
+			return err
+		}
+		return connErr
+	}
+	defer conn.Close()
+	key := s.codeKey(url.Destination)
+	if err != nil {
+		// a claim left behind lapses on its own
+		_, _ = releaseScript.do(ctx, conn, key, url.ShortCode)
+		return err
+	}
+	_, reverseAt := s.expiry(url)
+	if _, err = commitScript.do(ctx, conn, key, url.ShortCode, reverseAt); err != nil {
+		return fmt.Errorf("[redis] link written but not its reverse mapping: %w", err)
+	}
+	return nil
+}
+
+// staleHolder returns holder if its mapping of destination can be taken over
+// because the link is missing, gone or points elsewhere, and
+// ErrDestinationExists if it still holds the destination. Pending claims
+// always hold it.
+func (s *Store) staleHolder(ctx context.Context, holder, destination string) (string, error) {
+	if strings.HasPrefix(holder, claimPrefix) {
+		return "", fmt.Errorf("%w: %s is being shortened as %s", data.ErrDestinationExists, destination, holder[len(claimPrefix):])
+	}
+	live, err := s.getURLs(ctx, []string{holder})
+	if err != nil {
+		return "", err
+	}
+	if len(live) == 1 && live[0].Destination == destination && !live[0].Gone(time.Now()) {
+		return "", fmt.Errorf("%w: %s is shortened as %s", data.ErrDestinationExists, destination, holder)
+	}
+	return holder, nil
+}
+
+// isClaim reports whether a reverse mapping value is a pending claim
+func isClaim(value string) bool {
+	return strings.HasPrefix(value, claimPrefix)
+}
@@ -0,0 +1,196 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package rediscache
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// schemaVersion 1 stored both directions of every mapping as bare
+	// top-level keys, 2 moved them under urlPrefix and codePrefix, and 3
+	// moved the keys on Redis Cluster out of the one {smol} slot
+	schemaVersion = 3
+)
+
+// migrateScript moves one legacy pair to its namespaced keys, but only if the
+// two bare keys still point at each other
+var migrateScript = newScript(4, `
+if redis.call("GET", KEYS[1]) ~= ARGV[2] or redis.call("GET", KEYS[2]) ~= ARGV[1] then
+	return 0
+end
+redis.call("SET", KEYS[3], ARGV[2])
+redis.call("SET", KEYS[4], ARGV[1])
+redis.call("DEL", KEYS[1], KEYS[2])
+return 1
+`)
+
+// Migrate rewrites mappings stored in the original flat layout into the
+// namespaced layout, and on Redis Cluster moves keys from the shared {smol}
+// slot to the slots of their own short code or destination. Only pairs of
+// bare keys that point at each other are touched, so unrelated keys sharing
+// the database are left alone. It is safe to run again after a partial run
+// and is a no-op once complete. The flat layout predates cluster and shard
+// support, so there is nothing to scan for there.
+func (s *Store) Migrate(ctx context.Context) error {
+	var conn redis.Conn
+	var err error
+	if s.cluster != nil {
+		conn, err = s.clusterConn(ctx, s.schemaKey())
+	} else {
+		conn, err = s.conn(ctx, "")
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	version, err := redis.Int(do(ctx, conn, "GET", s.schemaKey()))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	if version >= schemaVersion {
+		return nil
+	}
+	if s.cluster != nil {
+		if err = s.migrateClusterKeys(ctx, conn); err != nil {
+			return err
+		}
+	}
+	if s.cluster != nil || s.shards != nil || version >= 2 {
+		_, err = do(ctx, conn, "SET", s.schemaKey(), schemaVersion)
+		return err
+	}
+
+	cursor := 0
+	for {
+		reply, err := redis.Values(do(ctx, conn, "SCAN", cursor, "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+		if cursor, err = redis.Int(reply[0], nil); err != nil {
+			return err
+		}
+		keys, err := redis.Strings(reply[1], nil)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			// short codes are alphanumeric while destinations always
+			// carry a scheme, so only bare short code keys start a pair
+			if strings.HasPrefix(key, keyPrefix) || strings.Contains(key, "://") {
+				continue
+			}
+			destination, err := redis.String(do(ctx, conn, "GET", key))
+			if err == redis.ErrNil || isWrongType(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if !strings.Contains(destination, "://") {
+				continue
+			}
+			if _, err = migrateScript.do(ctx, conn, key, destination, s.urlKey(key), s.codeKey(destination), key, destination); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	_, err = do(ctx, conn, "SET", s.schemaKey(), schemaVersion)
+	return err
+}
+
+// migrateClusterKeys moves every key under legacyClusterPrefix to its own
+// slot. conn is bound to the node owning the {smol} slot. Other instances
+// must not be writing while it runs.
+func (s *Store) migrateClusterKeys(ctx context.Context, conn redis.Conn) error {
+	cursor := "0"
+	for {
+		reply, err := redis.Values(do(ctx, conn, "SCAN", cursor, "MATCH", legacyClusterPrefix+"*", "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if _, err = redis.Scan(reply, &cursor, &keys); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			name := strings.TrimPrefix(key, legacyClusterPrefix)
+			var route, newKey string
+			switch {
+			case strings.HasPrefix(name, "url:"):
+				route = strings.TrimPrefix(name, "url:")
+				newKey = s.urlKey(route)
+			case strings.HasPrefix(name, "hits:"):
+				route = strings.TrimPrefix(name, "hits:")
+				newKey = s.hitsKey(route)
+			case strings.HasPrefix(name, "code:"):
+				route = strings.TrimPrefix(name, "code:")
+				newKey = s.codeKey(route)
+			default:
+				continue
+			}
+			to, err := s.conn(ctx, route)
+			if err != nil {
+				return err
+			}
+			err = moveKey(ctx, conn, to, key, newKey)
+			to.Close()
+			if err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// moveKey copies the string at key on from to newKey on to, keeping its time
+// to live, then deletes the original. A key that has gone in the meantime is
+// skipped.
+func moveKey(ctx context.Context, from, to redis.Conn, key, newKey string) error {
+	value, err := redis.Bytes(do(ctx, from, "GET", key))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ttl, err := redis.Int64(do(ctx, from, "PTTL", key))
+	if err != nil {
+		return err
+	}
+	args := []interface{}{newKey, value}
+	if ttl > 0 {
+		args = append(args, "PX", ttl)
+	}
+	if _, err = do(ctx, to, "SET", args...); err != nil {
+		return err
+	}
+	_, err = do(ctx, from, "DEL", key)
+	return err
+}
+
+func isWrongType(err error) bool {
+	e, ok := err.(redis.Error)
+	return ok && strings.HasPrefix(string(e), "WRONGTYPE")
+}
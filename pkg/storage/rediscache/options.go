@@ -0,0 +1,276 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package rediscache
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/mna/redisc"
+)
+
+// Options configures how a Store connects to redis. Host and Port address a
+// single server. Setting SentinelAddrs instead discovers the current master
+// of SentinelMaster through sentinel, setting ClusterAddrs talks to a Redis
+// Cluster through the given startup nodes, and setting Shards spreads links
+// over independent servers.
+type Options struct {
+	Host string
+	Port string
+
+	// Username and Password authenticate with AUTH. Leave Username empty for
+	// the default user or for servers older than redis 6.
+	Username string
+	Password string
+	// DB is the database selected after connecting. Redis Cluster only has 0.
+	DB int
+
+	// TLS enables TLS. TLSCAFile adds a PEM bundle of CAs to trust on top of
+	// the system pool, TLSServerName overrides the name verified against the
+	// server certificate.
+	TLS           bool
+	TLSCAFile     string
+	TLSServerName string
+	TLSSkipVerify bool
+
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+
+	// MaxIdle, MaxActive, IdleTimeout and Wait are passed to the connection
+	// pool, or to the pool of every node when using Redis Cluster
+	MaxIdle     int
+	MaxActive   int
+	IdleTimeout time.Duration
+	Wait        bool
+
+	SentinelAddrs    []string
+	SentinelMaster   string
+	SentinelPassword string
+
+	ClusterAddrs []string
+
+	// Shards are the host:port addresses of independent redis servers that
+	// links are spread over by consistent hashing, in place of Host and
+	// Port. The record of a link lives on the server its short code hashes
+	// to and its reverse mapping on the one its destination hashes to.
+	// When the list changes, writes are refused until Rebalance has moved
+	// the keys into place.
+	Shards []string
+
+	// ExpiredRetention is how long the record of an expired link is kept,
+	// answering as gone, before redis removes it. The reverse mapping goes
+	// as soon as the link expires.
+	ExpiredRetention time.Duration
+	// Quarantine is how long the tombstone of a deleted link is kept,
+	// answering as gone and holding on to its short code, before redis
+	// removes it
+	Quarantine time.Duration
+}
+
+// DefaultOptions are the connection settings smolserv uses unless told otherwise
+func DefaultOptions() Options {
+	return Options{
+		Host:           "localhost",
+		Port:           "6379",
+		ConnectTimeout: 5 * time.Second,
+		MaxIdle:        80,
+		MaxActive:      12000,
+		IdleTimeout:    5 * time.Minute,
+
+		ExpiredRetention: 24 * time.Hour,
+		Quarantine:       30 * 24 * time.Hour,
+	}
+}
+
+func (o Options) validate() error {
+	if len(o.SentinelAddrs) > 0 && len(o.ClusterAddrs) > 0 {
+		return errors.New("sentinel and cluster can't be used together")
+	}
+	if len(o.SentinelAddrs) > 0 && o.SentinelMaster == "" {
+		return errors.New("a sentinel master name is required with sentinel addresses")
+	}
+	if len(o.Shards) > 0 && (len(o.SentinelAddrs) > 0 || len(o.ClusterAddrs) > 0) {
+		return errors.New("shards can't be used with sentinel or cluster")
+	}
+	if len(o.ClusterAddrs) > 0 && o.DB != 0 {
+		return errors.New("redis cluster only supports database 0")
+	}
+	return nil
+}
+
+// dialOptions are applied to every data connection, whichever mode is in use
+func (o Options) dialOptions() ([]redis.DialOption, error) {
+	opts := []redis.DialOption{
+		redis.DialConnectTimeout(o.ConnectTimeout),
+		redis.DialReadTimeout(o.ReadTimeout),
+		redis.DialWriteTimeout(o.WriteTimeout),
+		redis.DialUsername(o.Username),
+		redis.DialPassword(o.Password),
+		redis.DialDatabase(o.DB),
+	}
+	if o.TLS {
+		tlsConfig, err := o.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, redis.DialUseTLS(true), redis.DialTLSConfig(tlsConfig), redis.DialTLSSkipVerify(o.TLSSkipVerify))
+	}
+	return opts, nil
+}
+
+func (o Options) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: o.TLSServerName,
+	}
+	if o.TLSCAFile == "" {
+		return config, nil
+	}
+	pem, err := ioutil.ReadFile(o.TLSCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA file: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", o.TLSCAFile)
+	}
+	config.RootCAs = pool
+	return config, nil
+}
+
+func (s *Store) newPool(dial func(ctx context.Context) (redis.Conn, error)) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     s.MaxIdle,
+		MaxActive:   s.MaxActive,
+		IdleTimeout: s.IdleTimeout,
+		Wait:        s.Wait,
+		DialContext: dial,
+	}
+}
+
+// dial connects to Host and Port, or to whichever server sentinel currently
+// reports as master
+func (s *Store) dial(ctx context.Context) (redis.Conn, error) {
+	addr := net.JoinHostPort(s.Host, s.Port)
+	if len(s.SentinelAddrs) > 0 {
+		var err error
+		if addr, err = s.masterAddr(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return s.dialAddr(ctx, addr)
+}
+
+// dialAddr connects to a single server
+func (s *Store) dialAddr(ctx context.Context, addr string) (redis.Conn, error) {
+	c, err := redis.DialContext(ctx, "tcp", addr, s.dialOpts...)
+	if err != nil {
+		err = fmt.Errorf("failed connecting to redis\n   %w", err)
+	}
+	return c, err
+}
+
+// masterAddr asks each sentinel in turn for the address of the master
+func (s *Store) masterAddr(ctx context.Context) (string, error) {
+	opts := []redis.DialOption{
+		redis.DialConnectTimeout(s.ConnectTimeout),
+		redis.DialReadTimeout(s.ReadTimeout),
+		redis.DialWriteTimeout(s.WriteTimeout),
+		redis.DialPassword(s.SentinelPassword),
+	}
+	var errs []string
+	for _, sentinel := range s.SentinelAddrs {
+		addr, err := func() (string, error) {
+			conn, err := redis.DialContext(ctx, "tcp", sentinel, opts...)
+			if err != nil {
+				return "", err
+			}
+			defer conn.Close()
+			hostPort, err := redis.Strings(do(ctx, conn, "SENTINEL", "get-master-addr-by-name", s.SentinelMaster))
+			if err != nil {
+				return "", err
+			}
+			if len(hostPort) != 2 {
+				return "", fmt.Errorf("unexpected reply %v", hostPort)
+			}
+			return net.JoinHostPort(hostPort[0], hostPort[1]), nil
+		}()
+		if err == nil {
+			return addr, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", sentinel, err))
+	}
+	return "", fmt.Errorf("no sentinel knows master %s: %s", s.SentinelMaster, strings.Join(errs, "; "))
+}
+
+// testRole drops pooled connections that have sat idle for a while and no
+// longer point at a master, which happens after a sentinel failover
+func (s *Store) testRole(c redis.Conn, lastUsed time.Time) error {
+	if time.Since(lastUsed) < time.Minute {
+		return nil
+	}
+	role, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(role) == 0 {
+		return errors.New("empty ROLE reply")
+	}
+	if name, _ := redis.String(role[0], nil); name != "master" {
+		return fmt.Errorf("connected to a %s, not the master", name)
+	}
+	return nil
+}
+
+// newShards creates a pool for every shard and the ring that picks between
+// them
+func (s *Store) newShards() ([]*redis.Pool, *ring) {
+	pools := make([]*redis.Pool, len(s.Shards))
+	for i, addr := range s.Shards {
+		addr := addr
+		pools[i] = s.newPool(func(ctx context.Context) (redis.Conn, error) {
+			return s.dialAddr(ctx, addr)
+		})
+	}
+	return pools, newRing(s.Shards)
+}
+
+func (s *Store) newCluster() (*redisc.Cluster, error) {
+	cluster := &redisc.Cluster{
+		StartupNodes: s.ClusterAddrs,
+		DialOptions:  s.dialOpts,
+		CreatePool: func(addr string, opts ...redis.DialOption) (*redis.Pool, error) {
+			return s.newPool(func(ctx context.Context) (redis.Conn, error) {
+				return redis.DialContext(ctx, "tcp", addr, opts...)
+			}), nil
+		},
+	}
+	if err := cluster.Refresh(); err != nil {
+		_ = cluster.Close()
+		return nil, err
+	}
+	return cluster, nil
+}
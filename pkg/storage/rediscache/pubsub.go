@@ -0,0 +1,81 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package rediscache
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Publish sends payload to every client subscribed to channel. In cluster
+// mode redis forwards it to the subscribers on every node.
+func (s *Store) Publish(ctx context.Context, channel string, payload []byte) error {
+	conn, err := s.conn(ctx, channel)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err = do(ctx, conn, "PUBLISH", channel, payload); err != nil {
+		return fmt.Errorf("[redis] error publishing to %s: %w", channel, err)
+	}
+	return nil
+}
+
+// Subscribe calls fn with every message published to channel until ctx is
+// done, when it returns ctx.Err(), or the connection fails. It holds one
+// connection for as long as it runs, and messages published while it isn't
+// running are lost.
+func (s *Store) Subscribe(ctx context.Context, channel string, fn func(payload []byte)) error {
+	conn, err := s.conn(ctx, channel)
+	if err != nil {
+		return err
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	defer psc.Close()
+	if err = psc.Subscribe(channel); err != nil {
+		return fmt.Errorf("[redis] error subscribing to %s: %w", channel, err)
+	}
+
+	// unsubscribing makes the receive loop below see a zero count and stop.
+	// The connection can't be closed while that is still being written.
+	done, exited := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(done)
+		<-exited
+	}()
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = psc.Unsubscribe(channel)
+		case <-done:
+		}
+	}()
+	for {
+		// no timeout, subscribers can sit idle for as long as nobody writes
+		switch v := psc.ReceiveWithTimeout(0).(type) {
+		case redis.Message:
+			fn(v.Data)
+		case redis.Subscription:
+			if v.Kind == "unsubscribe" && v.Count == 0 {
+				return ctx.Err()
+			}
+		case error:
+			return fmt.Errorf("[redis] error receiving from %s: %w", channel, v)
+		}
+	}
+}
@@ -15,114 +15,1211 @@
 package rediscache
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/mna/redisc"
 
+	"github.com/lucasreed/smol/pkg/data"
 	"github.com/lucasreed/smol/pkg/data/models"
+	"github.com/lucasreed/smol/pkg/storage/record"
 )
 
+const (
+	// keyPrefix namespaces every key smol writes
+	keyPrefix = "smol:"
+	// legacyClusterPrefix replaced keyPrefix against Redis Cluster before
+	// schema 3. Its hash tag put every key in the same slot, so a cluster
+	// gave no distribution. The schema version still lives there.
+	legacyClusterPrefix = "{smol}:"
+)
+
+// createScript sets both directions of a mapping, and the hit counter in
+// KEYS[3] if ARGV[3] isn't 0, only if the short code key in KEYS[1] is
+// unused. The reverse mapping is left out when ARGV[1] is empty, as it is for
+// tombstones. ARGV[4] and ARGV[5] are the unix millisecond times the record
+// and the reverse mapping expire at, 0 for never. It returns 0 when the code
+// was already taken. When the reverse mapping in KEYS[2] is held by another
+// code than ARGV[6], one not yet found to be stale, nothing is written and
+// that code is returned instead.
+var createScript = newScript(3, `
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+if ARGV[1] ~= "" then
+	local holder = redis.call("GET", KEYS[2])
+	if holder and holder ~= ARGV[1] and holder ~= ARGV[6] then
+		return holder
+	end
+end
+redis.call("SET", KEYS[1], ARGV[2])
+if ARGV[1] ~= "" then
+	redis.call("SET", KEYS[2], ARGV[1])
+end
+if ARGV[3] ~= "0" then
+	redis.call("SET", KEYS[3], ARGV[3])
+end
+if ARGV[4] ~= "0" then
+	redis.call("PEXPIREAT", KEYS[1], ARGV[4])
+	redis.call("PEXPIREAT", KEYS[3], ARGV[4])
+end
+if ARGV[5] ~= "0" then
+	redis.call("PEXPIREAT", KEYS[2], ARGV[5])
+end
+return 1
+`)
+
+// hitScript bumps the hit counter in KEYS[2] as long as the record in KEYS[1]
+// is still the one in ARGV[1], and the counter is below ARGV[2] when that
+// isn't 0. It returns nil if the record is missing, 0 if it has changed and
+// -1 if the link has no clicks left. The last click also removes the reverse
+// mapping in KEYS[3], if it still points at ARGV[3], so the destination can
+// be shortened again. ARGV[3] is empty when the reverse mapping lives
+// elsewhere. The counter is given the record's expiry so it doesn't outlive
+// it.
+var hitScript = newScript(3, `
+local value = redis.call("GET", KEYS[1])
+if not value then
+	return false
+end
+if value ~= ARGV[1] then
+	return 0
+end
+local max = tonumber(ARGV[2])
+if max > 0 and tonumber(redis.call("GET", KEYS[2]) or "0") >= max then
+	return -1
+end
+local hits = redis.call("INCR", KEYS[2])
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl > 0 then
+	redis.call("PEXPIRE", KEYS[2], ttl)
+end
+if max > 0 and hits >= max and ARGV[3] ~= "" and redis.call("GET", KEYS[3]) == ARGV[3] then
+	redis.call("DEL", KEYS[3])
+end
+return hits
+`)
+
+// unmapScript deletes the reverse mapping in KEYS[1] if it still points at the
+// short code in ARGV[1]
+var unmapScript = newScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("DEL", KEYS[1])
+end
+return 1
+`)
+
 // Store represents a rediscache storage location
 type Store struct {
-	Host string
-	Port string
+	Options
 	Pool *redis.Pool
+
+	cluster *redisc.Cluster
+	// nodes are pools to the masters of the cluster, for walking them, or
+	// to shards of another shard list while rebalancing
+	nodesMu  sync.Mutex
+	nodes    map[string]*redis.Pool
+	shards   []*redis.Pool
+	ring     *ring
+	dialOpts []redis.DialOption
+
+	// the stored topology of the shards, read again every topologyRefresh
+	topoMu      sync.Mutex
+	topoChecked time.Time
+	paused      bool
+	fallback    *placement
 }
 
 // NewStore represents a new instance of a rediscache storage location
-func NewStore(host, port string) *Store {
+func NewStore(opts Options) *Store {
 	return &Store{
-		Host: host,
-		Port: port,
+		Options: opts,
 	}
 }
 
-// Open populates the pool field of the store if it has not already been set up
-func (s *Store) Open() error {
-	if s.Pool == nil {
-		s.Pool = &redis.Pool{
-			MaxIdle:   80,
-			MaxActive: 12000,
-			Dial: func() (redis.Conn, error) {
-				c, err := redis.Dial("tcp", fmt.Sprintf("%s:%s", s.Host, s.Port))
-				if err != nil {
-					innerErr := fmt.Errorf("failed connecting to redis\n   %w", err)
-					err = innerErr
-				}
-				return c, err
-			},
+// Open populates the pool, or the cluster client when ClusterAddrs is set,
+// if it has not already been set up
+func (s *Store) Open(ctx context.Context) error {
+	if err := s.Options.validate(); err != nil {
+		return fmt.Errorf("[redis] %w", err)
+	}
+	if s.Pool == nil && s.cluster == nil && s.shards == nil {
+		dialOpts, err := s.dialOptions()
+		if err != nil {
+			return fmt.Errorf("[redis] %w", err)
+		}
+		s.dialOpts = dialOpts
+		if len(s.ClusterAddrs) > 0 {
+			cluster, err := s.newCluster()
+			if err != nil {
+				return fmt.Errorf("[redis] connection not established: %w", err)
+			}
+			s.cluster = cluster
+		} else if len(s.Shards) > 0 {
+			s.shards, s.ring = s.newShards()
+		} else {
+			s.Pool = s.newPool(s.dial)
+			if len(s.SentinelAddrs) > 0 {
+				s.Pool.TestOnBorrow = s.testRole
+			}
 		}
 	}
-	if !s.Health() {
+	if !s.Health(ctx) {
 		return fmt.Errorf("[redis] connection not established")
 	}
+	if err := s.Migrate(ctx); err != nil {
+		return fmt.Errorf("[redis] error migrating keys: %w", err)
+	}
+	if _, _, err := s.topologyState(ctx); err != nil {
+		return err
+	}
 	return nil
 }
 
 func (s *Store) Close() error {
+	s.nodesMu.Lock()
+	for _, pool := range s.nodes {
+		pool.Close()
+	}
+	s.nodesMu.Unlock()
+	if s.cluster != nil {
+		return s.cluster.Close()
+	}
+	if s.shards != nil {
+		var firstErr error
+		for _, pool := range s.shards {
+			if err := pool.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
 	return s.Pool.Close()
 }
 
-func (s *Store) Health() bool {
-	conn := s.Pool.Get()
-	data, err := redis.String(conn.Do("PING"))
-	if err != nil || data != "PONG" {
-		return false
+// Health probes every shard, as a link may live on any of them
+func (s *Store) Health(ctx context.Context) bool {
+	return s.Probe(ctx) == nil
+}
+
+// Probe reads the record of the empty short code from every shard. Against
+// Redis Cluster it is read from the node that owns its slot.
+func (s *Store) Probe(ctx context.Context) error {
+	if s.shards == nil {
+		if _, err := s.mget(ctx, "", []interface{}{s.urlKey(""), s.hitsKey("")}); err != nil {
+			return fmt.Errorf("[redis] %w", err)
+		}
+		return nil
+	}
+	for i := range s.shards {
+		conn, err := s.shardConn(ctx, i)
+		if err == nil {
+			_, err = do(ctx, conn, "MGET", s.urlKey(""), s.hitsKey(""))
+			conn.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("[redis] shard %s: %w", s.Shards[i], err)
+		}
 	}
-	return true
+	return nil
 }
 
-func (s *Store) GetURL(shortCode string) (models.URL, error) {
-	data, err := s.getValue(shortCode)
+// GetURL reads the record and its hit counter together
+func (s *Store) GetURL(ctx context.Context, shortCode string) (models.URL, error) {
+	urls, err := s.getURLs(ctx, []string{shortCode})
 	if err != nil {
 		return models.URL{}, err
 	}
-	return models.URL{Destination: data, ShortCode: shortCode}, nil
+	if len(urls) == 0 {
+		return models.URL{}, fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+	}
+	// the reverse mapping has already gone, the record is only kept to
+	// report the link as gone
+	if urls[0].Gone(time.Now()) {
+		return urls[0], fmt.Errorf("%w: %s", data.ErrGone, shortCode)
+	}
+	return urls[0], nil
+}
+
+// GetShortCode follows the reverse mapping and checks the link it points at
+// isn't gone and still has this destination, as a mapping can outlive its
+// link until redis expires it or the destination is shortened again. Pending
+// claims aren't links yet.
+func (s *Store) GetShortCode(ctx context.Context, destination string) (string, error) {
+	shortCode, err := s.getValue(ctx, destination, s.codeKey(destination))
+	if err != nil {
+		return "", err
+	}
+	if isClaim(shortCode) {
+		return "", fmt.Errorf("%w: %s", data.ErrNotFound, destination)
+	}
+	urls, err := s.getURLs(ctx, []string{shortCode})
+	if err != nil {
+		return "", err
+	}
+	if len(urls) == 0 || urls[0].Gone(time.Now()) || urls[0].Destination != destination {
+		return "", fmt.Errorf("%w: %s", data.ErrNotFound, destination)
+	}
+	return shortCode, nil
 }
 
-func (s *Store) GetShortCode(destination string) (string, error) {
-	return s.getValue(destination)
+// List walks the short code keys with SCAN, the cursor being the SCAN cursor.
+// SCAN may hand back a key more than once if the keyspace is resized while
+// it is being walked, and limit is only passed on as a COUNT hint. Shards, or
+// the masters of a cluster, are walked one after another, the cursor then
+// being prefixed with the index of the server it belongs to. A cluster that
+// gains or loses masters during the walk can skip or repeat links.
+func (s *Store) List(ctx context.Context, cursor string, limit int) ([]models.URL, string, error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("%w: %d", data.ErrInvalidLimit, limit)
+	}
+	count, err := s.shardCount(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	shard, cursor, err := s.parseCursor(cursor, count)
+	if err != nil {
+		return nil, "", err
+	}
+	var codes []string
+	for shard < count && len(codes) == 0 {
+		if codes, cursor, err = s.scan(ctx, shard, cursor, limit); err != nil {
+			return nil, "", err
+		}
+		if cursor == "0" {
+			shard, cursor = shard+1, "0"
+		}
+	}
+	next := ""
+	if shard < count {
+		next = s.formatCursor(shard, cursor)
+	}
+	if len(codes) == 0 {
+		return nil, next, nil
+	}
+	urls, err := s.getURLs(ctx, codes)
+	if err != nil {
+		return nil, "", err
+	}
+	return urls, next, nil
+}
+
+// scan runs SCAN on shard until it finds some short codes or reaches the end
+// of the shard, returning the codes and the cursor to carry on from
+func (s *Store) scan(ctx context.Context, shard int, cursor string, limit int) ([]string, string, error) {
+	conn, err := s.shardConn(ctx, shard)
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.Close()
+	var codes []string
+	for {
+		reply, err := redis.Values(do(ctx, conn, "SCAN", cursor, "MATCH", s.urlPattern(), "COUNT", limit))
+		if err != nil {
+			return nil, "", err
+		}
+		var keys []string
+		if _, err = redis.Scan(reply, &cursor, &keys); err != nil {
+			return nil, "", err
+		}
+		for _, key := range keys {
+			codes = append(codes, key[strings.Index(key, ":url:")+len(":url:"):])
+		}
+		if len(codes) > 0 || cursor == "0" {
+			return codes, cursor, nil
+		}
+	}
+}
+
+func (s *Store) parseCursor(cursor string, count int) (int, string, error) {
+	if cursor == "" {
+		return 0, "0", nil
+	}
+	if s.shards == nil && s.cluster == nil {
+		return 0, cursor, nil
+	}
+	i := strings.IndexByte(cursor, ':')
+	if i < 0 {
+		return 0, "", fmt.Errorf("[redis] invalid cursor %q", cursor)
+	}
+	shard, err := strconv.Atoi(cursor[:i])
+	if err != nil || shard < 0 || shard >= count {
+		return 0, "", fmt.Errorf("[redis] invalid cursor %q", cursor)
+	}
+	return shard, cursor[i+1:], nil
+}
+
+func (s *Store) formatCursor(shard int, cursor string) string {
+	if s.shards == nil && s.cluster == nil {
+		return cursor
+	}
+	return strconv.Itoa(shard) + ":" + cursor
+}
+
+// SetURL replaces the mapping for a short code, and the reverse mapping of
+// any destination it used to point at, in a single transaction. A reverse
+// mapping on another shard is taken over once the transaction is done.
+func (s *Store) SetURL(ctx context.Context, url models.URL) error {
+	return s.setURL(ctx, url, false)
+}
+
+// RewriteURL replaces the link like SetURL but leaves its hit counter alone,
+// so clicks counted while the caller held a stale copy are kept
+func (s *Store) RewriteURL(ctx context.Context, url models.URL) error {
+	return s.setURL(ctx, url, true)
+}
+
+func (s *Store) setURL(ctx context.Context, url models.URL, keepHits bool) error {
+	if err := s.writable(ctx); err != nil {
+		return err
+	}
+	conn, err := s.conn(ctx, url.ShortCode)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return s.watchExec(ctx, conn, url.ShortCode, s.urlKey(url.ShortCode), func(value string, found bool) ([]command, error) {
+		var cmds []command
+		var created time.Time
+		if found {
+			old, err := record.Decode(url.ShortCode, []byte(value))
+			if err != nil {
+				return nil, err
+			}
+			if old.Destination != url.Destination || url.Deleted() {
+				unmap, err := s.unmapDestination(ctx, conn, old)
+				if err != nil {
+					return nil, err
+				}
+				cmds = append(cmds, unmap...)
+			}
+			created = old.CreatedAt
+		}
+		url.Stamp(time.Now(), created)
+		encoded, hits, err := s.encode(url)
+		if err != nil {
+			return nil, err
+		}
+		if !found || !keepHits {
+			hitsCmd := command{"DEL", []interface{}{s.hitsKey(url.ShortCode)}, ""}
+			if hits != 0 {
+				hitsCmd = command{"SET", []interface{}{s.hitsKey(url.ShortCode), hits}, ""}
+			}
+			cmds = append(cmds, hitsCmd)
+		}
+		cmds = append(cmds, s.recordCommands(url, encoded)...)
+		if !url.Deleted() && !s.sameShard(url.ShortCode, url.Destination) {
+			cmds = append(cmds, s.reverseCommands(url)...)
+		}
+		return cmds, nil
+	})
 }
 
-func (s *Store) SetURL(shortCode, url string) error {
-	conn := s.Pool.Get()
-	err := conn.Send("SET", url, shortCode)
+// CreateURL runs the existence checks and the writes in one lua script so
+// redis executes them atomically. The destination may only be held by a link
+// that is gone, which the script leaves to the caller to find out. When
+// sharding puts the reverse mapping on another server the destination is
+// claimed there first, and the claim is committed once the script has
+// succeeded.
+func (s *Store) CreateURL(ctx context.Context, url models.URL) error {
+	if err := s.writable(ctx); err != nil {
+		return err
+	}
+	conn, err := s.conn(ctx, url.ShortCode)
 	if err != nil {
 		return err
 	}
-	err = conn.Send("SET", shortCode, url)
+	defer conn.Close()
+	url.Stamp(time.Now(), time.Time{})
+	encoded, hits, err := s.encode(url)
 	if err != nil {
 		return err
 	}
-	err = conn.Flush()
+	recordAt, reverseAt := s.expiry(url)
+	mapTo, reverseKey := url.ShortCode, s.codeKey(url.Destination)
+	// links created gone, tombstones among them, don't hold their
+	// destination
+	holds := !url.Gone(time.Now())
+	remote := holds && !s.sameShard(url.ShortCode, url.Destination)
+	if !holds || remote {
+		mapTo, reverseAt = "", 0
+	}
+	// the script leaves the reverse key alone without a mapping, but Redis
+	// Cluster wants every key it is given in one slot
+	if !s.sameShard(url.ShortCode, url.Destination) {
+		reverseKey = s.hitsKey(url.ShortCode)
+	}
+	if remote {
+		if err := s.claimDestination(ctx, url.ShortCode, url.Destination); err != nil {
+			return err
+		}
+	}
+	stale := ""
+	for attempt := 0; attempt < maxTxAttempts; attempt++ {
+		reply, err := createScript.do(ctx, conn,
+			s.urlKey(url.ShortCode), reverseKey, s.hitsKey(url.ShortCode),
+			mapTo, encoded, hits, recordAt, reverseAt, stale)
+		if holder, ok := reply.([]byte); ok && err == nil {
+			if stale, err = s.staleHolder(ctx, string(holder), url.Destination); err != nil {
+				return err
+			}
+			continue
+		}
+		if created, ok := reply.(int64); ok && err == nil && created == 0 {
+			err = fmt.Errorf("%w: %s", data.ErrExists, url.ShortCode)
+		}
+		if remote {
+			return s.settleClaim(ctx, url, err)
+		}
+		return err
+	}
+	return errTxConflict
+}
+
+// RecordHit reads the record for its MaxClicks and destination, then counts
+// the hit with hitScript, which checks the limit atomically. If the record is
+// replaced in between it is read again. A reverse mapping on another shard is
+// removed after the last click instead of by the script.
+func (s *Store) RecordHit(ctx context.Context, shortCode string) error {
+	if err := s.writable(ctx); err != nil {
+		return err
+	}
+	conn, err := s.conn(ctx, shortCode)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer conn.Close()
+	for {
+		value, err := redis.Bytes(do(ctx, conn, "GET", s.urlKey(shortCode)))
+		if err == redis.ErrNil {
+			return fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+		}
+		if err != nil {
+			return err
+		}
+		u, err := record.Decode(shortCode, value)
+		if err != nil {
+			return err
+		}
+		reverseKey, mappedTo := s.codeKey(u.Destination), shortCode
+		if !s.sameShard(shortCode, u.Destination) {
+			reverseKey, mappedTo = s.hitsKey(shortCode), ""
+		}
+		hits, err := redis.Int64(hitScript.do(ctx, conn,
+			s.urlKey(shortCode), s.hitsKey(shortCode), reverseKey,
+			value, u.MaxClicks, mappedTo))
+		switch {
+		case err == redis.ErrNil:
+			return fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+		case err != nil:
+			return err
+		case hits == -1:
+			return fmt.Errorf("%w: %s", data.ErrGone, shortCode)
+		case hits > 0:
+			if u.MaxClicks > 0 && hits >= u.MaxClicks && !s.sameShard(shortCode, u.Destination) {
+				unmap, err := s.unmapDestination(ctx, conn, u)
+				if err != nil {
+					return err
+				}
+				return s.runRemote(ctx, unmap)
+			}
+			return nil
+		}
+	}
+}
+
+// Delete removes both directions of the mapping and the hit counter in a
+// single transaction
+func (s *Store) Delete(ctx context.Context, shortCode string) error {
+	if err := s.writable(ctx); err != nil {
+		return err
+	}
+	conn, err := s.conn(ctx, shortCode)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return s.watchExec(ctx, conn, shortCode, s.urlKey(shortCode), func(value string, found bool) ([]command, error) {
+		if !found {
+			return nil, fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+		}
+		old, err := record.Decode(shortCode, []byte(value))
+		if err != nil {
+			return nil, err
+		}
+		cmds, err := s.unmapDestination(ctx, conn, old)
+		if err != nil {
+			return nil, err
+		}
+		return append(cmds, command{"DEL", []interface{}{s.urlKey(shortCode), s.hitsKey(shortCode)}, ""}), nil
+	})
 }
 
-func (s *Store) Delete(shortCode string) error {
-	destination, err := s.getValue(shortCode)
+// SoftDelete replaces the record with a tombstone, which redis removes once
+// the quarantine is over
+func (s *Store) SoftDelete(ctx context.Context, shortCode string) error {
+	if err := s.writable(ctx); err != nil {
+		return err
+	}
+	conn, err := s.conn(ctx, shortCode)
 	if err != nil {
 		return err
 	}
-	conn := s.Pool.Get()
-	err = conn.Send("DEL", shortCode, destination)
+	defer conn.Close()
+	return s.watchExec(ctx, conn, shortCode, s.urlKey(shortCode), func(value string, found bool) ([]command, error) {
+		if !found {
+			return nil, fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+		}
+		u, err := record.Decode(shortCode, []byte(value))
+		if err != nil {
+			return nil, err
+		}
+		if u.Deleted() {
+			return nil, fmt.Errorf("%w: %s", data.ErrGone, shortCode)
+		}
+		cmds, err := s.unmapDestination(ctx, conn, u)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		u.DeletedAt, u.UpdatedAt = &now, now
+		encoded, _, err := s.encode(u)
+		if err != nil {
+			return nil, err
+		}
+		return append(cmds, s.recordCommands(u, encoded)...), nil
+	})
+}
+
+// UpdateDestination moves the link and both reverse mappings in one
+// transaction. A new reverse mapping on another shard is claimed before the
+// transaction and committed after it.
+func (s *Store) UpdateDestination(ctx context.Context, shortCode, destination string) (models.URL, error) {
+	if err := s.writable(ctx); err != nil {
+		return models.URL{}, err
+	}
+	conn, err := s.conn(ctx, shortCode)
 	if err != nil {
+		return models.URL{}, err
+	}
+	defer conn.Close()
+	updated := models.URL{ShortCode: shortCode, Destination: destination}
+	claimed := false
+	err = s.watchExec(ctx, conn, shortCode, s.urlKey(shortCode), func(value string, found bool) ([]command, error) {
+		if !found {
+			return nil, fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+		}
+		u, err := record.Decode(shortCode, []byte(value))
+		if err != nil {
+			return nil, err
+		}
+		// the hit count decides whether the link is exhausted
+		hits, err := redis.Int64(do(ctx, conn, "GET", s.hitsKey(shortCode)))
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+		u.Hits = hits
+		now := time.Now()
+		if u.Gone(now) {
+			return nil, fmt.Errorf("%w: %s", data.ErrGone, shortCode)
+		}
+		if claimed, err = s.reserveDestination(ctx, conn, shortCode, destination, claimed); err != nil {
+			return nil, err
+		}
+		var cmds []command
+		if u.Destination != destination {
+			if cmds, err = s.unmapDestination(ctx, conn, u); err != nil {
+				return nil, err
+			}
+		}
+		u.Redirect(destination, now)
+		updated = u
+		encoded, _, err := s.encode(u)
+		if err != nil {
+			return nil, err
+		}
+		return append(cmds, s.recordCommands(u, encoded)...), nil
+	})
+	if claimed {
+		err = s.settleClaim(ctx, updated, err)
+	}
+	if err != nil {
+		return models.URL{}, err
+	}
+	return updated, nil
+}
+
+// Restore brings a tombstone back along with its reverse mapping, which is
+// claimed before the transaction when it lives on another shard
+func (s *Store) Restore(ctx context.Context, shortCode string) error {
+	if err := s.writable(ctx); err != nil {
 		return err
 	}
-	err = conn.Flush()
+	conn, err := s.conn(ctx, shortCode)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer conn.Close()
+	var restored models.URL
+	claimed := false
+	err = s.watchExec(ctx, conn, shortCode, s.urlKey(shortCode), func(value string, found bool) ([]command, error) {
+		if !found {
+			return nil, fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+		}
+		u, err := record.Decode(shortCode, []byte(value))
+		if err != nil {
+			return nil, err
+		}
+		if !u.Deleted() {
+			return nil, nil
+		}
+		if claimed && u.Destination != restored.Destination {
+			// the tombstone was replaced while it was being restored
+			return nil, errTxConflict
+		}
+		if claimed, err = s.reserveDestination(ctx, conn, shortCode, u.Destination, claimed); err != nil {
+			return nil, err
+		}
+		u.DeletedAt, u.UpdatedAt = nil, time.Now()
+		restored = u
+		encoded, _, err := s.encode(u)
+		if err != nil {
+			return nil, err
+		}
+		return s.recordCommands(u, encoded), nil
+	})
+	if claimed {
+		err = s.settleClaim(ctx, restored, err)
+	}
+	return err
+}
+
+// reserveDestination makes sure destination is free for shortCode while
+// building a watchExec transaction. On the shard of the transaction the
+// reverse key is checked with destinationFree and written by the transaction.
+// On another shard it is claimed with claimDestination, unless claimed says
+// an earlier attempt already did, and the caller has to settle the claim. It
+// reports whether there is a claim to settle.
+func (s *Store) reserveDestination(ctx context.Context, conn redis.Conn, shortCode, destination string, claimed bool) (bool, error) {
+	if s.sameShard(shortCode, destination) {
+		return claimed, s.destinationFree(ctx, conn, shortCode, destination)
+	}
+	if claimed {
+		return true, nil
+	}
+	if err := s.claimDestination(ctx, shortCode, destination); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// destinationFree returns ErrDestinationExists if destination is mapped to a code other
+// than shortCode that still holds it. It is called while building a
+// watchExec transaction and WATCHes the reverse key, so the check still holds
+// when the transaction runs. The reverse key has to be on the shard of the
+// transaction.
+func (s *Store) destinationFree(ctx context.Context, conn redis.Conn, shortCode, destination string) error {
+	key := s.codeKey(destination)
+	if _, err := do(ctx, conn, "WATCH", key); err != nil {
+		return err
+	}
+	other, err := redis.String(do(ctx, conn, "GET", key))
+	if err == redis.ErrNil || (err == nil && other == shortCode) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.staleHolder(ctx, other, destination)
+	return err
+}
+
+// recordCommands return the commands writing the encoded record of url and
+// its reverse mapping, then setting the expiry of both and of the hit
+// counter, which is written separately. A reverse mapping on another shard
+// is left to the caller.
+func (s *Store) recordCommands(url models.URL, encoded []byte) []command {
+	cmds := []command{{"SET", []interface{}{s.urlKey(url.ShortCode), encoded}, ""}}
+	if !url.Deleted() && s.sameShard(url.ShortCode, url.Destination) {
+		cmds = append(cmds, s.reverseCommands(url)...)
+	}
+	recordAt, _ := s.expiry(url)
+	if recordAt == 0 {
+		return append(cmds, command{"PERSIST", []interface{}{s.hitsKey(url.ShortCode)}, ""})
+	}
+	return append(cmds,
+		command{"PEXPIREAT", []interface{}{s.urlKey(url.ShortCode), recordAt}, ""},
+		command{"PEXPIREAT", []interface{}{s.hitsKey(url.ShortCode), recordAt}, ""},
+	)
+}
+
+// reverseCommands return the commands mapping the destination of url back to
+// it until the link expires
+func (s *Store) reverseCommands(url models.URL) []command {
+	key := s.codeKey(url.Destination)
+	cmds := []command{{"SET", []interface{}{key, url.ShortCode}, url.Destination}}
+	if _, reverseAt := s.expiry(url); reverseAt != 0 {
+		cmds = append(cmds, command{"PEXPIREAT", []interface{}{key, reverseAt}, url.Destination})
+	}
+	return cmds
+}
+
+// unmapDestination returns the command removing the reverse mapping of u,
+// unless the destination has since been shortened again under another code.
+// It is called while building a watchExec transaction and WATCHes the reverse
+// key too, so the check holds when the transaction runs. A reverse key on
+// another shard can't be watched, so there the check is left to unmapScript,
+// run on that shard once the transaction is done.
+func (s *Store) unmapDestination(ctx context.Context, conn redis.Conn, u models.URL) ([]command, error) {
+	key := s.codeKey(u.Destination)
+	if !s.sameShard(u.ShortCode, u.Destination) {
+		return []command{{"EVAL", []interface{}{unmapScript.src, 1, key, u.ShortCode}, u.Destination}}, nil
+	}
+	if _, err := do(ctx, conn, "WATCH", key); err != nil {
+		return nil, err
+	}
+	current, err := redis.String(do(ctx, conn, "GET", key))
+	if err == redis.ErrNil || (err == nil && current != u.ShortCode) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []command{{"DEL", []interface{}{key}, ""}}, nil
+}
+
+// expiry returns the unix millisecond times at which the record and the
+// reverse mapping of url expire, or zeros if it never does. Tombstones have
+// no reverse mapping and expire at the end of their quarantine.
+func (s *Store) expiry(url models.URL) (recordAt, reverseAt int64) {
+	if url.Deleted() {
+		return url.DeletedAt.Add(s.Quarantine).UnixNano() / int64(time.Millisecond), 0
+	}
+	if url.ExpiresAt == nil {
+		return 0, 0
+	}
+	reverseAt = url.ExpiresAt.UnixNano() / int64(time.Millisecond)
+	recordAt = url.ExpiresAt.Add(s.ExpiredRetention).UnixNano() / int64(time.Millisecond)
+	return recordAt, reverseAt
+}
+
+// encode returns the stored form of url. The hit count lives in its own
+// counter key, so it is returned separately rather than encoded.
+func (s *Store) encode(url models.URL) ([]byte, int64, error) {
+	hits := url.Hits
+	url.Hits = 0
+	encoded, err := record.Encode(url)
+	return encoded, hits, err
 }
 
-func (s *Store) getValue(key string) (string, error) {
-	conn := s.Pool.Get()
-	data, err := redis.String(conn.Do("GET", key))
+// getURLs reads the records of shortCodes along with their hit counters with
+// one MGET per shard, or per slot against Redis Cluster, leaving out any that
+// don't exist. While shards are rebalanced, records that aren't on their
+// shard are looked for under the other shard list too.
+func (s *Store) getURLs(ctx context.Context, shortCodes []string) ([]models.URL, error) {
+	byShard := make(map[int][]int)
+	for i, code := range shortCodes {
+		shard := s.shardOf(code)
+		byShard[shard] = append(byShard[shard], i)
+	}
+	values := make([]interface{}, 2*len(shortCodes))
+	for _, indexes := range byShard {
+		args := make([]interface{}, 0, 2*len(indexes))
+		for _, i := range indexes {
+			args = append(args, s.urlKey(shortCodes[i]), s.hitsKey(shortCodes[i]))
+		}
+		reply, err := s.mget(ctx, shortCodes[indexes[0]], args)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range indexes {
+			values[2*i], values[2*i+1] = reply[2*j], reply[2*j+1]
+		}
+	}
+	if fallback := s.readFallback(ctx); fallback != nil {
+		for i, code := range shortCodes {
+			if values[2*i] != nil {
+				continue
+			}
+			moved, err := s.readMoved(ctx, fallback, code, s.urlKey(code), s.hitsKey(code))
+			if err != nil {
+				return nil, err
+			}
+			if moved != nil {
+				values[2*i], values[2*i+1] = moved[0], moved[1]
+			}
+		}
+	}
+	urls := make([]models.URL, 0, len(shortCodes))
+	for i, code := range shortCodes {
+		value, err := redis.Bytes(values[2*i], nil)
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		u, err := record.Decode(code, value)
+		if err != nil {
+			return nil, err
+		}
+		if values[2*i+1] != nil {
+			if u.Hits, err = redis.Int64(values[2*i+1], nil); err != nil {
+				return nil, err
+			}
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// mget reads keys from the shard that route belongs to
+func (s *Store) mget(ctx context.Context, route string, keys []interface{}) ([]interface{}, error) {
+	conn, err := s.conn(ctx, route)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return redis.Values(do(ctx, conn, "MGET", keys...))
+}
+
+// getValue reads key from the shard that route belongs to, or while shards
+// are rebalanced from its shard under the other shard list
+func (s *Store) getValue(ctx context.Context, route, key string) (string, error) {
+	conn, err := s.conn(ctx, route)
 	if err != nil {
 		return "", err
 	}
-	return data, nil
+	defer conn.Close()
+	value, err := redis.String(do(ctx, conn, "GET", key))
+	if err == redis.ErrNil {
+		if fallback := s.readFallback(ctx); fallback != nil {
+			moved, err := s.readMoved(ctx, fallback, route, key)
+			if err != nil {
+				return "", err
+			}
+			if moved != nil {
+				return redis.String(moved[0], nil)
+			}
+		}
+		return "", fmt.Errorf("%w: %s", data.ErrNotFound, key)
+	}
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// prefix returns the prefix of the keys routed by route. Against Redis
+// Cluster it carries a hash tag made from route, so that the record and hit
+// counter of a short code share a slot while links spread over the cluster.
+// The tag is a hash because route itself may contain braces.
+func (s *Store) prefix(route string) string {
+	if len(s.ClusterAddrs) == 0 {
+		return keyPrefix
+	}
+	return fmt.Sprintf("%s{%08x}:", keyPrefix, crc32.ChecksumIEEE([]byte(route)))
+}
+
+// urlKey maps a short code to its encoded record
+func (s *Store) urlKey(shortCode string) string {
+	return s.prefix(shortCode) + "url:" + shortCode
+}
+
+// hitsKey counts the redirects served for a short code
+func (s *Store) hitsKey(shortCode string) string {
+	return s.prefix(shortCode) + "hits:" + shortCode
+}
+
+// codeKey maps a destination back to its short code
+func (s *Store) codeKey(destination string) string {
+	return s.prefix(destination) + "code:" + destination
+}
+
+// urlPattern matches the record keys of every short code
+func (s *Store) urlPattern() string {
+	if len(s.ClusterAddrs) == 0 {
+		return keyPrefix + "url:*"
+	}
+	return keyPrefix + "{*}:url:*"
+}
+
+// schemaKey holds the layout version of the keys
+func (s *Store) schemaKey() string {
+	if len(s.ClusterAddrs) == 0 {
+		return keyPrefix + "schema"
+	}
+	return legacyClusterPrefix + "schema"
+}
+
+// conn gets a connection to the shard route belongs to. Keys are routed by
+// the short code or destination they are named after, so that a record and
+// its hit counter always share a shard. Cluster connections are bound to
+// the node that owns the slot of route.
+func (s *Store) conn(ctx context.Context, route string) (redis.Conn, error) {
+	if s.cluster != nil {
+		return s.clusterConn(ctx, s.prefix(route))
+	}
+	return s.shardConn(ctx, s.shardOf(route))
+}
+
+// clusterConn gets a cluster connection bound to the node owning key
+func (s *Store) clusterConn(ctx context.Context, key string) (redis.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	conn := s.cluster.Get()
+	if err := redisc.BindConn(conn, key); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// shardConn gets a connection to one of the servers links are spread over,
+// giving up once ctx is done. Without sharding there is only shard 0.
+// Against Redis Cluster the shards are its masters, in the order
+// clusterMasters lists them.
+func (s *Store) shardConn(ctx context.Context, shard int) (redis.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if s.cluster != nil {
+		masters, err := s.clusterMasters(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if shard >= len(masters) {
+			return nil, fmt.Errorf("[redis] cluster has no master %d", shard)
+		}
+		return s.nodePool(masters[shard]).GetContext(ctx)
+	}
+	if s.shards != nil {
+		return s.shards[shard].GetContext(ctx)
+	}
+	return s.Pool.GetContext(ctx)
+}
+
+// shardCount is the number of servers links are spread over
+func (s *Store) shardCount(ctx context.Context) (int, error) {
+	if s.cluster != nil {
+		masters, err := s.clusterMasters(ctx)
+		return len(masters), err
+	}
+	if s.shards != nil {
+		return len(s.shards), nil
+	}
+	return 1, nil
+}
+
+// clusterMasters returns the sorted addresses of the masters serving slots
+func (s *Store) clusterMasters(ctx context.Context) ([]string, error) {
+	conn := s.cluster.Get()
+	defer conn.Close()
+	reply, err := redis.Values(do(ctx, conn, "CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var masters []string
+	for _, r := range reply {
+		slots, err := redis.Values(r, nil)
+		if err != nil || len(slots) < 3 {
+			return nil, fmt.Errorf("[redis] unexpected CLUSTER SLOTS reply: %v", err)
+		}
+		node, err := redis.Values(slots[2], nil)
+		if err != nil || len(node) < 2 {
+			return nil, fmt.Errorf("[redis] unexpected CLUSTER SLOTS reply: %v", err)
+		}
+		host, err := redis.String(node[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		port, err := redis.Int(node[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		if !seen[addr] {
+			seen[addr] = true
+			masters = append(masters, addr)
+		}
+	}
+	sort.Strings(masters)
+	return masters, nil
+}
+
+// nodePool returns the pool of direct connections to the cluster node, or
+// the shard of another shard list, at addr
+func (s *Store) nodePool(addr string) *redis.Pool {
+	s.nodesMu.Lock()
+	defer s.nodesMu.Unlock()
+	if s.nodes == nil {
+		s.nodes = make(map[string]*redis.Pool)
+	}
+	pool, ok := s.nodes[addr]
+	if !ok {
+		pool = s.newPool(func(ctx context.Context) (redis.Conn, error) {
+			return redis.DialContext(ctx, "tcp", addr, s.dialOpts...)
+		})
+		s.nodes[addr] = pool
+	}
+	return pool
+}
+
+// shardOf returns the shard of route, or its slot against Redis Cluster
+func (s *Store) shardOf(route string) int {
+	if len(s.ClusterAddrs) > 0 {
+		return redisc.Slot(s.prefix(route))
+	}
+	if s.ring == nil {
+		return 0
+	}
+	return s.ring.get(route)
+}
+
+// sameShard reports whether the keys routed by a and b live on one server, or
+// in one slot of a cluster, where a transaction or script can cover both
+func (s *Store) sameShard(a, b string) bool {
+	return s.shardOf(a) == s.shardOf(b)
+}
+
+// do runs a single command, bounding it by the deadline of ctx if it has one
+func do(ctx context.Context, conn redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		return redis.DoWithTimeout(conn, time.Until(deadline), cmd, args...)
+	}
+	return conn.Do(cmd, args...)
+}
+
+// maxTxAttempts bounds how often watchExec retries when the watched key keeps
+// changing underneath it
+const maxTxAttempts = 5
+
+var errTxConflict = errors.New("[redis] transaction aborted by concurrent writes")
+
+// command is queued by watchExec. Commands with a route run on the shard of
+// that route; an empty route is the shard of the transaction itself.
+type command struct {
+	name  string
+	args  []interface{}
+	route string
+}
+
+// watchExec runs an optimistic transaction on conn, a connection to the shard
+// of route. It WATCHes key, hands its current value to build and runs the
+// commands build returns inside MULTI/EXEC, so either all of them apply or
+// none do. If key changes before EXEC the whole thing is retried with the new
+// value. An error from build aborts without writing anything; the pool
+// UNWATCHes the connection when it is closed. Commands for other shards can't
+// join the transaction, and run on their own shards once it has succeeded.
+func (s *Store) watchExec(ctx context.Context, conn redis.Conn, route, key string, build func(value string, found bool) ([]command, error)) error {
+	for attempt := 0; attempt < maxTxAttempts; attempt++ {
+		if _, err := do(ctx, conn, "WATCH", key); err != nil {
+			return err
+		}
+		value, err := redis.String(do(ctx, conn, "GET", key))
+		found := err == nil
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+		cmds, err := build(value, found)
+		if err != nil {
+			return err
+		}
+		var local, remote []command
+		for _, cmd := range cmds {
+			if cmd.route == "" || s.sameShard(cmd.route, route) {
+				local = append(local, cmd)
+			} else {
+				remote = append(remote, cmd)
+			}
+		}
+
+		if err = conn.Send("MULTI"); err != nil {
+			return err
+		}
+		for _, cmd := range local {
+			if err = conn.Send(cmd.name, cmd.args...); err != nil {
+				return err
+			}
+		}
+		replies, err := redis.Values(do(ctx, conn, "EXEC"))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, reply := range replies {
+			if e, ok := reply.(redis.Error); ok {
+				return e
+			}
+		}
+		return s.runRemote(ctx, remote)
+	}
+	return errTxConflict
+}
+
+// runRemote runs commands that didn't fit in a transaction on the shards of
+// their routes, in order
+func (s *Store) runRemote(ctx context.Context, cmds []command) error {
+	for _, cmd := range cmds {
+		conn, err := s.conn(ctx, cmd.route)
+		if err != nil {
+			return err
+		}
+		_, err = do(ctx, conn, cmd.name, cmd.args...)
+		conn.Close()
+		if err != nil {
+			return fmt.Errorf("[redis] link written but not its reverse mapping: %w", err)
+		}
+	}
+	return nil
+}
+
+// script is a lua script that is run through do, unlike redis.Script, so that
+// it honours context deadlines too
+type script struct {
+	keyCount int
+	src      string
+	hash     string
+}
+
+func newScript(keyCount int, src string) *script {
+	h := sha1.Sum([]byte(src))
+	return &script{
+		keyCount: keyCount,
+		src:      src,
+		hash:     hex.EncodeToString(h[:]),
+	}
+}
+
+// do runs the script by hash, falling back to sending the source the first
+// time a server sees it
+func (sc *script) do(ctx context.Context, conn redis.Conn, keysAndArgs ...interface{}) (interface{}, error) {
+	args := make([]interface{}, 2+len(keysAndArgs))
+	args[0] = sc.hash
+	args[1] = sc.keyCount
+	copy(args[2:], keysAndArgs)
+	reply, err := do(ctx, conn, "EVALSHA", args...)
+	if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "NOSCRIPT ") {
+		args[0] = sc.src
+		reply, err = do(ctx, conn, "EVAL", args...)
+	}
+	return reply, err
 }
@@ -0,0 +1,678 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package rediscache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+	"github.com/mna/redisc"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/data/models"
+	"github.com/lucasreed/smol/pkg/storage/record"
+	"github.com/lucasreed/smol/pkg/storage/storagetest"
+)
+
+func TestStoreConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) data.StorageReadWrite {
+		server, err := miniredis.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(server.Close)
+
+		store := NewStore(testOptions(server))
+		if err = store.Open(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+func TestShardedStoreConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) data.StorageReadWrite {
+		store, _ := newShardedStore(t, 3)
+		return store
+	})
+}
+
+func TestClusterStoreConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) data.StorageReadWrite {
+		store, _ := newClusterStore(t)
+		return store
+	})
+}
+
+// newClusterStore talks to miniredis as a one node Redis Cluster holding
+// every slot. Its connections refuse commands and transactions spanning
+// slots, as a real cluster does.
+func newClusterStore(t *testing.T) (*Store, *miniredis.Miniredis) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	opts := DefaultOptions()
+	opts.ClusterAddrs = []string{server.Addr()}
+	store := NewStore(opts)
+	store.cluster = &redisc.Cluster{
+		StartupNodes: opts.ClusterAddrs,
+		CreatePool: func(addr string, dialOpts ...redis.DialOption) (*redis.Pool, error) {
+			return &redis.Pool{Dial: func() (redis.Conn, error) {
+				conn, err := redis.Dial("tcp", addr, dialOpts...)
+				if err != nil {
+					return nil, err
+				}
+				return &slotConn{Conn: conn, slot: -1}, nil
+			}}, nil
+		},
+	}
+	if err = store.cluster.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return store, server
+}
+
+// slotConn checks that every command, and every MULTI block, only touches
+// keys in one hash slot
+type slotConn struct {
+	redis.Conn
+	multi bool
+	slot  int
+}
+
+func (c *slotConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if err := c.check(cmd, args); err != nil {
+		return nil, err
+	}
+	return c.Conn.Do(cmd, args...)
+}
+
+func (c *slotConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	if err := c.check(cmd, args); err != nil {
+		return nil, err
+	}
+	return redis.DoWithTimeout(c.Conn, timeout, cmd, args...)
+}
+
+func (c *slotConn) Send(cmd string, args ...interface{}) error {
+	if err := c.check(cmd, args); err != nil {
+		return err
+	}
+	return c.Conn.Send(cmd, args...)
+}
+
+func (c *slotConn) check(cmd string, args []interface{}) error {
+	switch strings.ToUpper(cmd) {
+	case "MULTI":
+		c.multi, c.slot = true, -1
+		return nil
+	case "EXEC", "DISCARD":
+		c.multi = false
+		return nil
+	}
+	if !c.multi {
+		c.slot = -1
+	}
+	for _, key := range commandKeys(cmd, args) {
+		slot := redisc.Slot(key)
+		if c.slot == -1 {
+			c.slot = slot
+		} else if c.slot != slot {
+			return redis.Error(fmt.Sprintf("CROSSSLOT %s touches %s in another slot", cmd, key))
+		}
+	}
+	return nil
+}
+
+// commandKeys returns the keys of the commands the store sends
+func commandKeys(cmd string, args []interface{}) []string {
+	var keys []interface{}
+	switch strings.ToUpper(cmd) {
+	case "DEL", "MGET", "WATCH", "EXISTS":
+		keys = args
+	case "EVAL", "EVALSHA":
+		n, _ := strconv.Atoi(fmt.Sprint(args[1]))
+		keys = args[2 : 2+n]
+	case "SCAN", "CLUSTER", "PING", "AUTH", "SELECT", "UNWATCH", "PUBLISH", "SUBSCRIBE", "UNSUBSCRIBE", "READONLY":
+	default:
+		if len(args) > 0 {
+			keys = args[:1]
+		}
+	}
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i], _ = redis.String(key, nil)
+	}
+	return names
+}
+
+func TestStore_ClusterSlots(t *testing.T) {
+	ctx := context.Background()
+	store, server := newClusterStore(t)
+	defer store.Close()
+	for i := 0; i < 20; i++ {
+		u := models.URL{ShortCode: fmt.Sprintf("code%03d", i), Destination: fmt.Sprintf("https://example.com/%d", i)}
+		if err := store.CreateURL(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.RecordHit(ctx, u.ShortCode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	slots := make(map[int]bool)
+	for _, key := range server.Keys() {
+		slots[redisc.Slot(key)] = true
+	}
+	// 20 records with their hit counters and reverse mappings
+	if len(slots) < 30 {
+		t.Errorf("keys only use %d slots: %v", len(slots), server.Keys())
+	}
+	if store.urlKey("abcd123") != "smol:{"+fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte("abcd123")))+"}:url:abcd123" {
+		t.Errorf("unexpected record key %s", store.urlKey("abcd123"))
+	}
+	if redisc.Slot(store.urlKey("abcd123")) != redisc.Slot(store.hitsKey("abcd123")) {
+		t.Error("a record and its hit counter are in different slots")
+	}
+	urls, next, err := store.List(ctx, "", 100)
+	if err != nil || len(urls) != 20 || next != "" {
+		t.Errorf("List returned %d links, %q, %v want all 20", len(urls), next, err)
+	}
+}
+
+func TestStore_MigrateClusterKeys(t *testing.T) {
+	ctx := context.Background()
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Set("{smol}:schema", "2")
+	encoded, err := record.Encode(models.URL{ShortCode: "abcd123", Destination: "https://example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Set("{smol}:url:abcd123", string(encoded))
+	server.Set("{smol}:hits:abcd123", "3")
+	server.Set("{smol}:code:https://example.com", "abcd123")
+	server.SetTTL("{smol}:code:https://example.com", time.Hour)
+
+	opts := DefaultOptions()
+	opts.ClusterAddrs = []string{server.Addr()}
+	store := NewStore(opts)
+	if err = store.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	u, err := store.GetURL(ctx, "abcd123")
+	if err != nil || u.Destination != "https://example.com" || u.Hits != 3 {
+		t.Errorf("GetURL after migrating returned %+v, %v", u, err)
+	}
+	if code, err := store.GetShortCode(ctx, "https://example.com"); err != nil || code != "abcd123" {
+		t.Errorf("GetShortCode after migrating returned %s, %v", code, err)
+	}
+	if ttl := server.TTL(store.codeKey("https://example.com")); ttl <= 0 {
+		t.Errorf("migrated reverse mapping lost its expiry")
+	}
+	for _, key := range server.Keys() {
+		if strings.HasPrefix(key, "{smol}:") && key != "{smol}:schema" {
+			t.Errorf("legacy key %s left behind", key)
+		}
+	}
+	if v, _ := server.Get("{smol}:schema"); v != strconv.Itoa(schemaVersion) {
+		t.Errorf("schema is %s after migrating", v)
+	}
+}
+
+func TestStore_Shards(t *testing.T) {
+	ctx := context.Background()
+	store, servers := newShardedStore(t, 3)
+	defer store.Close()
+	for i := 0; i < 60; i++ {
+		u := models.URL{ShortCode: fmt.Sprintf("code%03d", i), Destination: fmt.Sprintf("https://example.com/%d", i)}
+		if err := store.CreateURL(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, server := range servers {
+		links := 0
+		for _, key := range server.Keys() {
+			if _, ok := keyRoute(key); ok {
+				links++
+			}
+		}
+		if links == 0 {
+			t.Errorf("shard %d holds no link keys: %v", i, server.Keys())
+		}
+	}
+	for i := 0; i < 60; i++ {
+		code, err := store.GetShortCode(ctx, fmt.Sprintf("https://example.com/%d", i))
+		if err != nil || code != fmt.Sprintf("code%03d", i) {
+			t.Errorf("GetShortCode of link %d returned %s, %v", i, code, err)
+		}
+	}
+
+	var listed int
+	cursor := ""
+	for {
+		urls, next, err := store.List(ctx, cursor, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listed += len(urls)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if listed != 60 {
+		t.Errorf("List walked %d links across the shards, want 60", listed)
+	}
+}
+
+// TestStore_DestinationRaces shortens one destination under many codes at
+// once, which most of them place on another shard than the destination, and
+// points many links at one destination at once. Only one may win each time.
+func TestStore_DestinationRaces(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newShardedStore(t, 3)
+	defer store.Close()
+
+	race := func(n int, write func(i int) error) int {
+		errs := make(chan error, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs <- write(i)
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		won := 0
+		for err := range errs {
+			switch {
+			case err == nil:
+				won++
+			case !errors.Is(err, data.ErrDestinationExists):
+				t.Errorf("losing write returned %v, want ErrDestinationExists", err)
+			}
+		}
+		return won
+	}
+
+	if won := race(20, func(i int) error {
+		return store.CreateURL(ctx, models.URL{ShortCode: fmt.Sprintf("new%02d", i), Destination: "https://example.com/created"})
+	}); won != 1 {
+		t.Errorf("%d links were created for one destination", won)
+	}
+
+	for i := 0; i < 20; i++ {
+		u := models.URL{ShortCode: fmt.Sprintf("old%02d", i), Destination: fmt.Sprintf("https://example.com/%d", i)}
+		if err := store.CreateURL(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if won := race(20, func(i int) error {
+		_, err := store.UpdateDestination(ctx, fmt.Sprintf("old%02d", i), "https://example.com/updated")
+		return err
+	}); won != 1 {
+		t.Errorf("%d links were moved to one destination", won)
+	}
+	code, err := store.GetShortCode(ctx, "https://example.com/updated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, err := store.GetURL(ctx, code); err != nil || u.Destination != "https://example.com/updated" {
+		t.Errorf("destination maps to %s pointing at %s, %v", code, u.Destination, err)
+	}
+}
+
+func TestStore_Rebalance(t *testing.T) {
+	defer func(pause time.Duration) { rebalancePause = pause }(rebalancePause)
+	rebalancePause = 0
+	ctx := context.Background()
+	old, servers := newShardedStore(t, 3)
+	defer old.Close()
+	expires := time.Now().Add(time.Hour)
+	for i := 0; i < 60; i++ {
+		u := models.URL{ShortCode: fmt.Sprintf("code%03d", i), Destination: fmt.Sprintf("https://example.com/%d", i), Hits: int64(i)}
+		if i%2 == 0 {
+			u.ExpiresAt = &expires
+		}
+		if err := old.SetURL(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a shard is added and another removed
+	added, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer added.Close()
+	opts := DefaultOptions()
+	opts.Shards = []string{servers[2].Addr(), added.Addr(), servers[0].Addr()}
+	store := NewStore(opts)
+	if err := store.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	check := func(when string) {
+		for i := 0; i < 60; i++ {
+			u, err := store.GetURL(ctx, fmt.Sprintf("code%03d", i))
+			if err != nil || u.Hits != int64(i) {
+				t.Errorf("%s: GetURL of link %d returned %+v, %v", when, i, u, err)
+			}
+			code, err := store.GetShortCode(ctx, fmt.Sprintf("https://example.com/%d", i))
+			if err != nil || code != fmt.Sprintf("code%03d", i) {
+				t.Errorf("%s: GetShortCode of link %d returned %s, %v", when, i, code, err)
+			}
+		}
+	}
+	check("before rebalancing")
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "new", Destination: "https://example.com/new"}); !errors.Is(err, data.ErrUnavailable) {
+		t.Errorf("CreateURL returned %v before rebalancing, want ErrUnavailable", err)
+	}
+
+	moved, err := store.Rebalance(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved == 0 {
+		t.Error("Rebalance moved no keys")
+	}
+	check("after rebalancing")
+	for _, key := range servers[1].Keys() {
+		if _, ok := keyRoute(key); ok {
+			t.Errorf("removed shard still holds %s", key)
+		}
+	}
+	for _, server := range []*miniredis.Miniredis{servers[0], servers[2], added} {
+		for _, key := range server.Keys() {
+			route, ok := keyRoute(key)
+			if ok && store.Shards[store.shardOf(route)] != server.Addr() {
+				t.Errorf("%s is on %s, not its shard", key, server.Addr())
+			}
+		}
+	}
+	if ttl := added.TTL("smol:url:code000") + servers[0].TTL("smol:url:code000") + servers[2].TTL("smol:url:code000"); ttl <= 0 {
+		t.Errorf("code000 lost its expiry when moved")
+	}
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "new", Destination: "https://example.com/new"}); err != nil {
+		t.Errorf("CreateURL returned %v after rebalancing", err)
+	}
+
+	// an instance still running with the old list stops writing
+	old.topoChecked = time.Time{}
+	if err := old.Delete(ctx, "code001"); !errors.Is(err, data.ErrUnavailable) {
+		t.Errorf("Delete with the old list returned %v, want ErrUnavailable", err)
+	}
+	if moved, err = store.Rebalance(ctx); err != nil || moved != 0 {
+		t.Errorf("second Rebalance moved %d keys, %v", moved, err)
+	}
+}
+
+func newShardedStore(t *testing.T, n int) (*Store, []*miniredis.Miniredis) {
+	opts := DefaultOptions()
+	servers := make([]*miniredis.Miniredis, n)
+	for i := range servers {
+		server, err := miniredis.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(server.Close)
+		servers[i] = server
+		opts.Shards = append(opts.Shards, server.Addr())
+	}
+	store := NewStore(opts)
+	if err := store.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return store, servers
+}
+
+func TestStore_MigrateLegacyKeys(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	for k, v := range map[string]string{
+		"abcd123":             "https://example.com",
+		"https://example.com": "abcd123",
+		"unrelated":           "value",
+	} {
+		if err = server.Set(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	store := NewStore(testOptions(server))
+	if err = store.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	u, err := store.GetURL(ctx, "abcd123")
+	if err != nil {
+		t.Fatalf("GetURL after migration: %v", err)
+	}
+	if u.Destination != "https://example.com" {
+		t.Errorf("GetURL returned %s after migration, want https://example.com", u.Destination)
+	}
+	code, err := store.GetShortCode(ctx, "https://example.com")
+	if err != nil {
+		t.Fatalf("GetShortCode after migration: %v", err)
+	}
+	if code != "abcd123" {
+		t.Errorf("GetShortCode returned %s after migration, want abcd123", code)
+	}
+	for _, k := range []string{"abcd123", "https://example.com"} {
+		if server.Exists(k) {
+			t.Errorf("legacy key %s still exists after migration", k)
+		}
+	}
+	if v, err := server.Get("unrelated"); err != nil || v != "value" {
+		t.Errorf("unrelated key was modified by migration: %q, %v", v, err)
+	}
+}
+
+func TestStore_AuthAndDatabase(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.RequireUserAuth("smol", "secret")
+
+	ctx := context.Background()
+	opts := testOptions(server)
+	opts.Username = "smol"
+	opts.Password = "wrong"
+	if err = NewStore(opts).Open(ctx); err == nil {
+		t.Fatal("Open succeeded with the wrong password")
+	}
+
+	opts.Password = "secret"
+	opts.DB = 2
+	store := NewStore(opts)
+	if err = store.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err = store.SetURL(ctx, models.URL{ShortCode: "abcd123", Destination: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := server.DB(2).Get(store.codeKey("https://example.com")); err != nil || v != "abcd123" {
+		t.Errorf("mapping not written to database 2: %q, %v", v, err)
+	}
+}
+
+func TestStore_ExpiresKeys(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ctx := context.Background()
+	store := NewStore(testOptions(server))
+	if err = store.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	expires := time.Now().Add(time.Hour)
+	if err = store.CreateURL(ctx, models.URL{ShortCode: "abcd123", Destination: "https://example.com", ExpiresAt: &expires}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.RecordHit(ctx, "abcd123"); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]time.Duration{
+		store.codeKey("https://example.com"): time.Hour,
+		store.urlKey("abcd123"):              time.Hour + store.ExpiredRetention,
+		store.hitsKey("abcd123"):             time.Hour + store.ExpiredRetention,
+	} {
+		if ttl := server.TTL(key); ttl < want-time.Minute || ttl > want {
+			t.Errorf("%s expires in %v, want %v", key, ttl, want)
+		}
+	}
+
+	// the reverse mapping expires first, leaving the record to report the
+	// link as gone until the retention period is over
+	server.FastForward(time.Hour)
+	if server.Exists(store.codeKey("https://example.com")) || !server.Exists(store.urlKey("abcd123")) {
+		t.Error("reverse mapping should expire with the link and the record be retained")
+	}
+	server.FastForward(store.ExpiredRetention)
+	if server.Exists(store.urlKey("abcd123")) || server.Exists(store.hitsKey("abcd123")) {
+		t.Error("record should expire after the retention period")
+	}
+}
+
+func TestStore_TombstoneExpires(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ctx := context.Background()
+	store := NewStore(testOptions(server))
+	if err = store.Open(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err = store.CreateURL(ctx, models.URL{ShortCode: "abcd123", Destination: "https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.RecordHit(ctx, "abcd123"); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.SoftDelete(ctx, "abcd123"); err != nil {
+		t.Fatal(err)
+	}
+	if server.Exists(store.codeKey("https://example.com")) {
+		t.Error("reverse mapping should be removed with the link")
+	}
+	for _, key := range []string{store.urlKey("abcd123"), store.hitsKey("abcd123")} {
+		if ttl := server.TTL(key); ttl < store.Quarantine-time.Minute || ttl > store.Quarantine {
+			t.Errorf("%s expires in %v, want %v", key, ttl, store.Quarantine)
+		}
+	}
+
+	if err = store.Restore(ctx, "abcd123"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{store.urlKey("abcd123"), store.hitsKey("abcd123")} {
+		if ttl := server.TTL(key); ttl != 0 {
+			t.Errorf("%s still expires in %v after restoring", key, ttl)
+		}
+	}
+	u, err := store.GetURL(ctx, "abcd123")
+	if err != nil || u.Hits != 1 {
+		t.Errorf("GetURL after restoring returned %+v, %v, want the link with its hit", u, err)
+	}
+}
+
+func testOptions(server *miniredis.Miniredis) Options {
+	opts := DefaultOptions()
+	opts.Host = server.Host()
+	opts.Port = server.Port()
+	return opts
+}
+
+func TestStore_PublishSubscribe(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	store := NewStore(testOptions(server))
+	if err = store.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan string, 1)
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- store.Subscribe(ctx, "smol:test", func(payload []byte) { received <- string(payload) })
+	}()
+	// miniredis drops messages published before the subscription lands
+	deadline := time.Now().Add(time.Second)
+	for len(server.PubSubChannels("smol:test")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err = store.Publish(context.Background(), "smol:test", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received:
+		if msg != "hello" {
+			t.Errorf("Subscribe received %q, want hello", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Subscribe received nothing")
+	}
+
+	cancel()
+	select {
+	case err = <-stopped:
+		if err != context.Canceled {
+			t.Errorf("Subscribe returned %v after cancel, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Subscribe didn't return after cancel")
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package rediscache
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// ringReplicas is how many points each node gets on the ring. More points
+// spread keys more evenly at the cost of a larger table to search.
+const ringReplicas = 160
+
+// ring assigns keys to nodes by consistent hashing. Every node is hashed to
+// ringReplicas points on a circle and a key belongs to the node owning the
+// first point at or after the key's own hash. Adding a node only takes over
+// the keys just before its points, and removing one only hands its keys to
+// the next points along, so every other key stays where it was. Nodes are
+// placed by name, so the order they are listed in doesn't matter.
+type ring struct {
+	points []uint32
+	owners map[uint32]int
+}
+
+func newRing(nodes []string) *ring {
+	r := &ring{owners: make(map[uint32]int, len(nodes)*ringReplicas)}
+	for i, node := range nodes {
+		for j := 0; j < ringReplicas; j++ {
+			point := crc32.ChecksumIEEE([]byte(node + "#" + strconv.Itoa(j)))
+			// on the rare collision the point goes to whichever node
+			// sorts first, so that every process agrees on it
+			if owner, ok := r.owners[point]; ok {
+				if node < nodes[owner] {
+					r.owners[point] = i
+				}
+				continue
+			}
+			r.points = append(r.points, point)
+			r.owners[point] = i
+		}
+	}
+	sort.Slice(r.points, func(a, b int) bool { return r.points[a] < r.points[b] })
+	return r
+}
+
+// get returns the index of the node key belongs to
+func (r *ring) get(key string) int {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package rediscache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	nodes := []string{"10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379"}
+	r := newRing(nodes)
+	const keys = 30000
+	counts := make([]int, len(nodes))
+	before := make([]string, keys)
+	for i := 0; i < keys; i++ {
+		node := r.get(fmt.Sprintf("code%d", i))
+		counts[node]++
+		before[i] = nodes[node]
+	}
+	for i, n := range counts {
+		if n < keys/len(nodes)*7/10 || n > keys/len(nodes)*13/10 {
+			t.Errorf("%s owns %d of %d keys", nodes[i], n, keys)
+		}
+	}
+
+	// listing the nodes in another order changes nothing
+	reordered := newRing([]string{nodes[2], nodes[0], nodes[1]})
+	for i := 0; i < keys; i++ {
+		if got := []string{nodes[2], nodes[0], nodes[1]}[reordered.get(fmt.Sprintf("code%d", i))]; got != before[i] {
+			t.Fatalf("code%d moved from %s to %s when the nodes were reordered", i, before[i], got)
+		}
+	}
+
+	// a new node only takes keys, it never shuffles them between the others
+	grown := append(append([]string{}, nodes...), "10.0.0.4:6379")
+	r = newRing(grown)
+	moved := 0
+	for i := 0; i < keys; i++ {
+		after := grown[r.get(fmt.Sprintf("code%d", i))]
+		if after == before[i] {
+			continue
+		}
+		if after != "10.0.0.4:6379" {
+			t.Fatalf("code%d moved from %s to %s", i, before[i], after)
+		}
+		moved++
+	}
+	if moved < keys/4*7/10 || moved > keys/4*13/10 {
+		t.Errorf("adding a fourth node moved %d of %d keys, want about a quarter", moved, keys)
+	}
+}
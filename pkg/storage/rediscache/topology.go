@@ -0,0 +1,409 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package rediscache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/lucasreed/smol/pkg/data"
+)
+
+// topologyKey holds the shard list keys are placed by, on every shard
+const topologyKey = keyPrefix + "topology"
+
+// topologyRefresh is how often a sharded Store reads the stored topology
+// again, so that it notices a rebalance started elsewhere
+const topologyRefresh = 5 * time.Second
+
+// rebalancePause is how long Rebalance waits between announcing a new shard
+// list and moving keys, so that every running instance has paused its writes
+var rebalancePause = 2 * topologyRefresh
+
+var errRebalancing = fmt.Errorf("[redis] %w: shards are being rebalanced", data.ErrUnavailable)
+
+// topology is stored in topologyKey. Next is set while Rebalance moves keys
+// from the placement of Shards to that of Next.
+type topology struct {
+	Shards []string `json:"shards"`
+	Next   []string `json:"next,omitempty"`
+}
+
+// placement places keys by a shard list other than Shards
+type placement struct {
+	addrs []string
+	ring  *ring
+}
+
+func newPlacement(addrs []string) *placement {
+	return &placement{addrs: addrs, ring: newRing(addrs)}
+}
+
+// addr returns the address of the shard route belongs to
+func (p *placement) addr(route string) string {
+	return p.addrs[p.ring.get(route)]
+}
+
+// topologyState returns whether writes are paused because the stored
+// topology differs from Shards, and if so the placement of the other list,
+// which reads fall back to for keys that haven't been moved yet. The stored
+// topology is read again once topologyRefresh has passed; when that fails
+// the last known state is kept and the error returned.
+func (s *Store) topologyState(ctx context.Context) (bool, *placement, error) {
+	if s.shards == nil {
+		return false, nil, nil
+	}
+	s.topoMu.Lock()
+	defer s.topoMu.Unlock()
+	var err error
+	if time.Since(s.topoChecked) >= topologyRefresh {
+		s.topoChecked = time.Now()
+		err = s.loadTopology(ctx)
+	}
+	return s.paused, s.fallback, err
+}
+
+// loadTopology reads the topology stored on every shard. A Store whose
+// shards have none yet stores Shards there. Writes are paused when any shard
+// stores another list, has a rebalance in progress or, having been added
+// without one, stores nothing.
+func (s *Store) loadTopology(ctx context.Context) error {
+	want := sortedShards(s.Shards)
+	stored := make([]*topology, len(s.shards))
+	found := false
+	for i := range s.shards {
+		t, err := s.readTopology(ctx, s.Shards[i])
+		if err != nil {
+			return fmt.Errorf("[redis] shard %s: %w", s.Shards[i], err)
+		}
+		stored[i], found = t, found || t != nil
+	}
+	if !found {
+		encoded, err := json.Marshal(topology{Shards: want})
+		if err != nil {
+			return err
+		}
+		for _, addr := range s.Shards {
+			if err = s.writeTopology(ctx, addr, encoded, "NX"); err != nil {
+				return err
+			}
+		}
+		s.paused, s.fallback = false, nil
+		return nil
+	}
+	paused := false
+	var other []string
+	for _, t := range stored {
+		switch {
+		case t == nil:
+			paused = true
+		case !equalShards(t.Shards, want):
+			paused = true
+			if other == nil {
+				other = t.Shards
+			}
+		case t.Next != nil:
+			paused = true
+			if other == nil {
+				other = t.Next
+			}
+		}
+	}
+	s.paused, s.fallback = paused, nil
+	if other != nil {
+		s.fallback = newPlacement(other)
+	}
+	return nil
+}
+
+// readTopology returns the topology stored on the shard at addr, or nil
+func (s *Store) readTopology(ctx context.Context, addr string) (*topology, error) {
+	conn, err := s.addrConn(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	value, err := redis.Bytes(do(ctx, conn, "GET", topologyKey))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var t topology
+	if err = json.Unmarshal(value, &t); err != nil {
+		return nil, fmt.Errorf("[redis] bad topology %q: %w", value, err)
+	}
+	return &t, nil
+}
+
+// writeTopology stores an encoded topology on the shard at addr
+func (s *Store) writeTopology(ctx context.Context, addr string, encoded []byte, args ...interface{}) error {
+	conn, err := s.addrConn(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = do(ctx, conn, "SET", append([]interface{}{topologyKey, encoded}, args...)...)
+	return err
+}
+
+// writable returns an error wrapping data.ErrUnavailable while writes are
+// paused for a rebalance
+func (s *Store) writable(ctx context.Context) error {
+	paused, _, err := s.topologyState(ctx)
+	if err != nil {
+		return err
+	}
+	if paused {
+		return errRebalancing
+	}
+	return nil
+}
+
+// readFallback returns the placement reads fall back to while keys are
+// rebalanced. A failure to read the topology again is left to the read
+// itself to run into.
+func (s *Store) readFallback(ctx context.Context) *placement {
+	_, fallback, _ := s.topologyState(ctx)
+	return fallback
+}
+
+// readMoved reads keys routed by route, missing from their shard, from the
+// shard of route under the fallback placement. Their shard is read once
+// more after that, since a move writes the new copy before deleting the old
+// one, so a key moved in between is still found. It returns nil if the
+// first key isn't there either.
+func (s *Store) readMoved(ctx context.Context, fallback *placement, route string, keys ...interface{}) ([]interface{}, error) {
+	addr := fallback.addr(route)
+	if addr == s.Shards[s.shardOf(route)] {
+		return nil, nil
+	}
+	conn, err := s.addrConn(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	values, err := redis.Values(do(ctx, conn, "MGET", keys...))
+	conn.Close()
+	if err != nil || values[0] != nil {
+		return values, err
+	}
+	if values, err = s.mget(ctx, route, keys); err != nil || values[0] != nil {
+		return values, err
+	}
+	return nil, nil
+}
+
+// Rebalance moves every key onto the shard it belongs to under Shards, once
+// the shard list has changed. The change is first stored on every shard of
+// the old and new lists, so that running instances pause their writes and
+// read from both placements, and Rebalance waits for them to notice before
+// moving any key. Once every key is in place Shards is stored as the
+// topology, which lets writes resume everywhere the new list is used. It can
+// be run again after a partial run. It returns the number of keys moved.
+func (s *Store) Rebalance(ctx context.Context) (int, error) {
+	if s.shards == nil {
+		return 0, fmt.Errorf("[redis] only a list of shards can be rebalanced")
+	}
+	want := sortedShards(s.Shards)
+	sources := make(map[string]bool)
+	var old []string
+	settled := true
+	for _, addr := range s.Shards {
+		sources[addr] = true
+		t, err := s.readTopology(ctx, addr)
+		if err != nil {
+			return 0, fmt.Errorf("[redis] shard %s: %w", addr, err)
+		}
+		if t == nil || !equalShards(t.Shards, want) || t.Next != nil {
+			settled = false
+		}
+		if t == nil {
+			continue
+		}
+		for _, addr := range t.Shards {
+			sources[addr] = true
+		}
+		for _, addr := range t.Next {
+			sources[addr] = true
+		}
+		if old == nil && !equalShards(t.Shards, want) {
+			old = t.Shards
+		}
+	}
+	if settled {
+		return 0, nil
+	}
+	if old == nil {
+		// only shards without a topology, or an interrupted rebalance to
+		// this same list
+		old = want
+	}
+
+	encoded, err := json.Marshal(topology{Shards: old, Next: want})
+	if err != nil {
+		return 0, err
+	}
+	for addr := range sources {
+		if err = s.writeTopology(ctx, addr, encoded); err != nil {
+			return 0, fmt.Errorf("[redis] shard %s: %w", addr, err)
+		}
+	}
+	select {
+	case <-time.After(rebalancePause):
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	target := newPlacement(want)
+	moved := 0
+	for addr := range sources {
+		n, err := s.moveShard(ctx, addr, target)
+		moved += n
+		if err != nil {
+			return moved, fmt.Errorf("[redis] shard %s: %w", addr, err)
+		}
+	}
+
+	if encoded, err = json.Marshal(topology{Shards: want}); err != nil {
+		return moved, err
+	}
+	for addr := range sources {
+		if contains(want, addr) {
+			err = s.writeTopology(ctx, addr, encoded)
+		} else {
+			err = s.deleteTopology(ctx, addr)
+		}
+		if err != nil {
+			return moved, fmt.Errorf("[redis] shard %s: %w", addr, err)
+		}
+	}
+	s.topoMu.Lock()
+	s.topoChecked = time.Time{}
+	s.topoMu.Unlock()
+	return moved, nil
+}
+
+// moveShard moves the keys on the shard at addr that belong elsewhere under
+// target, returning how many it moved
+func (s *Store) moveShard(ctx context.Context, addr string, target *placement) (int, error) {
+	from, err := s.addrConn(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	defer from.Close()
+	moved := 0
+	cursor := "0"
+	for {
+		reply, err := redis.Values(do(ctx, from, "SCAN", cursor, "MATCH", keyPrefix+"*", "COUNT", 1000))
+		if err != nil {
+			return moved, err
+		}
+		var keys []string
+		if _, err = redis.Scan(reply, &cursor, &keys); err != nil {
+			return moved, err
+		}
+		for _, key := range keys {
+			route, ok := keyRoute(key)
+			if !ok || target.addr(route) == addr {
+				continue
+			}
+			to, err := s.addrConn(ctx, target.addr(route))
+			if err != nil {
+				return moved, err
+			}
+			err = moveKey(ctx, from, to, key, key)
+			to.Close()
+			if err != nil {
+				return moved, err
+			}
+			moved++
+		}
+		if cursor == "0" {
+			return moved, nil
+		}
+	}
+}
+
+// deleteTopology removes the topology from a shard that has left the list
+func (s *Store) deleteTopology(ctx context.Context, addr string) error {
+	conn, err := s.addrConn(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = do(ctx, conn, "DEL", topologyKey)
+	return err
+}
+
+// keyRoute returns the short code or destination a sharded key is routed by
+func keyRoute(key string) (string, bool) {
+	name := strings.TrimPrefix(key, keyPrefix)
+	for _, kind := range []string{"url:", "hits:", "code:"} {
+		if strings.HasPrefix(name, kind) {
+			return strings.TrimPrefix(name, kind), true
+		}
+	}
+	return "", false
+}
+
+// addrConn gets a connection to the shard at addr, which need not be one of
+// Shards
+func (s *Store) addrConn(ctx context.Context, addr string) (redis.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for i, shard := range s.Shards {
+		if shard == addr {
+			return s.shards[i].GetContext(ctx)
+		}
+	}
+	return s.nodePool(addr).GetContext(ctx)
+}
+
+func sortedShards(shards []string) []string {
+	sorted := append([]string(nil), shards...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// equalShards reports whether two shard lists name the same servers
+func equalShards(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = sortedShards(a), sortedShards(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// migrations are applied in order and must never be edited once released.
+// The number of applied migrations is tracked in PRAGMA user_version.
+var migrations = []string{
+	// 1: initial schema
+	`CREATE TABLE urls (
+		short_code  TEXT NOT NULL,
+		destination TEXT NOT NULL
+	);
+	CREATE UNIQUE INDEX urls_short_code ON urls (short_code);
+	CREATE UNIQUE INDEX urls_destination ON urls (destination);`,
+	// 2: link metadata. sqlite can't add a column with a non-constant
+	// default, so the timestamps of rows from before this are NULL.
+	`ALTER TABLE urls ADD COLUMN created_at TIMESTAMP;
+	ALTER TABLE urls ADD COLUMN updated_at TIMESTAMP;
+	ALTER TABLE urls ADD COLUMN creator TEXT NOT NULL DEFAULT '';
+	ALTER TABLE urls ADD COLUMN title TEXT NOT NULL DEFAULT '';
+	ALTER TABLE urls ADD COLUMN hits INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE urls ADD COLUMN labels TEXT NOT NULL DEFAULT '{}';`,
+	// 3: expiring links
+	`ALTER TABLE urls ADD COLUMN expires_at TIMESTAMP;
+	CREATE INDEX urls_expires_at ON urls (expires_at) WHERE expires_at IS NOT NULL;`,
+	// 4: links limited to a number of clicks
+	`ALTER TABLE urls ADD COLUMN max_clicks INTEGER NOT NULL DEFAULT 0;`,
+	// 5: tombstones. A deleted link keeps its short code but not its
+	// destination, which only has to be unique among live links.
+	`ALTER TABLE urls ADD COLUMN deleted_at TIMESTAMP;
+	DROP INDEX urls_destination;
+	CREATE UNIQUE INDEX urls_destination ON urls (destination) WHERE deleted_at IS NULL;
+	CREATE INDEX urls_deleted_at ON urls (deleted_at) WHERE deleted_at IS NOT NULL;`,
+	// 6: past destinations
+	`ALTER TABLE urls ADD COLUMN revisions TEXT NOT NULL DEFAULT '[]';`,
+	// 7: links that expired or used up their clicks give up their
+	// destination, rather than being deleted, once it is shortened again
+	`ALTER TABLE urls ADD COLUMN released INTEGER NOT NULL DEFAULT 0;
+	DROP INDEX urls_destination;
+	CREATE UNIQUE INDEX urls_destination ON urls (destination) WHERE deleted_at IS NULL AND NOT released;`,
+}
+
+func migrate(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var current int
+	if err = tx.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&current); err != nil {
+		return err
+	}
+	for i := current; i < len(migrations); i++ {
+		if _, err = tx.ExecContext(ctx, migrations[i]); err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	// register the pure Go sqlite driver with database/sql, so that sqlite
+	// works in binaries built without cgo
+	_ "modernc.org/sqlite"
+
+	"github.com/lucasreed/smol/pkg/storage/sqlstore"
+)
+
+// Store represents a sqlite storage location
+type Store struct {
+	sqlstore.Store
+	Path string
+}
+
+// NewStore represents a new instance of a sqlite storage location
+func NewStore(path string) *Store {
+	return &Store{
+		Store: sqlstore.NewStore(sqlstore.Dialect{Name: "sqlite"}),
+		Path:  path,
+	}
+}
+
+// Open creates the database file if needed and applies any outstanding schema
+// migrations. Times are written in the same text format as before the switch
+// to a pure Go driver, so existing files keep comparing correctly.
+func (s *Store) Open(ctx context.Context) error {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_time_format=sqlite", s.Path))
+	if err != nil {
+		return err
+	}
+	if err = db.PingContext(ctx); err != nil {
+		_ = db.Close()
+		return fmt.Errorf("[sqlite] error opening database: %w", err)
+	}
+	s.DB = db
+
+	if err = migrate(ctx, db); err != nil {
+		return fmt.Errorf("[sqlite] error migrating schema: %w", err)
+	}
+	return nil
+}
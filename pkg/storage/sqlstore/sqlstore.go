@@ -0,0 +1,529 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+// Package sqlstore implements storage on a SQL database. The postgres and
+// sqlite backends wrap it with their driver, their dialect and their schema
+// migrations.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/data/models"
+)
+
+// Dialect describes what the shared queries need to know about a database
+type Dialect struct {
+	// Name prefixes errors, such as "postgres"
+	Name string
+	// Rebind rewrites the ? placeholders of a query for the driver. Nil
+	// keeps them as they are.
+	Rebind func(query string) string
+	// LockRow is appended to the SELECT of a row that the same transaction
+	// goes on to update
+	LockRow string
+}
+
+// Store runs the shared queries against DB. Times are always written in UTC,
+// which sqlite needs to compare them correctly as text.
+type Store struct {
+	DB      *sql.DB
+	Dialect Dialect
+}
+
+// NewStore returns a Store speaking dialect, to be opened by the backend
+func NewStore(dialect Dialect) Store {
+	return Store{Dialect: dialect}
+}
+
+func (s *Store) Close() error {
+	return s.DB.Close()
+}
+
+func (s *Store) Health(ctx context.Context) bool {
+	return s.Probe(ctx) == nil
+}
+
+// Probe queries the urls table for the empty short code, catching a missing
+// table or a locked database that a ping wouldn't
+func (s *Store) Probe(ctx context.Context) error {
+	if s.DB == nil {
+		return fmt.Errorf("[%s] database not open", s.Dialect.Name)
+	}
+	if _, err := s.GetURL(ctx, ""); err != nil && !errors.Is(err, data.ErrNotFound) {
+		return fmt.Errorf("[%s] probe failed: %w", s.Dialect.Name, err)
+	}
+	return nil
+}
+
+func (s *Store) GetURL(ctx context.Context, shortCode string) (models.URL, error) {
+	u, err := scanURL(s.DB.QueryRowContext(ctx, s.q(`SELECT `+urlColumns+` FROM urls WHERE short_code = ?`), shortCode))
+	if err == sql.ErrNoRows {
+		return models.URL{}, fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+	}
+	if err != nil {
+		return models.URL{}, err
+	}
+	if u.Gone(time.Now()) {
+		return u, fmt.Errorf("%w: %s", data.ErrGone, shortCode)
+	}
+	return u, nil
+}
+
+func (s *Store) GetShortCode(ctx context.Context, destination string) (string, error) {
+	var shortCode string
+	err := s.DB.QueryRowContext(ctx, s.q(`
+		SELECT short_code FROM urls
+		WHERE destination = ? AND (expires_at IS NULL OR expires_at > ?)
+			AND (max_clicks = 0 OR hits < max_clicks) AND deleted_at IS NULL`),
+		destination, time.Now().UTC()).Scan(&shortCode)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("%w: %s", data.ErrNotFound, destination)
+	}
+	if err != nil {
+		return "", err
+	}
+	return shortCode, nil
+}
+
+// List pages through the table by short code, the cursor being the last code
+// of the previous page
+func (s *Store) List(ctx context.Context, cursor string, limit int) ([]models.URL, string, error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("%w: %d", data.ErrInvalidLimit, limit)
+	}
+	rows, err := s.DB.QueryContext(ctx, s.q(`
+		SELECT `+urlColumns+` FROM urls
+		WHERE short_code > ? ORDER BY short_code LIMIT ?`),
+		cursor, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	var urls []models.URL
+	for rows.Next() {
+		u, err := scanURL(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		urls = append(urls, u)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(urls) > limit {
+		urls = urls[:limit]
+		next = urls[limit-1].ShortCode
+	}
+	return urls, next, nil
+}
+
+// SetURL upserts the record. A zero CreatedAt is passed as NULL so that an
+// overwrite keeps the time the code was first stored.
+func (s *Store) SetURL(ctx context.Context, url models.URL) error {
+	return s.setURL(ctx, url, false)
+}
+
+// RewriteURL upserts the record like SetURL, but an overwrite keeps the
+// stored hit count. It is read in the same statement that writes the record,
+// so hits counted concurrently aren't lost.
+func (s *Store) RewriteURL(ctx context.Context, url models.URL) error {
+	return s.setURL(ctx, url, true)
+}
+
+func (s *Store) setURL(ctx context.Context, url models.URL, keepHits bool) error {
+	labels, revisions, err := encodeJSON(url)
+	if err != nil {
+		return err
+	}
+	var created interface{}
+	if !url.CreatedAt.IsZero() {
+		created = url.CreatedAt.UTC()
+	}
+	url.Stamp(time.Now(), time.Time{})
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if err = s.releaseDestination(ctx, tx, url); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, s.q(`
+		INSERT INTO urls (`+urlColumns+`, released)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (short_code) DO UPDATE SET
+			destination = excluded.destination,
+			created_at = COALESCE(?, urls.created_at, excluded.created_at),
+			updated_at = excluded.updated_at,
+			creator = excluded.creator,
+			title = excluded.title,
+			hits = CASE WHEN ? THEN urls.hits ELSE excluded.hits END,
+			labels = excluded.labels,
+			expires_at = excluded.expires_at,
+			max_clicks = excluded.max_clicks,
+			deleted_at = excluded.deleted_at,
+			revisions = excluded.revisions,
+			released = excluded.released`),
+		url.ShortCode, url.Destination, url.CreatedAt.UTC(), url.UpdatedAt.UTC(), url.Creator, url.Title, url.Hits, labels, nullTime(url.ExpiresAt), url.MaxClicks, nullTime(url.DeletedAt), revisions, url.Gone(time.Now()), created, keepHits)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateURL relies on the unique short code index to make the insert atomic,
+// and on the partial unique destination index to keep a destination from
+// links that aren't gone. An insert rejected by the latter is reported as
+// ErrDestinationExists.
+func (s *Store) CreateURL(ctx context.Context, url models.URL) error {
+	labels, revisions, err := encodeJSON(url)
+	if err != nil {
+		return err
+	}
+	url.Stamp(time.Now(), time.Time{})
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if err = s.releaseDestination(ctx, tx, url); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, s.q(`
+		INSERT INTO urls (`+urlColumns+`, released) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (short_code) DO NOTHING`),
+		url.ShortCode, url.Destination, url.CreatedAt.UTC(), url.UpdatedAt.UTC(), url.Creator, url.Title, url.Hits, labels, nullTime(url.ExpiresAt), url.MaxClicks, nullTime(url.DeletedAt), revisions, url.Gone(time.Now()))
+	if err != nil {
+		// the failed insert may have aborted the transaction, so the holder
+		// is looked for outside it
+		_ = tx.Rollback()
+		if other, holderErr := s.destinationHolder(ctx, s.DB, url.ShortCode, url.Destination); holderErr == nil && other != "" {
+			return fmt.Errorf("%w: %s is shortened as %s", data.ErrDestinationExists, url.Destination, other)
+		}
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %s", data.ErrExists, url.ShortCode)
+	}
+	return tx.Commit()
+}
+
+// releaseDestination marks links to the destination of url under another
+// code that are gone as released. Destinations are only unique among links
+// that aren't deleted or released, so a gone link would otherwise stop the
+// destination being shortened again. The link itself is kept, answering
+// gone until it is swept, like a tombstone. Links written while gone are
+// released straight away.
+func (s *Store) releaseDestination(ctx context.Context, tx *sql.Tx, url models.URL) error {
+	_, err := tx.ExecContext(ctx, s.q(`
+		UPDATE urls SET released = ?
+		WHERE destination = ? AND short_code <> ?
+			AND (expires_at <= ? OR (max_clicks > 0 AND hits >= max_clicks))
+			AND deleted_at IS NULL AND NOT released`),
+		true, url.Destination, url.ShortCode, time.Now().UTC())
+	return err
+}
+
+// rowQuerier is a *sql.DB or *sql.Tx
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// destinationHolder returns the code other than shortCode that destination
+// is shortened as, among links that aren't deleted or released, or "" if
+// there is none
+func (s *Store) destinationHolder(ctx context.Context, q rowQuerier, shortCode, destination string) (string, error) {
+	var other string
+	err := q.QueryRowContext(ctx, s.q(`
+		SELECT short_code FROM urls
+		WHERE destination = ? AND short_code <> ? AND deleted_at IS NULL AND NOT released`),
+		destination, shortCode).Scan(&other)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return other, err
+}
+
+// RecordHit checks the link has clicks left and counts the hit in a single
+// statement, so concurrent redirects can't take it over MaxClicks
+func (s *Store) RecordHit(ctx context.Context, shortCode string) error {
+	res, err := s.DB.ExecContext(ctx, s.q(`
+		UPDATE urls SET hits = hits + 1
+		WHERE short_code = ? AND (max_clicks = 0 OR hits < max_clicks)`), shortCode)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 1 {
+		return nil
+	}
+	return s.missingOrGone(ctx, shortCode)
+}
+
+// AddHits counts buffered hits in one transaction. Limited links are capped
+// at max_clicks, which RecordHit would have stopped them at.
+func (s *Store) AddHits(ctx context.Context, hits map[string]int64) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, s.q(`
+		UPDATE urls SET hits = CASE
+			WHEN max_clicks > 0 AND hits + ? > max_clicks THEN max_clicks
+			ELSE hits + ? END
+		WHERE short_code = ? AND (max_clicks = 0 OR hits < max_clicks)`))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for shortCode, n := range hits {
+		if _, err = stmt.ExecContext(ctx, n, n, shortCode); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Store) SoftDelete(ctx context.Context, shortCode string) error {
+	now := time.Now().UTC()
+	res, err := s.DB.ExecContext(ctx, s.q(`
+		UPDATE urls SET deleted_at = ?, updated_at = ?
+		WHERE short_code = ? AND deleted_at IS NULL`), now, now, shortCode)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 1 {
+		return nil
+	}
+	return s.missingOrGone(ctx, shortCode)
+}
+
+// UpdateDestination checks the new destination is free and moves the link in
+// one transaction. releaseDestination frees it from links that are gone.
+func (s *Store) UpdateDestination(ctx context.Context, shortCode, destination string) (models.URL, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return models.URL{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	u, err := scanURL(tx.QueryRowContext(ctx, s.q(`SELECT `+urlColumns+` FROM urls WHERE short_code = ?`+s.Dialect.LockRow), shortCode))
+	if err == sql.ErrNoRows {
+		return models.URL{}, fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+	}
+	if err != nil {
+		return models.URL{}, err
+	}
+	now := time.Now()
+	if u.Gone(now) {
+		return models.URL{}, fmt.Errorf("%w: %s", data.ErrGone, shortCode)
+	}
+	u.Redirect(destination, now)
+	if err = s.releaseDestination(ctx, tx, u); err != nil {
+		return models.URL{}, err
+	}
+	other, err := s.destinationHolder(ctx, tx, shortCode, destination)
+	if err != nil {
+		return models.URL{}, err
+	}
+	if other != "" {
+		return models.URL{}, fmt.Errorf("%w: %s is shortened as %s", data.ErrDestinationExists, destination, other)
+	}
+	_, revisions, err := encodeJSON(u)
+	if err != nil {
+		return models.URL{}, err
+	}
+	_, err = tx.ExecContext(ctx, s.q(`
+		UPDATE urls SET destination = ?, updated_at = ?, revisions = ?
+		WHERE short_code = ?`),
+		u.Destination, u.UpdatedAt.UTC(), revisions, shortCode)
+	if err != nil {
+		return models.URL{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return models.URL{}, err
+	}
+	return u, nil
+}
+
+// Restore checks the destination is free and brings the link back in one
+// transaction. releaseDestination frees it from links that are gone.
+func (s *Store) Restore(ctx context.Context, shortCode string) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	u, err := scanURL(tx.QueryRowContext(ctx, s.q(`SELECT `+urlColumns+` FROM urls WHERE short_code = ?`), shortCode))
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+	}
+	if err != nil {
+		return err
+	}
+	if !u.Deleted() {
+		return nil
+	}
+	if err = s.releaseDestination(ctx, tx, u); err != nil {
+		return err
+	}
+	other, err := s.destinationHolder(ctx, tx, shortCode, u.Destination)
+	if err != nil {
+		return err
+	}
+	if other != "" {
+		return fmt.Errorf("%w: %s is shortened as %s", data.ErrDestinationExists, u.Destination, other)
+	}
+	// a link that expired while deleted comes back already released
+	now := time.Now()
+	u.DeletedAt = nil
+	if _, err = tx.ExecContext(ctx, s.q(`UPDATE urls SET deleted_at = NULL, updated_at = ?, released = ? WHERE short_code = ?`), now.UTC(), u.Gone(now), shortCode); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// missingOrGone explains why an update of shortCode matched no rows
+func (s *Store) missingOrGone(ctx context.Context, shortCode string) error {
+	var exists bool
+	if err := s.DB.QueryRowContext(ctx, s.q(`SELECT EXISTS (SELECT 1 FROM urls WHERE short_code = ?)`), shortCode).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%w: %s", data.ErrGone, shortCode)
+	}
+	return fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+}
+
+// Sweep removes links that expired before expiredBefore and tombstones
+// deleted before deletedBefore
+func (s *Store) Sweep(ctx context.Context, expiredBefore, deletedBefore time.Time) (int, error) {
+	res, err := s.DB.ExecContext(ctx, s.q(`
+		DELETE FROM urls
+		WHERE (deleted_at IS NULL AND expires_at < ?) OR deleted_at < ?`), expiredBefore.UTC(), deletedBefore.UTC())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *Store) Delete(ctx context.Context, shortCode string) error {
+	res, err := s.DB.ExecContext(ctx, s.q(`DELETE FROM urls WHERE short_code = ?`), shortCode)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %s", data.ErrNotFound, shortCode)
+	}
+	return nil
+}
+
+// q rebinds query for the dialect
+func (s *Store) q(query string) string {
+	if s.Dialect.Rebind == nil {
+		return query
+	}
+	return s.Dialect.Rebind(query)
+}
+
+// urlColumns are selected in the order scanURL reads them
+const urlColumns = `short_code, destination, created_at, updated_at, creator, title, hits, labels, expires_at, max_clicks, deleted_at, revisions`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanURL(row scanner) (models.URL, error) {
+	var u models.URL
+	var created, updated, expires, deleted sql.NullTime
+	var labels, revisions []byte
+	if err := row.Scan(&u.ShortCode, &u.Destination, &created, &updated, &u.Creator, &u.Title, &u.Hits, &labels, &expires, &u.MaxClicks, &deleted, &revisions); err != nil {
+		return models.URL{}, err
+	}
+	u.CreatedAt, u.UpdatedAt = created.Time, updated.Time
+	if expires.Valid {
+		u.ExpiresAt = &expires.Time
+	}
+	if deleted.Valid {
+		u.DeletedAt = &deleted.Time
+	}
+	if err := json.Unmarshal(labels, &u.Labels); err != nil {
+		return models.URL{}, fmt.Errorf("error decoding labels of %s: %w", u.ShortCode, err)
+	}
+	if len(u.Labels) == 0 {
+		u.Labels = nil
+	}
+	if err := json.Unmarshal(revisions, &u.Revisions); err != nil {
+		return models.URL{}, fmt.Errorf("error decoding revisions of %s: %w", u.ShortCode, err)
+	}
+	if len(u.Revisions) == 0 {
+		u.Revisions = nil
+	}
+	return u, nil
+}
+
+// encodeJSON returns the labels and revisions of url as the JSON stored in
+// their columns
+func encodeJSON(url models.URL) (labels, revisions string, err error) {
+	labels, revisions = "{}", "[]"
+	if url.Labels != nil {
+		body, err := json.Marshal(url.Labels)
+		if err != nil {
+			return "", "", err
+		}
+		labels = string(body)
+	}
+	if url.Revisions != nil {
+		body, err := json.Marshal(url.Revisions)
+		if err != nil {
+			return "", "", err
+		}
+		revisions = string(body)
+	}
+	return labels, revisions, nil
+}
+
+// nullTime converts t for storage, in UTC like every other time
+func nullTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
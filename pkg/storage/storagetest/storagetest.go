@@ -0,0 +1,879 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+// Package storagetest is a conformance suite that every data.StorageReadWrite
+// implementation is expected to pass.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/data/models"
+)
+
+// Factory returns a new, opened and empty store. It is called once per test
+// and should register any cleanup of backing files or servers with t.Cleanup.
+type Factory func(t *testing.T) data.StorageReadWrite
+
+// Run runs the full conformance suite against the stores built by newStore
+func Run(t *testing.T, newStore Factory) {
+	tests := []struct {
+		name string
+		test func(*testing.T, data.StorageReadWrite)
+	}{
+		{"Health", testHealth},
+		{"RoundTrip", testRoundTrip},
+		{"ReverseLookup", testReverseLookup},
+		{"NotFound", testNotFound},
+		{"Overwrite", testOverwrite},
+		{"Delete", testDelete},
+		{"DeleteMissing", testDeleteMissing},
+		{"ConcurrentWriters", testConcurrentWriters},
+		{"ConcurrentOverwrite", testConcurrentOverwrite},
+		{"CreateIfAbsent", testCreateIfAbsent},
+		{"CreateTakenDestination", testCreateTakenDestination},
+		{"ConcurrentCreate", testConcurrentCreate},
+		{"Metadata", testMetadata},
+		{"OverwriteKeepsCreatedAt", testOverwriteKeepsCreatedAt},
+		{"RecordHit", testRecordHit},
+		{"AddHits", testAddHits},
+		{"RewriteKeepsHits", testRewriteKeepsHits},
+		{"MaxClicks", testMaxClicks},
+		{"Expiry", testExpiry},
+		{"ExpiredDestinationReused", testExpiredDestinationReused},
+		{"GoneLeavesDestination", testGoneLeavesDestination},
+		{"UpdateDestination", testUpdateDestination},
+		{"SoftDelete", testSoftDelete},
+		{"RestoreMissing", testRestoreMissing},
+		{"Sweep", testSweep},
+		{"List", testList},
+		{"ListEmpty", testListEmpty},
+		{"ListInvalidLimit", testListInvalidLimit},
+		{"CanceledContext", testCanceledContext},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			store := newStore(t)
+			defer func() {
+				if err := store.Close(); err != nil {
+					t.Errorf("error closing store: %v", err)
+				}
+			}()
+			tc.test(t, store)
+		})
+	}
+}
+
+func testHealth(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	if !store.Health(ctx) {
+		t.Error("opened store reported unhealthy")
+	}
+	if err := data.Probe(ctx, store); err != nil {
+		t.Errorf("Probe of opened store: %v", err)
+	}
+}
+
+func testRoundTrip(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	mustSet(t, store, "abcd123", "https://example.com")
+	u, err := store.GetURL(ctx, "abcd123")
+	if err != nil {
+		t.Fatalf("GetURL: %v", err)
+	}
+	if u.ShortCode != "abcd123" || u.Destination != "https://example.com" {
+		t.Errorf("GetURL returned %+v, want abcd123 -> https://example.com", u)
+	}
+}
+
+func testReverseLookup(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	mustSet(t, store, "abcd123", "https://example.com")
+	code, err := store.GetShortCode(ctx, "https://example.com")
+	if err != nil {
+		t.Fatalf("GetShortCode: %v", err)
+	}
+	if code != "abcd123" {
+		t.Errorf("GetShortCode returned %s, want abcd123", code)
+	}
+}
+
+func testNotFound(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	if _, err := store.GetURL(ctx, "missing"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("GetURL on missing code returned %v, want data.ErrNotFound", err)
+	}
+	if _, err := store.GetShortCode(ctx, "https://missing.example.com"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("GetShortCode on missing destination returned %v, want data.ErrNotFound", err)
+	}
+}
+
+func testOverwrite(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	mustSet(t, store, "abcd123", "https://example.com")
+	mustSet(t, store, "abcd123", "https://example.org")
+
+	u, err := store.GetURL(ctx, "abcd123")
+	if err != nil {
+		t.Fatalf("GetURL: %v", err)
+	}
+	if u.Destination != "https://example.org" {
+		t.Errorf("GetURL returned %s after overwrite, want https://example.org", u.Destination)
+	}
+	if _, err = store.GetShortCode(ctx, "https://example.com"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("GetShortCode on replaced destination returned %v, want data.ErrNotFound", err)
+	}
+}
+
+func testDelete(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	mustSet(t, store, "abcd123", "https://example.com")
+	if err := store.Delete(ctx, "abcd123"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.GetURL(ctx, "abcd123"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("GetURL after delete returned %v, want data.ErrNotFound", err)
+	}
+	if _, err := store.GetShortCode(ctx, "https://example.com"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("GetShortCode after delete returned %v, want data.ErrNotFound", err)
+	}
+}
+
+func testDeleteMissing(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	if err := store.Delete(ctx, "missing"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("Delete on missing code returned %v, want data.ErrNotFound", err)
+	}
+}
+
+func testConcurrentWriters(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	const writers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := store.SetURL(ctx, models.URL{ShortCode: code(i), Destination: destination(i)}); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent SetURL: %v", err)
+	}
+
+	for i := 0; i < writers; i++ {
+		u, err := store.GetURL(ctx, code(i))
+		if err != nil {
+			t.Errorf("GetURL(%s): %v", code(i), err)
+			continue
+		}
+		if u.Destination != destination(i) {
+			t.Errorf("GetURL(%s) returned %s, want %s", code(i), u.Destination, destination(i))
+		}
+		c, err := store.GetShortCode(ctx, destination(i))
+		if err != nil {
+			t.Errorf("GetShortCode(%s): %v", destination(i), err)
+			continue
+		}
+		if c != code(i) {
+			t.Errorf("GetShortCode(%s) returned %s, want %s", destination(i), c, code(i))
+		}
+	}
+}
+
+func testConcurrentOverwrite(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	const writers = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := store.SetURL(ctx, models.URL{ShortCode: "abcd123", Destination: destination(i)}); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent SetURL: %v", err)
+	}
+
+	u, err := store.GetURL(ctx, "abcd123")
+	if err != nil {
+		t.Fatalf("GetURL: %v", err)
+	}
+	for i := 0; i < writers; i++ {
+		code, err := store.GetShortCode(ctx, destination(i))
+		if destination(i) == u.Destination {
+			if err != nil || code != "abcd123" {
+				t.Errorf("GetShortCode(%s) returned %s, %v, want abcd123", destination(i), code, err)
+			}
+			continue
+		}
+		if !errors.Is(err, data.ErrNotFound) {
+			t.Errorf("GetShortCode(%s) for an overwritten destination returned %s, %v, want data.ErrNotFound", destination(i), code, err)
+		}
+	}
+}
+
+func testCreateIfAbsent(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "abcd123", Destination: "https://example.com"}); err != nil {
+		t.Fatalf("CreateURL on free code: %v", err)
+	}
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "abcd123", Destination: "https://example.org"}); !errors.Is(err, data.ErrExists) {
+		t.Errorf("CreateURL on taken code returned %v, want data.ErrExists", err)
+	}
+	u, err := store.GetURL(ctx, "abcd123")
+	if err != nil {
+		t.Fatalf("GetURL: %v", err)
+	}
+	if u.Destination != "https://example.com" {
+		t.Errorf("GetURL returned %s, want the first destination https://example.com", u.Destination)
+	}
+	code, err := store.GetShortCode(ctx, "https://example.com")
+	if err != nil {
+		t.Fatalf("GetShortCode: %v", err)
+	}
+	if code != "abcd123" {
+		t.Errorf("GetShortCode returned %s, want abcd123", code)
+	}
+}
+
+func testCreateTakenDestination(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "abcd123", Destination: "https://example.com"}); err != nil {
+		t.Fatalf("CreateURL: %v", err)
+	}
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "efgh456", Destination: "https://example.com"}); !errors.Is(err, data.ErrDestinationExists) {
+		t.Errorf("CreateURL on a taken destination returned %v, want data.ErrDestinationExists", err)
+	}
+	if _, err := store.GetURL(ctx, "efgh456"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("GetURL of the rejected code returned %v, want data.ErrNotFound", err)
+	}
+	code, err := store.GetShortCode(ctx, "https://example.com")
+	if err != nil || code != "abcd123" {
+		t.Errorf("GetShortCode returned %s, %v, want abcd123", code, err)
+	}
+	// deleting the holder frees the destination
+	if err := store.Delete(ctx, "abcd123"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "efgh456", Destination: "https://example.com"}); err != nil {
+		t.Errorf("CreateURL on a freed destination: %v", err)
+	}
+}
+
+func testConcurrentCreate(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	const writers = 20
+	var wg sync.WaitGroup
+	winners := make(chan string, writers)
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := store.CreateURL(ctx, models.URL{ShortCode: "abcd123", Destination: destination(i)})
+			switch {
+			case err == nil:
+				winners <- destination(i)
+			case !errors.Is(err, data.ErrExists):
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(winners)
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent CreateURL: %v", err)
+	}
+	if len(winners) != 1 {
+		t.Fatalf("%d concurrent CreateURL calls succeeded for the same code, want exactly 1", len(winners))
+	}
+	winner := <-winners
+	u, err := store.GetURL(ctx, "abcd123")
+	if err != nil {
+		t.Fatalf("GetURL: %v", err)
+	}
+	if u.Destination != winner {
+		t.Errorf("GetURL returned %s, want the winning destination %s", u.Destination, winner)
+	}
+}
+
+func testMetadata(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	created := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	want := models.URL{
+		Destination: "https://example.com",
+		ShortCode:   "abcd123",
+		CreatedAt:   created,
+		UpdatedAt:   created.Add(time.Hour),
+		Creator:     "luke",
+		Title:       "Example",
+		Hits:        3,
+		Labels:      map[string]string{"campaign": "spring"},
+	}
+	if err := store.CreateURL(ctx, want); err != nil {
+		t.Fatalf("CreateURL: %v", err)
+	}
+	u, err := store.GetURL(ctx, "abcd123")
+	if err != nil {
+		t.Fatalf("GetURL: %v", err)
+	}
+	if !u.CreatedAt.Equal(want.CreatedAt) || !u.UpdatedAt.Equal(want.UpdatedAt) {
+		t.Errorf("GetURL returned timestamps %v, %v, want %v, %v", u.CreatedAt, u.UpdatedAt, want.CreatedAt, want.UpdatedAt)
+	}
+	u.CreatedAt, u.UpdatedAt = want.CreatedAt, want.UpdatedAt
+	if !reflect.DeepEqual(u, want) {
+		t.Errorf("GetURL returned %+v, want %+v", u, want)
+	}
+
+	mustSet(t, store, "efgh456", "https://example.org")
+	u, err = store.GetURL(ctx, "efgh456")
+	if err != nil {
+		t.Fatalf("GetURL: %v", err)
+	}
+	if u.CreatedAt.IsZero() || u.UpdatedAt.IsZero() {
+		t.Errorf("GetURL returned zero timestamps %v, %v for a record written without them", u.CreatedAt, u.UpdatedAt)
+	}
+}
+
+func testOverwriteKeepsCreatedAt(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	created := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := store.SetURL(ctx, models.URL{ShortCode: "abcd123", Destination: "https://example.com", CreatedAt: created}); err != nil {
+		t.Fatalf("SetURL: %v", err)
+	}
+	mustSet(t, store, "abcd123", "https://example.org")
+	u, err := store.GetURL(ctx, "abcd123")
+	if err != nil {
+		t.Fatalf("GetURL: %v", err)
+	}
+	if !u.CreatedAt.Equal(created) {
+		t.Errorf("overwrite changed CreatedAt from %v to %v", created, u.CreatedAt)
+	}
+	if !u.UpdatedAt.After(created) {
+		t.Errorf("overwrite left UpdatedAt at %v", u.UpdatedAt)
+	}
+}
+
+func testRecordHit(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	mustSet(t, store, "abcd123", "https://example.com")
+	const hits = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, hits)
+	for i := 0; i < hits; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := store.RecordHit(ctx, "abcd123"); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent RecordHit: %v", err)
+	}
+	u, err := store.GetURL(ctx, "abcd123")
+	if err != nil {
+		t.Fatalf("GetURL: %v", err)
+	}
+	if u.Hits != hits {
+		t.Errorf("GetURL returned %d hits, want %d", u.Hits, hits)
+	}
+	if err = store.RecordHit(ctx, "missing"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("RecordHit on missing code returned %v, want data.ErrNotFound", err)
+	}
+}
+
+func testAddHits(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	mustSet(t, store, "abcd123", "https://example.com")
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "efgh456", Destination: "https://example.org", MaxClicks: 3}); err != nil {
+		t.Fatalf("CreateURL: %v", err)
+	}
+	if err := data.AddHits(ctx, store, map[string]int64{"abcd123": 5, "efgh456": 10, "missing": 2}); err != nil {
+		t.Fatalf("AddHits: %v", err)
+	}
+	if u, err := store.GetURL(ctx, "abcd123"); err != nil || u.Hits != 5 {
+		t.Errorf("GetURL returned %d hits, %v after AddHits, want 5", u.Hits, err)
+	}
+	u, err := store.GetURL(ctx, "efgh456")
+	if !errors.Is(err, data.ErrGone) || u.Hits != 3 {
+		t.Errorf("GetURL on a limited link returned %d hits, %v after AddHits, want 3 and data.ErrGone", u.Hits, err)
+	}
+	if _, err = store.GetShortCode(ctx, "https://example.org"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("GetShortCode for an exhausted link returned %v, want data.ErrNotFound", err)
+	}
+	if _, err = store.GetURL(ctx, "missing"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("AddHits created a missing code: %v", err)
+	}
+}
+
+func testRewriteKeepsHits(t *testing.T, store data.StorageReadWrite) {
+	rewriter, ok := store.(data.Rewriter)
+	if !ok {
+		t.Skip("store can't rewrite links")
+	}
+	ctx := context.Background()
+	mustSet(t, store, "abcd123", "https://example.com")
+	stale, err := store.GetURL(ctx, "abcd123")
+	if err != nil {
+		t.Fatalf("GetURL: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = store.RecordHit(ctx, "abcd123"); err != nil {
+			t.Fatalf("RecordHit: %v", err)
+		}
+	}
+	stale.Destination = "https://example.org"
+	if err = rewriter.RewriteURL(ctx, stale); err != nil {
+		t.Fatalf("RewriteURL: %v", err)
+	}
+	u, err := store.GetURL(ctx, "abcd123")
+	if err != nil {
+		t.Fatalf("GetURL: %v", err)
+	}
+	if u.Destination != "https://example.org" || u.Hits != 2 {
+		t.Errorf("GetURL returned %s with %d hits after RewriteURL, want https://example.org with 2", u.Destination, u.Hits)
+	}
+	if code, err := store.GetShortCode(ctx, "https://example.org"); err != nil || code != "abcd123" {
+		t.Errorf("GetShortCode returned %s, %v after RewriteURL, want abcd123", code, err)
+	}
+
+	// a link that isn't stored is written with the hits it is given
+	if err = rewriter.RewriteURL(ctx, models.URL{ShortCode: "efgh456", Destination: "https://example.net", Hits: 3}); err != nil {
+		t.Fatalf("RewriteURL: %v", err)
+	}
+	if u, err = store.GetURL(ctx, "efgh456"); err != nil || u.Hits != 3 {
+		t.Errorf("GetURL returned %d hits, %v for a rewritten new link, want 3", u.Hits, err)
+	}
+}
+
+func testMaxClicks(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	const maxClicks = 3
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "abcd123", Destination: "https://example.com", MaxClicks: maxClicks}); err != nil {
+		t.Fatalf("CreateURL: %v", err)
+	}
+	const attempts = 10
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	counted, gone := 0, 0
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := store.RecordHit(ctx, "abcd123")
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				counted++
+			case errors.Is(err, data.ErrGone):
+				gone++
+			default:
+				t.Errorf("concurrent RecordHit: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if counted != maxClicks || gone != attempts-maxClicks {
+		t.Errorf("RecordHit counted %d and refused %d hits, want %d and %d", counted, gone, maxClicks, attempts-maxClicks)
+	}
+
+	u, err := store.GetURL(ctx, "abcd123")
+	if !errors.Is(err, data.ErrGone) {
+		t.Errorf("GetURL on exhausted link returned %v, want data.ErrGone", err)
+	}
+	if u.Hits != maxClicks || u.MaxClicks != maxClicks {
+		t.Errorf("GetURL on exhausted link returned %d/%d clicks, want %d/%d", u.Hits, u.MaxClicks, maxClicks, maxClicks)
+	}
+	if _, err = store.GetShortCode(ctx, "https://example.com"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("GetShortCode on exhausted destination returned %v, want data.ErrNotFound", err)
+	}
+	if err = store.CreateURL(ctx, models.URL{ShortCode: "efgh456", Destination: "https://example.com"}); err != nil {
+		t.Fatalf("CreateURL reusing an exhausted destination: %v", err)
+	}
+	if code, err := store.GetShortCode(ctx, "https://example.com"); err != nil || code != "efgh456" {
+		t.Errorf("GetShortCode after reuse returned %q, %v, want efgh456", code, err)
+	}
+}
+
+func testExpiry(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Minute)
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "abcd123", Destination: "https://example.com", ExpiresAt: &future}); err != nil {
+		t.Fatalf("CreateURL: %v", err)
+	}
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "efgh456", Destination: "https://example.org", ExpiresAt: &past}); err != nil {
+		t.Fatalf("CreateURL: %v", err)
+	}
+
+	u, err := store.GetURL(ctx, "abcd123")
+	if err != nil {
+		t.Fatalf("GetURL on unexpired link: %v", err)
+	}
+	if u.ExpiresAt == nil || !u.ExpiresAt.Equal(future) {
+		t.Errorf("GetURL returned ExpiresAt %v, want %v", u.ExpiresAt, future)
+	}
+	if u, err = store.GetURL(ctx, "efgh456"); !errors.Is(err, data.ErrGone) {
+		t.Errorf("GetURL on expired link returned %v, want data.ErrGone", err)
+	} else if u.Destination != "https://example.org" {
+		t.Errorf("GetURL on expired link returned %+v, want the expired record", u)
+	}
+	if _, err = store.GetShortCode(ctx, "https://example.org"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("GetShortCode on expired destination returned %v, want data.ErrNotFound", err)
+	}
+	if err = store.CreateURL(ctx, models.URL{ShortCode: "efgh456", Destination: "https://example.net"}); !errors.Is(err, data.ErrExists) {
+		t.Errorf("CreateURL on an expired but unswept code returned %v, want data.ErrExists", err)
+	}
+}
+
+func testExpiredDestinationReused(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	past := time.Now().Add(-time.Minute)
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "abcd123", Destination: "https://example.com", ExpiresAt: &past}); err != nil {
+		t.Fatalf("CreateURL: %v", err)
+	}
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "efgh456", Destination: "https://example.com"}); err != nil {
+		t.Fatalf("CreateURL for an expired destination: %v", err)
+	}
+	// the expired link keeps answering gone until it is swept
+	if _, err := store.GetURL(ctx, "abcd123"); !errors.Is(err, data.ErrGone) {
+		t.Errorf("GetURL of the expired code returned %v after reusing its destination, want ErrGone", err)
+	}
+	if err := store.Delete(ctx, "abcd123"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	code, err := store.GetShortCode(ctx, "https://example.com")
+	if err != nil || code != "efgh456" {
+		t.Errorf("GetShortCode returned %s, %v after deleting the expired code, want efgh456", code, err)
+	}
+
+	// the same goes for a link that used up its clicks
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "ijkl789", Destination: "https://example.org", MaxClicks: 1}); err != nil {
+		t.Fatalf("CreateURL: %v", err)
+	}
+	if err := store.RecordHit(ctx, "ijkl789"); err != nil {
+		t.Fatalf("RecordHit: %v", err)
+	}
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "mnop012", Destination: "https://example.org"}); err != nil {
+		t.Fatalf("CreateURL for an exhausted destination: %v", err)
+	}
+	if _, err := store.GetURL(ctx, "ijkl789"); !errors.Is(err, data.ErrGone) {
+		t.Errorf("GetURL of the exhausted code returned %v after reusing its destination, want ErrGone", err)
+	}
+	if code, err = store.GetShortCode(ctx, "https://example.org"); err != nil || code != "mnop012" {
+		t.Errorf("GetShortCode returned %s, %v for the reused destination, want mnop012", code, err)
+	}
+}
+
+func testGoneLeavesDestination(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "abcd123", Destination: "https://example.com"}); err != nil {
+		t.Fatalf("CreateURL: %v", err)
+	}
+	// a link that is gone from the start must not take the destination over
+	past := time.Now().Add(-time.Minute)
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "efgh456", Destination: "https://example.com", ExpiresAt: &past}); err != nil {
+		t.Fatalf("CreateURL of an expired link: %v", err)
+	}
+	code, err := store.GetShortCode(ctx, "https://example.com")
+	if err != nil || code != "abcd123" {
+		t.Errorf("GetShortCode returned %s, %v after storing an expired link, want abcd123", code, err)
+	}
+}
+
+func testSweep(t *testing.T, store data.StorageReadWrite) {
+	sweeper, ok := store.(data.Sweeper)
+	if !ok {
+		t.Skip("store expires links on its own")
+	}
+	ctx := context.Background()
+	past := time.Now().Add(-time.Minute)
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "abcd123", Destination: "https://example.com", ExpiresAt: &past}); err != nil {
+		t.Fatalf("CreateURL: %v", err)
+	}
+	mustSet(t, store, "efgh456", "https://example.org")
+	// a tombstone is kept for its quarantine even though it has expired
+	beforeDelete := time.Now()
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "ijkl789", Destination: "https://example.net", ExpiresAt: &past}); err != nil {
+		t.Fatalf("CreateURL: %v", err)
+	}
+	if err := store.SoftDelete(ctx, "ijkl789"); err != nil {
+		t.Fatalf("SoftDelete: %v", err)
+	}
+
+	if n, err := sweeper.Sweep(ctx, past.Add(-time.Minute), beforeDelete); err != nil || n != 0 {
+		t.Errorf("Sweep before the expiry removed %d, %v, want 0", n, err)
+	}
+	if n, err := sweeper.Sweep(ctx, time.Now(), beforeDelete); err != nil || n != 1 {
+		t.Errorf("Sweep removed %d, %v, want 1", n, err)
+	}
+	if _, err := store.GetURL(ctx, "abcd123"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("GetURL after Sweep returned %v, want data.ErrNotFound", err)
+	}
+	if _, err := store.GetURL(ctx, "ijkl789"); !errors.Is(err, data.ErrGone) {
+		t.Errorf("Sweep removed a tombstone during its quarantine: %v", err)
+	}
+	if n, err := sweeper.Sweep(ctx, time.Now(), time.Now()); err != nil || n != 1 {
+		t.Errorf("Sweep after the quarantine removed %d, %v, want 1", n, err)
+	}
+	if _, err := store.GetURL(ctx, "efgh456"); err != nil {
+		t.Errorf("Sweep removed an unexpired link: %v", err)
+	}
+}
+
+func testUpdateDestination(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	mustSet(t, store, "abcd123", "https://example.com")
+	mustSet(t, store, "efgh456", "https://example.org")
+	if _, err := store.UpdateDestination(ctx, "abcd123", "https://example.org"); !errors.Is(err, data.ErrDestinationExists) {
+		t.Errorf("UpdateDestination to a shortened destination returned %v, want data.ErrDestinationExists", err)
+	}
+
+	before := time.Now()
+	u, err := store.UpdateDestination(ctx, "abcd123", "https://example.net")
+	if err != nil {
+		t.Fatalf("UpdateDestination: %v", err)
+	}
+	if u.Destination != "https://example.net" || len(u.Revisions) != 1 {
+		t.Fatalf("UpdateDestination returned %+v, want example.net with one revision", u)
+	}
+	if r := u.Revisions[0]; r.Destination != "https://example.com" || r.ReplacedAt.Before(before.Add(-time.Second)) {
+		t.Errorf("UpdateDestination recorded revision %+v, want example.com replaced now", r)
+	}
+	// unchanged destinations aren't recorded
+	if _, err = store.UpdateDestination(ctx, "abcd123", "https://example.net"); err != nil {
+		t.Fatalf("UpdateDestination: %v", err)
+	}
+	if u, err = store.GetURL(ctx, "abcd123"); err != nil {
+		t.Fatalf("GetURL: %v", err)
+	}
+	if u.Destination != "https://example.net" || len(u.Revisions) != 1 || u.Revisions[0].Destination != "https://example.com" {
+		t.Errorf("GetURL after UpdateDestination returned %+v", u)
+	}
+	if code, err := store.GetShortCode(ctx, "https://example.net"); err != nil || code != "abcd123" {
+		t.Errorf("GetShortCode on new destination returned %q, %v, want abcd123", code, err)
+	}
+	if _, err = store.GetShortCode(ctx, "https://example.com"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("GetShortCode on old destination returned %v, want data.ErrNotFound", err)
+	}
+
+	if _, err = store.UpdateDestination(ctx, "missing", "https://example.com"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("UpdateDestination on missing code returned %v, want data.ErrNotFound", err)
+	}
+	if err = store.SoftDelete(ctx, "efgh456"); err != nil {
+		t.Fatalf("SoftDelete: %v", err)
+	}
+	if _, err = store.UpdateDestination(ctx, "efgh456", "https://example.com"); !errors.Is(err, data.ErrGone) {
+		t.Errorf("UpdateDestination on tombstone returned %v, want data.ErrGone", err)
+	}
+}
+
+func testSoftDelete(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	mustSet(t, store, "abcd123", "https://example.com")
+	if err := store.SoftDelete(ctx, "abcd123"); err != nil {
+		t.Fatalf("SoftDelete: %v", err)
+	}
+	u, err := store.GetURL(ctx, "abcd123")
+	if !errors.Is(err, data.ErrGone) {
+		t.Errorf("GetURL on tombstone returned %v, want data.ErrGone", err)
+	}
+	if u.DeletedAt == nil || u.Destination != "https://example.com" {
+		t.Errorf("GetURL on tombstone returned %+v, want the record with DeletedAt set", u)
+	}
+	if err = store.SoftDelete(ctx, "abcd123"); !errors.Is(err, data.ErrGone) {
+		t.Errorf("SoftDelete on tombstone returned %v, want data.ErrGone", err)
+	}
+	if _, err = store.GetShortCode(ctx, "https://example.com"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("GetShortCode on deleted destination returned %v, want data.ErrNotFound", err)
+	}
+	if err = store.CreateURL(ctx, models.URL{ShortCode: "abcd123", Destination: "https://example.org"}); !errors.Is(err, data.ErrExists) {
+		t.Errorf("CreateURL on a quarantined code returned %v, want data.ErrExists", err)
+	}
+
+	// the destination is free to be shortened again, which blocks the restore
+	if err = store.CreateURL(ctx, models.URL{ShortCode: "efgh456", Destination: "https://example.com"}); err != nil {
+		t.Fatalf("CreateURL reusing a deleted destination: %v", err)
+	}
+	if err = store.Restore(ctx, "abcd123"); !errors.Is(err, data.ErrDestinationExists) {
+		t.Errorf("Restore with the destination in use returned %v, want data.ErrDestinationExists", err)
+	}
+	if err = store.Delete(ctx, "efgh456"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	if err = store.Restore(ctx, "abcd123"); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if u, err = store.GetURL(ctx, "abcd123"); err != nil || u.DeletedAt != nil {
+		t.Errorf("GetURL after Restore returned %+v, %v", u, err)
+	}
+	if code, err := store.GetShortCode(ctx, "https://example.com"); err != nil || code != "abcd123" {
+		t.Errorf("GetShortCode after Restore returned %q, %v, want abcd123", code, err)
+	}
+	if err = store.Restore(ctx, "abcd123"); err != nil {
+		t.Errorf("Restore on a live link returned %v, want nil", err)
+	}
+}
+
+func testRestoreMissing(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	if err := store.SoftDelete(ctx, "missing"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("SoftDelete on missing code returned %v, want data.ErrNotFound", err)
+	}
+	if err := store.Restore(ctx, "missing"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("Restore on missing code returned %v, want data.ErrNotFound", err)
+	}
+}
+
+func testList(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	const stored = 25
+	for i := 0; i < stored; i++ {
+		mustSet(t, store, code(i), destination(i))
+	}
+
+	seen := make(map[string]string)
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > stored {
+			t.Fatalf("List did not finish after %d pages", pages)
+		}
+		urls, next, err := store.List(ctx, cursor, 7)
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		for _, u := range urls {
+			seen[u.ShortCode] = u.Destination
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(seen) != stored {
+		t.Errorf("List returned %d codes, want %d", len(seen), stored)
+	}
+	for i := 0; i < stored; i++ {
+		if seen[code(i)] != destination(i) {
+			t.Errorf("List returned %s -> %s, want %s", code(i), seen[code(i)], destination(i))
+		}
+	}
+}
+
+func testListEmpty(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	urls, next, err := store.List(ctx, "", 10)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(urls) != 0 || next != "" {
+		t.Errorf("List on empty store returned %v, %q, want nothing", urls, next)
+	}
+}
+
+func testListInvalidLimit(t *testing.T, store data.StorageReadWrite) {
+	ctx := context.Background()
+	mustSet(t, store, "abcd123", "https://example.com")
+	for _, limit := range []int{0, -1} {
+		if _, _, err := store.List(ctx, "", limit); !errors.Is(err, data.ErrInvalidLimit) {
+			t.Errorf("List with limit %d returned %v, want ErrInvalidLimit", limit, err)
+		}
+	}
+}
+
+func testCanceledContext(t *testing.T, store data.StorageReadWrite) {
+	mustSet(t, store, "abcd123", "https://example.com")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := store.GetURL(ctx, "abcd123"); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetURL with canceled context returned %v, want context.Canceled", err)
+	}
+	if _, err := store.GetShortCode(ctx, "https://example.com"); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetShortCode with canceled context returned %v, want context.Canceled", err)
+	}
+	if err := store.SetURL(ctx, models.URL{ShortCode: "efgh456", Destination: "https://example.org"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("SetURL with canceled context returned %v, want context.Canceled", err)
+	}
+	if err := store.CreateURL(ctx, models.URL{ShortCode: "efgh456", Destination: "https://example.org"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("CreateURL with canceled context returned %v, want context.Canceled", err)
+	}
+	if _, _, err := store.List(ctx, "", 10); !errors.Is(err, context.Canceled) {
+		t.Errorf("List with canceled context returned %v, want context.Canceled", err)
+	}
+	if err := store.RecordHit(ctx, "abcd123"); !errors.Is(err, context.Canceled) {
+		t.Errorf("RecordHit with canceled context returned %v, want context.Canceled", err)
+	}
+	if err := store.Delete(ctx, "abcd123"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Delete with canceled context returned %v, want context.Canceled", err)
+	}
+	if err := store.SoftDelete(ctx, "abcd123"); !errors.Is(err, context.Canceled) {
+		t.Errorf("SoftDelete with canceled context returned %v, want context.Canceled", err)
+	}
+	if err := store.Restore(ctx, "abcd123"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Restore with canceled context returned %v, want context.Canceled", err)
+	}
+	if _, err := store.UpdateDestination(ctx, "abcd123", "https://example.org"); !errors.Is(err, context.Canceled) {
+		t.Errorf("UpdateDestination with canceled context returned %v, want context.Canceled", err)
+	}
+	if store.Health(ctx) {
+		t.Error("Health with canceled context reported healthy")
+	}
+	if err := data.Probe(ctx, store); !errors.Is(err, context.Canceled) {
+		t.Errorf("Probe with canceled context returned %v, want context.Canceled", err)
+	}
+}
+
+func mustSet(t *testing.T, store data.StorageReadWrite, shortCode, url string) {
+	t.Helper()
+	ctx := context.Background()
+	if err := store.SetURL(ctx, models.URL{ShortCode: shortCode, Destination: url}); err != nil {
+		t.Fatalf("SetURL(%s, %s): %v", shortCode, url, err)
+	}
+}
+
+func code(i int) string {
+	return fmt.Sprintf("code%03d", i)
+}
+
+func destination(i int) string {
+	return fmt.Sprintf("https://example.com/%d", i)
+}
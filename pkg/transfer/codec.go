@@ -0,0 +1,274 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package transfer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/lucasreed/smol/pkg/data/models"
+)
+
+type encoder struct {
+	format Format
+	w      *bufio.Writer
+	csv    *csv.Writer
+	count  int
+}
+
+func newEncoder(w *bufio.Writer, format Format) *encoder {
+	enc := &encoder{format: format, w: w}
+	if format == CSV {
+		enc.csv = csv.NewWriter(w)
+	}
+	return enc
+}
+
+func (e *encoder) begin() error {
+	switch e.format {
+	case JSON:
+		_, err := e.w.WriteString("[")
+		return err
+	case CSV:
+		return e.csv.Write(csvHeader)
+	}
+	return nil
+}
+
+func (e *encoder) encode(u models.URL) error {
+	if e.format == CSV {
+		row, err := toCSV(u)
+		if err != nil {
+			return err
+		}
+		return e.csv.Write(row)
+	}
+	body, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	sep, term := "", "\n"
+	if e.format == JSON {
+		sep, term = ",\n", ""
+		if e.count == 0 {
+			sep = "\n"
+		}
+	}
+	e.count++
+	if _, err = e.w.WriteString(sep); err != nil {
+		return err
+	}
+	if _, err = e.w.Write(body); err != nil {
+		return err
+	}
+	_, err = e.w.WriteString(term)
+	return err
+}
+
+func (e *encoder) end() error {
+	switch e.format {
+	case JSON:
+		_, err := e.w.WriteString("\n]\n")
+		return err
+	case CSV:
+		e.csv.Flush()
+		return e.csv.Error()
+	}
+	return nil
+}
+
+// decoder reads one URL at a time, returning io.EOF after the last one
+type decoder struct {
+	format  Format
+	json    *json.Decoder
+	csv     *csv.Reader
+	columns map[string]int
+}
+
+func newDecoder(r io.Reader, format Format) (*decoder, error) {
+	dec := &decoder{format: format}
+	switch format {
+	case JSON:
+		dec.json = json.NewDecoder(r)
+		tok, err := dec.json.Token()
+		if err != nil {
+			return nil, err
+		}
+		if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+			return nil, fmt.Errorf("expected a JSON array")
+		}
+	case NDJSON:
+		dec.json = json.NewDecoder(r)
+	case CSV:
+		dec.csv = csv.NewReader(r)
+		header, err := dec.csv.Read()
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV header: %w", err)
+		}
+		dec.columns = make(map[string]int, len(header))
+		for i, name := range header {
+			dec.columns[name] = i
+		}
+		for _, name := range csvHeader[:2] {
+			if _, ok := dec.columns[name]; !ok {
+				return nil, fmt.Errorf("CSV header is missing the %s column", name)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("not a valid format: %s", format)
+	}
+	return dec, nil
+}
+
+func (d *decoder) decode() (models.URL, error) {
+	var u models.URL
+	switch d.format {
+	case CSV:
+		row, err := d.csv.Read()
+		if err != nil {
+			return u, err
+		}
+		return d.fromCSV(row)
+	case JSON:
+		if !d.json.More() {
+			return u, io.EOF
+		}
+	}
+	err := d.json.Decode(&u)
+	return u, err
+}
+
+func toCSV(u models.URL) ([]string, error) {
+	expires := ""
+	if u.ExpiresAt != nil {
+		expires = formatTime(*u.ExpiresAt)
+	}
+	deleted := ""
+	if u.DeletedAt != nil {
+		deleted = formatTime(*u.DeletedAt)
+	}
+	maxClicks := ""
+	if u.MaxClicks > 0 {
+		maxClicks = strconv.FormatInt(u.MaxClicks, 10)
+	}
+	labels := ""
+	if len(u.Labels) > 0 {
+		body, err := json.Marshal(u.Labels)
+		if err != nil {
+			return nil, err
+		}
+		labels = string(body)
+	}
+	revisions := ""
+	if len(u.Revisions) > 0 {
+		body, err := json.Marshal(u.Revisions)
+		if err != nil {
+			return nil, err
+		}
+		revisions = string(body)
+	}
+	return []string{
+		u.ShortCode,
+		u.Destination,
+		formatTime(u.CreatedAt),
+		formatTime(u.UpdatedAt),
+		u.Creator,
+		u.Title,
+		strconv.FormatInt(u.Hits, 10),
+		labels,
+		expires,
+		maxClicks,
+		deleted,
+		revisions,
+	}, nil
+}
+
+// fromCSV reads a row laid out by the header, leaving any optional column
+// that is missing or empty at its zero value
+func (d *decoder) fromCSV(row []string) (models.URL, error) {
+	column := func(name string) string {
+		if i, ok := d.columns[name]; ok {
+			return row[i]
+		}
+		return ""
+	}
+	u := models.URL{
+		ShortCode:   column("ShortCode"),
+		Destination: column("Destination"),
+		Creator:     column("Creator"),
+		Title:       column("Title"),
+	}
+	var err error
+	if u.CreatedAt, err = parseTime(column("CreatedAt")); err != nil {
+		return u, err
+	}
+	if u.UpdatedAt, err = parseTime(column("UpdatedAt")); err != nil {
+		return u, err
+	}
+	if expires := column("ExpiresAt"); expires != "" {
+		t, err := parseTime(expires)
+		if err != nil {
+			return u, err
+		}
+		u.ExpiresAt = &t
+	}
+	if deleted := column("DeletedAt"); deleted != "" {
+		t, err := parseTime(deleted)
+		if err != nil {
+			return u, err
+		}
+		u.DeletedAt = &t
+	}
+	if hits := column("Hits"); hits != "" {
+		if u.Hits, err = strconv.ParseInt(hits, 10, 64); err != nil {
+			return u, fmt.Errorf("invalid Hits: %w", err)
+		}
+	}
+	if maxClicks := column("MaxClicks"); maxClicks != "" {
+		if u.MaxClicks, err = strconv.ParseInt(maxClicks, 10, 64); err != nil {
+			return u, fmt.Errorf("invalid MaxClicks: %w", err)
+		}
+	}
+	if labels := column("Labels"); labels != "" {
+		if err = json.Unmarshal([]byte(labels), &u.Labels); err != nil {
+			return u, fmt.Errorf("invalid Labels: %w", err)
+		}
+	}
+	if revisions := column("Revisions"); revisions != "" {
+		if err = json.Unmarshal([]byte(revisions), &u.Revisions); err != nil {
+			return u, fmt.Errorf("invalid Revisions: %w", err)
+		}
+	}
+	return u, nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
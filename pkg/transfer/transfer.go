@@ -0,0 +1,214 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+// Package transfer dumps and loads every link in a store as JSON, NDJSON or
+// CSV.
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/data/models"
+)
+
+// Format is an export file format
+type Format string
+
+const (
+	// JSON is a single array of URLs
+	JSON Format = "json"
+	// NDJSON is one URL object per line
+	NDJSON Format = "ndjson"
+	// CSV has a header row naming the columns. Labels are a JSON object.
+	CSV Format = "csv"
+)
+
+// ParseFormat checks that name is a supported format
+func ParseFormat(name string) (Format, error) {
+	switch f := Format(name); f {
+	case JSON, NDJSON, CSV:
+		return f, nil
+	}
+	return "", fmt.Errorf("not a valid format: %s", name)
+}
+
+// ContentType is the media type of f, for serving exports over HTTP
+func (f Format) ContentType() string {
+	switch f {
+	case NDJSON:
+		return "application/x-ndjson"
+	case CSV:
+		return "text/csv"
+	}
+	return "application/json"
+}
+
+// Policy says what Import does with a record whose short code is already
+// taken, or whose destination is already shortened under another code
+type Policy string
+
+const (
+	// Skip leaves the stored link alone
+	Skip Policy = "skip"
+	// Overwrite replaces the stored link
+	Overwrite Policy = "overwrite"
+	// Fail stops the import. Links imported before the conflict are kept.
+	Fail Policy = "fail"
+)
+
+// ParsePolicy checks that name is a supported conflict policy
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(name); p {
+	case Skip, Overwrite, Fail:
+		return p, nil
+	}
+	return "", fmt.Errorf("not a valid conflict policy: %s", name)
+}
+
+// ErrConflict is returned by Import under the Fail policy
+var ErrConflict = errors.New("conflicts with a stored link")
+
+// ErrInvalid is returned by Import under the Fail policy for a record whose
+// destination isn't a valid url
+var ErrInvalid = errors.New("not a valid url")
+
+// listBatchSize is the page size Export reads the store with
+const listBatchSize = 500
+
+// csvHeader names the CSV columns. Only ShortCode and Destination are needed
+// on import.
+var csvHeader = []string{"ShortCode", "Destination", "CreatedAt", "UpdatedAt", "Creator", "Title", "Hits", "Labels", "ExpiresAt", "MaxClicks", "DeletedAt", "Revisions"}
+
+// Export writes every link in store to w, returning how many were written
+func Export(ctx context.Context, store data.StorageReader, w io.Writer, format Format) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := newEncoder(bw, format)
+	if err := enc.begin(); err != nil {
+		return 0, err
+	}
+	count := 0
+	cursor := ""
+	for {
+		urls, next, err := store.List(ctx, cursor, listBatchSize)
+		if err != nil {
+			return count, err
+		}
+		for _, u := range urls {
+			if err = enc.encode(u); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if err := enc.end(); err != nil {
+		return count, err
+	}
+	return count, bw.Flush()
+}
+
+// Stats counts what Import did with each record
+type Stats struct {
+	Created     int
+	Overwritten int
+	Skipped     int
+	// Unchanged records were already stored with the same destination
+	Unchanged int
+	// Invalid records have a destination that isn't a valid url. They are
+	// left out unless the policy is Fail.
+	Invalid int
+}
+
+// Import loads the links in r into store, resolving taken short codes with
+// policy. Records whose destination isn't a valid url are counted as Invalid,
+// or stop the import under Fail. Records are written as they are read, so an error part way through
+// leaves the records before it imported.
+func Import(ctx context.Context, store data.StorageReadWrite, r io.Reader, format Format, policy Policy) (Stats, error) {
+	var stats Stats
+	dec, err := newDecoder(r, format)
+	if err != nil {
+		return stats, err
+	}
+	for record := 1; ; record++ {
+		u, err := dec.decode()
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, fmt.Errorf("record %d: %w", record, err)
+		}
+		if u.ShortCode == "" || u.Destination == "" {
+			return stats, fmt.Errorf("record %d: ShortCode and Destination are required", record)
+		}
+		if !u.ValidateURL() {
+			if policy == Fail {
+				return stats, fmt.Errorf("record %d: %w: %s", record, ErrInvalid, u.Destination)
+			}
+			stats.Invalid++
+			continue
+		}
+		if err = importURL(ctx, store, u, policy, &stats); err != nil {
+			return stats, fmt.Errorf("record %d: %w", record, err)
+		}
+	}
+}
+
+func importURL(ctx context.Context, store data.StorageReadWrite, u models.URL, policy Policy, stats *Stats) error {
+	err := store.CreateURL(ctx, u)
+	if err == nil {
+		stats.Created++
+		return nil
+	}
+	if errors.Is(err, data.ErrDestinationExists) {
+		return resolveConflict(ctx, store, u, policy, stats, fmt.Errorf("%w: %v", ErrConflict, err))
+	}
+	if !errors.Is(err, data.ErrExists) {
+		return err
+	}
+	existing, err := store.GetURL(ctx, u.ShortCode)
+	if err != nil && !errors.Is(err, data.ErrGone) {
+		return err
+	}
+	if existing.Destination == u.Destination {
+		stats.Unchanged++
+		return nil
+	}
+	return resolveConflict(ctx, store, u, policy, stats, fmt.Errorf("%w: %s", ErrConflict, u.ShortCode))
+}
+
+// resolveConflict applies policy to a record that clashes with a stored link,
+// either on its short code or on its destination. conflict is returned under
+// the Fail policy.
+func resolveConflict(ctx context.Context, store data.StorageReadWrite, u models.URL, policy Policy, stats *Stats, conflict error) error {
+	switch policy {
+	case Overwrite:
+		if err := store.SetURL(ctx, u); err != nil {
+			return err
+		}
+		stats.Overwritten++
+	case Fail:
+		return conflict
+	default:
+		stats.Skipped++
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+// Copyright 2020 Luke Reed <luke@lreed.net>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucasreed/smol/pkg/data"
+	"github.com/lucasreed/smol/pkg/data/models"
+	"github.com/lucasreed/smol/pkg/storage/memory"
+)
+
+func newStore(t *testing.T, urls map[string]string) *memory.Store {
+	store := memory.NewStore("", 0)
+	if err := store.Open(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for code, destination := range urls {
+		if err := store.SetURL(context.Background(), models.URL{ShortCode: code, Destination: destination}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	urls := map[string]string{
+		"aaaaaaa": "https://example.com/a",
+		"bbbbbbb": "https://example.com/b?q=1,2",
+		"ccccccc": "https://example.com/\"c\"",
+	}
+	expires := time.Date(2030, 5, 1, 12, 0, 0, 0, time.UTC)
+	rich := models.URL{
+		ShortCode:   "ddddddd",
+		Destination: "https://example.com/d",
+		CreatedAt:   time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC),
+		UpdatedAt:   time.Date(2020, 5, 2, 12, 0, 0, 0, time.UTC),
+		Creator:     "luke",
+		Title:       "Spring, \"sale\"",
+		Hits:        7,
+		Labels:      map[string]string{"campaign": "spring"},
+		ExpiresAt:   &expires,
+		MaxClicks:   10,
+		Revisions:   []models.Revision{{Destination: "https://example.com/old", ReplacedAt: time.Date(2020, 5, 2, 12, 0, 0, 0, time.UTC)}},
+	}
+	for _, format := range []Format{JSON, NDJSON, CSV} {
+		t.Run(string(format), func(t *testing.T) {
+			src := newStore(t, urls)
+			if err := src.SetURL(ctx, rich); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			n, err := Export(ctx, src, &buf, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(urls)+1 {
+				t.Errorf("Export wrote %d links, want %d", n, len(urls)+1)
+			}
+
+			dst := newStore(t, nil)
+			stats, err := Import(ctx, dst, &buf, format, Fail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Created != len(urls)+1 {
+				t.Errorf("Import returned %+v, want %d created", stats, len(urls)+1)
+			}
+			if u, err := dst.GetURL(ctx, rich.ShortCode); err != nil || !reflect.DeepEqual(u, rich) {
+				t.Errorf("GetURL(%s) returned %+v, %v, want %+v", rich.ShortCode, u, err, rich)
+			}
+			for code, destination := range urls {
+				u, err := dst.GetURL(ctx, code)
+				if err != nil || u.Destination != destination {
+					t.Errorf("GetURL(%s) returned %s, %v, want %s", code, u.Destination, err, destination)
+				}
+			}
+		})
+	}
+}
+
+func TestImportPolicies(t *testing.T) {
+	ctx := context.Background()
+	input := "ShortCode,Destination\naaaaaaa,https://example.com/a\nbbbbbbb,https://example.com/new\nccccccc,https://example.com/c\nddddddd,https://example.com/taken\n"
+	existing := map[string]string{
+		"aaaaaaa": "https://example.com/a",
+		"bbbbbbb": "https://example.com/old",
+		"eeeeeee": "https://example.com/taken",
+	}
+
+	store := newStore(t, existing)
+	stats, err := Import(ctx, store, strings.NewReader(input), CSV, Skip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (Stats{Created: 1, Skipped: 2, Unchanged: 1}) {
+		t.Errorf("Import with skip returned %+v", stats)
+	}
+	if u, _ := store.GetURL(ctx, "bbbbbbb"); u.Destination != "https://example.com/old" {
+		t.Errorf("Import with skip replaced bbbbbbb with %s", u.Destination)
+	}
+	if _, err = store.GetURL(ctx, "ddddddd"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("Import with skip stored ddddddd over a taken destination: %v", err)
+	}
+
+	store = newStore(t, existing)
+	stats, err = Import(ctx, store, strings.NewReader(input), CSV, Overwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (Stats{Created: 1, Overwritten: 2, Unchanged: 1}) {
+		t.Errorf("Import with overwrite returned %+v", stats)
+	}
+	if u, _ := store.GetURL(ctx, "bbbbbbb"); u.Destination != "https://example.com/new" {
+		t.Errorf("Import with overwrite left bbbbbbb at %s", u.Destination)
+	}
+	if code, _ := store.GetShortCode(ctx, "https://example.com/taken"); code != "ddddddd" {
+		t.Errorf("Import with overwrite left https://example.com/taken shortened as %s", code)
+	}
+
+	store = newStore(t, existing)
+	if _, err = Import(ctx, store, strings.NewReader(input), CSV, Fail); !errors.Is(err, ErrConflict) {
+		t.Errorf("Import with fail returned %v, want ErrConflict", err)
+	}
+	store = newStore(t, existing)
+	taken := "ShortCode,Destination\nddddddd,https://example.com/taken\n"
+	if _, err = Import(ctx, store, strings.NewReader(taken), CSV, Fail); !errors.Is(err, ErrConflict) {
+		t.Errorf("Import with fail returned %v for a taken destination, want ErrConflict", err)
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	ctx := context.Background()
+	for name, tc := range map[string]struct {
+		format Format
+		input  string
+	}{
+		"missing column": {CSV, "ShortCode\naaaaaaa\n"},
+		"not an array":   {JSON, `{"ShortCode":"aaaaaaa"}`},
+		"empty field":    {NDJSON, `{"ShortCode":"aaaaaaa"}` + "\n"},
+	} {
+		if _, err := Import(ctx, newStore(t, nil), strings.NewReader(tc.input), tc.format, Skip); err == nil {
+			t.Errorf("%s: Import succeeded, want an error", name)
+		}
+	}
+}
+
+func TestImportInvalidDestination(t *testing.T) {
+	ctx := context.Background()
+	input := "ShortCode,Destination\naaaaaaa,https://example.com/a\nbbbbbbb,not a url\nccccccc,https://example.com/c\n"
+
+	store := newStore(t, nil)
+	stats, err := Import(ctx, store, strings.NewReader(input), CSV, Skip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (Stats{Created: 2, Invalid: 1}) {
+		t.Errorf("Import with skip returned %+v", stats)
+	}
+	if _, err = store.GetURL(ctx, "bbbbbbb"); !errors.Is(err, data.ErrNotFound) {
+		t.Errorf("Import stored the invalid record bbbbbbb: %v", err)
+	}
+
+	store = newStore(t, nil)
+	stats, err = Import(ctx, store, strings.NewReader(input), CSV, Fail)
+	if !errors.Is(err, ErrInvalid) {
+		t.Errorf("Import with fail returned %v, want ErrInvalid", err)
+	}
+	if stats != (Stats{Created: 1}) {
+		t.Errorf("Import with fail returned %+v, want only the record before the invalid one", stats)
+	}
+}